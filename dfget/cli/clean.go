@@ -0,0 +1,102 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// CleanWorkHome removes the task files in the data directory of the work home
+// that haven't been modified for olderThan, and returns the number of bytes
+// reclaimed. The files of a task in use, whose lock file holds the pid of a
+// running dfget, are never removed. The expired files are only listed if
+// ctx.DryRun is set.
+func CleanWorkHome(ctx *cfg.Context, olderThan time.Duration) (int64, error) {
+	if olderThan < 0 {
+		return 0, fmt.Errorf("threshold[%v] must not be negative", olderThan)
+	}
+	var (
+		dataDir   = filepath.Join(ctx.WorkHome, cfg.DataDirName)
+		deadline  = cfg.DefaultClock.Now().Add(-olderThan)
+		reclaimed int64
+	)
+	err := filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dataDir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !info.ModTime().Before(deadline) {
+			return nil
+		}
+		if pid, ok := lockedBy(path); ok {
+			ctx.ClientLogger.Debugf("skip file:%s locked by pid:%d", path, pid)
+			return nil
+		}
+		if ctx.DryRun {
+			ctx.ClientLogger.Infof("expired file:%s size:%d", path, info.Size())
+			util.Printer.Println(fmt.Sprintf("%s %d", path, info.Size()))
+		} else if err := os.Remove(path); err != nil {
+			ctx.ClientLogger.Warnf("remove expired file:%s error: %v", path, err)
+			return nil
+		} else {
+			ctx.ClientLogger.Infof("remove expired file:%s size:%d", path, info.Size())
+		}
+		reclaimed += info.Size()
+		return nil
+	})
+	return reclaimed, err
+}
+
+// lockedBy returns the pid of the running dfget using the task file, and the
+// lock file of the task is named by the task file without the suffix
+// '.service' or '.lock' plus cfg.LockFileSuffix.
+func lockedBy(path string) (int, bool) {
+	task := strings.TrimSuffix(strings.TrimSuffix(path, cfg.LockFileSuffix), ".service")
+	pid := util.LockHolder(task + cfg.LockFileSuffix)
+	if pid <= 0 {
+		return 0, false
+	}
+	// the signal 0 only checks whether the process exists
+	if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+		return pid, true
+	}
+	return 0, false
+}
+
+// runClean cleans the work home with cfg.Ctx.CleanOlderThan instead of
+// downloading, and exits.
+func runClean() {
+	reclaimed, err := CleanWorkHome(cfg.Ctx, cfg.Ctx.CleanOlderThan)
+	if err != nil {
+		cfg.Ctx.ClientLogger.Errorf("clean FAIL: %v", err)
+		util.Printer.Println(fmt.Sprintf("clean FAIL(1) error:%v", err))
+		os.Exit(1)
+	}
+	cfg.Ctx.ClientLogger.Infof("clean SUCCESS reclaimed:%d", reclaimed)
+	printInfo(cfg.Ctx, fmt.Sprintf("clean SUCCESS(0) reclaimed:%d", reclaimed))
+	os.Exit(0)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+func (suite *CliSuite) TestCleanWorkHome(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_home")
+	defer os.RemoveAll(tmpDir)
+	cfg.Ctx.WorkHome = tmpDir
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+
+	// nothing to clean if the data directory doesn't exist
+	reclaimed, err := CleanWorkHome(cfg.Ctx, time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(reclaimed, check.Equals, int64(0))
+	_, err = CleanWorkHome(cfg.Ctx, -time.Hour)
+	c.Assert(err, check.NotNil)
+
+	// the pid of an exited process
+	cmd := exec.Command("true")
+	c.Assert(cmd.Run(), check.IsNil)
+	deadPid := cmd.Process.Pid
+
+	dataDir := filepath.Join(tmpDir, cfg.DataDirName)
+	os.MkdirAll(filepath.Join(dataDir, "sub"), 0755)
+	var files = []struct {
+		name    string
+		content string
+		old     bool
+		kept    bool
+	}{
+		{"new-1", "12345", false, true},
+		{"old-1", "12345", true, false},
+		{"sub/old-2.service", "123", true, false},
+		{"running", "1234567", true, true},
+		{"running.service", "1234567", true, true},
+		{"running.lock", strconv.Itoa(os.Getpid()), true, true},
+		{"dead", "12", true, false},
+		{"dead.lock", strconv.Itoa(deadPid), true, false},
+	}
+	var expected int64
+	for _, f := range files {
+		path := filepath.Join(dataDir, f.name)
+		ioutil.WriteFile(path, []byte(f.content), 0644)
+		if f.old {
+			old := time.Now().Add(-2 * time.Hour)
+			os.Chtimes(path, old, old)
+		}
+		if !f.kept {
+			expected += int64(len(f.content))
+		}
+	}
+
+	cfg.Ctx.DryRun = true
+	reclaimed, err = CleanWorkHome(cfg.Ctx, time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(reclaimed, check.Equals, expected)
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dataDir, f.name))
+		c.Assert(err, check.IsNil, check.Commentf("%v", f))
+	}
+
+	cfg.Ctx.DryRun = false
+	reclaimed, err = CleanWorkHome(cfg.Ctx, time.Hour)
+	c.Assert(err, check.IsNil)
+	c.Assert(reclaimed, check.Equals, expected)
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dataDir, f.name))
+		c.Assert(err == nil, check.Equals, f.kept, check.Commentf("%v", f))
+	}
+}
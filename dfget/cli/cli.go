@@ -20,11 +20,24 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/downloader"
+	"github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/alibaba/Dragonfly/dfget/regist"
 	"github.com/alibaba/Dragonfly/dfget/util"
 	"github.com/alibaba/Dragonfly/version"
 )
@@ -32,13 +45,698 @@ import (
 // Run is running cli.
 func Run() {
 	initialize()
-	util.Printer.Println(fmt.Sprintf("--%s--  %s",
-		cfg.Ctx.StartTime.Format(cfg.DefaultTimestampFormat), cfg.Ctx.URL))
+	if len(cfg.Ctx.URLs) > 0 || !util.IsEmptyStr(cfg.Ctx.Manifest) {
+		runURLs()
+		return
+	}
+	if cfg.Ctx.VerifyOnly {
+		verifyOnly(cfg.Ctx)
+		return
+	}
+	printInfo(cfg.Ctx, fmt.Sprintf("--%s--  %s",
+		cfg.Ctx.StartTime.Format(cfg.DefaultTimestampFormat), cfg.RedactURL(cfg.Ctx.URL)))
+
+	if cfg.Ctx.DryRun {
+		dryRun(cfg.Ctx)
+		return
+	}
+
+	dd, err := download(context.Background(), cfg.Ctx, nil)
+	cost := cfg.Since(cfg.Ctx.StartTime).Seconds()
+	if !util.IsEmptyStr(cfg.Ctx.ResultFile) {
+		if e := writeResult(cfg.Ctx.ResultFile, newResult(cfg.Ctx, dd.Total(), cost, err)); e != nil {
+			cfg.Ctx.ClientLogger.Warnf("write result file[%s] error: %v", cfg.Ctx.ResultFile, e)
+		}
+	}
+	if code := report(cfg.Ctx, dd, cost, err); code != 0 {
+		os.Exit(code)
+	}
+}
+
+// runURLs downloads each of cfg.Ctx.URLs or the entries of cfg.Ctx.Manifest
+// into the directory of cfg.Ctx.Output, and at most cfg.Ctx.Concurrency of
+// them are downloaded in parallel. The results of them are aggregated into
+// the summary, and the failed ones are listed.
+func runURLs() {
+	split := cfg.Ctx.SplitURLs
+	if !util.IsEmptyStr(cfg.Ctx.Manifest) {
+		split = cfg.Ctx.SplitManifest
+	}
+	runtimes, err := split()
+	if err != nil {
+		cfg.Ctx.ClientLogger.Errorf("download FAIL: %v", err)
+		util.Printer.Println(fmt.Sprintf("download FAIL(1) error:%v", err))
+		os.Exit(1)
+	}
+	if cfg.Ctx.VerifyOnly {
+		for _, runtime := range runtimes {
+			verifyOnly(runtime)
+		}
+		return
+	}
+	if cfg.Ctx.DryRun {
+		for _, runtime := range runtimes {
+			dryRun(runtime)
+		}
+		return
+	}
+
+	results, codes := downloadURLs(runtimes)
+	sum := newSummary(results, cfg.Since(cfg.Ctx.StartTime).Seconds())
+	if cfg.Ctx.Preheat {
+		sum.CacheFiles, sum.CacheSize = cacheUsage(cfg.Ctx)
+	}
+	if !util.IsEmptyStr(cfg.Ctx.ResultFile) {
+		if e := writeResult(cfg.Ctx.ResultFile, sum); e != nil {
+			cfg.Ctx.ClientLogger.Warnf("write result file[%s] error: %v", cfg.Ctx.ResultFile, e)
+		}
+	}
+	if code := batchExitCode(codes, sum.Failed, cfg.Ctx.ContinueOnError); code != 0 {
+		cfg.Ctx.ClientLogger.Errorf("download FAIL files:%d failed:%d length:%d cost:%.3fs",
+			len(results), sum.Failed, sum.Length, sum.Cost)
+		util.Printer.Println(fmt.Sprintf("download FAIL(%d) cost(%.3fs) length:%d files:%d failed:%d",
+			code, sum.Cost, sum.Length, len(results), sum.Failed))
+		for _, r := range results {
+			if !r.Success {
+				util.Printer.Println(fmt.Sprintf("  FAIL %s error:%s", r.URL, r.Error))
+			}
+		}
+		os.Exit(code)
+	}
+	var cache string
+	if cfg.Ctx.Preheat {
+		cache = fmt.Sprintf(" cache(files:%d size:%d)", sum.CacheFiles, sum.CacheSize)
+	}
+	cfg.Ctx.ClientLogger.Infof("download SUCCESS files:%d length:%d cost:%.3fs%s",
+		len(results), sum.Length, sum.Cost, cache)
+	printInfo(cfg.Ctx, fmt.Sprintf("download SUCCESS(0) cost(%.3fs) length:%d files:%d%s",
+		sum.Cost, sum.Length, len(results), cache))
+}
+
+// cacheUsage returns the number and the total size of the files cached in
+// runtime.CacheDir, and the failure of reading it is only logged.
+func cacheUsage(runtime *cfg.Context) (int, int64) {
+	files, size, err := downloader.CacheUsage(runtime.CacheDir)
+	if err != nil {
+		runtime.ClientLogger.Warnf("read cache dir[%s] error: %v", runtime.CacheDir, err)
+	}
+	return files, size
+}
+
+// Download validates the runtime context, downloads the file of it and runs
+// the post hook after it succeeds, and returns the path of the downloaded
+// file. Unlike Run, it neither prints nor exits, so that dfget can be used as
+// a library, and the runtime context must be created by cfg.NewContext and
+// has its ClientLogger and ServerLogger set. Set CleanOnInterrupt to false to
+// keep SIGINT and SIGTERM for the caller. The path is empty if Preheat is set,
+// since the file is only cached. If VerifyOnly is set, the existing output is
+// verified and its path is returned without downloading, and if DryRun is set,
+// the source is only checked and the path is empty. The urls and the manifest
+// must be downloaded one by one instead.
+func Download(runtime *cfg.Context) (string, error) {
+	return DownloadContext(context.Background(), runtime)
+}
+
+// DownloadContext is like Download, but the download and the post hook are
+// canceled once goctx is done, and goctx.Err() is returned then. The partial
+// output is removed on cancellation unless Resume is set.
+func DownloadContext(goctx context.Context, runtime *cfg.Context) (string, error) {
+	if err := runtime.Validate(); err != nil {
+		return "", err
+	}
+	if len(runtime.URLs) > 0 {
+		return "", fmt.Errorf("urls are not supported, download each of them instead")
+	}
+	if !util.IsEmptyStr(runtime.Manifest) {
+		return "", fmt.Errorf("manifest is not supported, download each of its entries instead")
+	}
+	if runtime.VerifyOnly {
+		ctx, cancel := newDeadlineContext(goctx, runtime)
+		defer cancel()
+		if err := downloader.NewDirectDownloader(runtime).Verify(ctx); err != nil {
+			return "", err
+		}
+		return runtime.Output, nil
+	}
+	if runtime.DryRun {
+		ctx, cancel := newDeadlineContext(goctx, runtime)
+		defer cancel()
+		_, err := downloader.StatSource(ctx, runtime)
+		return "", err
+	}
+	if _, err := download(goctx, runtime, nil); err != nil {
+		return "", err
+	}
+	if runtime.Preheat {
+		return "", nil
+	}
+	return runtime.Output, nil
+}
+
+// download downloads the file of runtime and runs the post hook after it
+// succeeds, and runtime must be validated. Both of them are canceled once
+// goctx is done. The task is registered in session if it's not nil, which is
+// shared by the downloads of a batch.
+func download(goctx context.Context, runtime *cfg.Context, session *regist.SupernodeRegister) (
+	*downloader.DirectDownloader, error) {
+	if runtime.Force {
+		runtime.ClientLogger.Warnf("force is set, all the caches are ignored and %s is fetched again, "+
+			"it defeats the point of p2p", cfg.RedactURL(runtime.URL))
+	}
+	dd := downloader.NewDirectDownloader(runtime)
+	if runtime.Pattern != cfg.PatternSource {
+		reason, err := register(goctx, runtime, session)
+		if err != nil {
+			return dd, err
+		}
+		runtime.BackSourceReason = reason
+	}
+	if runtime.Notbs && runtime.BackSourceReason != cfg.BackSourceReasonNone {
+		runtime.BackSourceReason += cfg.ForceNotBackSourceAddition
+		return dd, errors.ErrBackSourceDisabled
+	}
+	if runtime.Metrics != nil && runtime.BackSourceReason != cfg.BackSourceReasonNone {
+		runtime.Metrics.RecordBackSource(runtime.BackSourceReason)
+	}
+	notifyStatus(runtime, "downloading "+runtime.URL)
+	err := downloadFile(goctx, runtime, dd)
+	if err == nil {
+		err = runPostHook(goctx, runtime)
+	}
+	if err != nil {
+		notifyStatus(runtime, "download failed "+runtime.URL)
+		return dd, err
+	}
+	notifyStatus(runtime, "downloaded "+runtime.URL)
+	return dd, nil
+}
+
+// register registers the task of runtime to its supernodes, and returns the
+// reason of going back to source. The task goes back to source even if it's
+// registered, because P2PDownloader has not been ported from the python
+// version yet, which is regarded as the failure of initializing p2p
+// downloading. The peer server isn't launched either, so the port is 0.
+// A new SupernodeRegister is created if session is nil. It fails only if goctx
+// is done.
+func register(goctx context.Context, runtime *cfg.Context, session *regist.SupernodeRegister) (int, error) {
+	if len(runtime.Node) == 0 && runtime.NodeResolver == nil {
+		runtime.ClientLogger.Warnf("no supernode to register to")
+		return cfg.BackSourceReasonRegisterFail, nil
+	}
+	sr := session
+	if sr == nil {
+		var err error
+		if sr, err = regist.NewSupernodeRegister(runtime); err != nil {
+			runtime.ClientLogger.Warnf("create supernode register error: %v", err)
+			return cfg.BackSourceReasonRegisterFail, nil
+		}
+	} else {
+		sr = sr.ForContext(runtime)
+	}
+	result, err := sr.RegisterContext(goctx, 0)
+	if goctx.Err() != nil {
+		return 0, goctx.Err()
+	}
+	if err != nil {
+		runtime.ClientLogger.Warnf("register fail: %v", err)
+		return cfg.BackSourceReasonRegisterFail, nil
+	}
+	runtime.ClientLogger.Infof("registered to node:%s taskID:%s, but p2p downloading is not supported yet",
+		result.Node, result.TaskID)
+	sdNotify(runtime, "READY=1")
+	return cfg.BackSourceReasonInitError, nil
+}
+
+// newSession creates the SupernodeRegister shared by the downloads of
+// runtime.URLs or runtime.Manifest, and it's nil if they never register or
+// it fails, in which case each of them creates its own.
+func newSession(runtime *cfg.Context) *regist.SupernodeRegister {
+	if runtime.Pattern == cfg.PatternSource || (len(runtime.Node) == 0 && runtime.NodeResolver == nil) {
+		return nil
+	}
+	sr, err := regist.NewSupernodeRegister(runtime)
+	if err != nil {
+		return nil
+	}
+	return sr
+}
+
+// notifyStatus sends the status to systemd if runtime.SystemdNotify is set.
+func notifyStatus(runtime *cfg.Context, status string) {
+	sdNotify(runtime, "STATUS="+status)
+}
+
+// sdNotify sends the state to systemd if runtime.SystemdNotify is set, and
+// the failure of it is only logged.
+func sdNotify(runtime *cfg.Context, state string) {
+	if !runtime.SystemdNotify {
+		return
+	}
+	if _, err := util.SdNotify(state); err != nil {
+		runtime.ClientLogger.Warnf("notify systemd of [%s] error: %v", state, err)
+	}
+}
+
+const (
+	// maxFailedExitCode caps the exit code counting the failed downloads,
+	// because the larger ones are reserved by shells and the interruption.
+	maxFailedExitCode = 125
+
+	// autoConcurrencyWindow is the window over which the throughput is
+	// measured to tune the concurrency if AutoConcurrency is set.
+	autoConcurrencyWindow = 2 * time.Second
+)
+
+// downloadURLs downloads each of runtimes, and at most cfg.Ctx.Concurrency of
+// them are downloaded in parallel. If cfg.Ctx.AutoConcurrency is set, the
+// number of the parallel ones is tuned by util.ConcurrencyTuner instead, which
+// is capped by Concurrency. The downloads not started yet are skipped once one
+// of them is interrupted, or once one of them fails unless ContinueOnError is
+// set. All of them are registered in one session of supernodes, which shares
+// the breaker of the nodes. It returns the result and the exit code of each of
+// runtimes.
+func downloadURLs(runtimes []*cfg.Context) ([]*result, []int) {
+	session := newSession(cfg.Ctx)
+	var (
+		results = make([]*result, len(runtimes))
+		codes   = make([]int, len(runtimes))
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		// running is the number of the downloads in progress, and cond is
+		// signaled once it decreases or the concurrency is tuned.
+		running int
+		cond    = sync.NewCond(&mu)
+		// skip is the reason of skipping the downloads not started yet
+		skip error
+	)
+	concurrency := func() int { return cfg.Ctx.Concurrency }
+	if cfg.Ctx.AutoConcurrency {
+		tuner := util.NewConcurrencyTuner(cfg.Ctx.Concurrency, cfg.Ctx.LocalLimit, cfg.DefaultClock.Now())
+		concurrency = tuner.Concurrency
+		done := make(chan struct{})
+		defer close(done)
+		go tuneConcurrency(tuner, cond, done)
+		for _, runtime := range runtimes {
+			countProgress(runtime, tuner)
+		}
+		defer func() {
+			cfg.Ctx.ClientLogger.Infof("auto concurrency:%d of max:%d settled:%t",
+				tuner.Concurrency(), cfg.Ctx.Concurrency, tuner.Settled())
+		}()
+	}
+	for i, runtime := range runtimes {
+		mu.Lock()
+		for running >= concurrency() {
+			cond.Wait()
+		}
+		err := skip
+		if err == nil {
+			running++
+		}
+		mu.Unlock()
+		if err != nil {
+			results[i], codes[i] = newResult(runtime, 0, 0, err), exitCode(err)
+			continue
+		}
+		printInfo(runtime, fmt.Sprintf("--%s--  %s",
+			cfg.DefaultClock.Now().Format(cfg.DefaultTimestampFormat), runtime.URL))
+		wg.Add(1)
+		go func(i int, runtime *cfg.Context) {
+			defer func() {
+				mu.Lock()
+				running--
+				cond.Broadcast()
+				mu.Unlock()
+				wg.Done()
+			}()
+			start := cfg.DefaultClock.Now()
+			dd, err := download(context.Background(), runtime, session)
+			mu.Lock()
+			if _, ok := err.(*interruptedError); ok {
+				skip = err
+			} else if err != nil && !runtime.ContinueOnError && skip == nil {
+				skip = fmt.Errorf("skipped since url[%s] failed", runtime.URL)
+			}
+			mu.Unlock()
+			cost := cfg.Since(start).Seconds()
+			results[i], codes[i] = newResult(runtime, dd.Total(), cost, err), report(runtime, dd, cost, err)
+		}(i, runtime)
+	}
+	wg.Wait()
+	return results, codes
+}
+
+// tuneConcurrency tunes the concurrency of tuner every autoConcurrencyWindow
+// and signals cond until it's settled or done is closed.
+func tuneConcurrency(tuner *util.ConcurrencyTuner, cond *sync.Cond, done <-chan struct{}) {
+	for !tuner.Settled() {
+		select {
+		case now := <-cfg.DefaultClock.After(autoConcurrencyWindow):
+			tuner.Tune(now)
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+// countProgress adds the bytes downloaded for runtime to tuner along with
+// its OnProgress.
+func countProgress(runtime *cfg.Context, tuner *util.ConcurrencyTuner) {
+	var (
+		last     int64
+		callback = runtime.OnProgress
+	)
+	runtime.OnProgress = func(done, total int64) {
+		tuner.Add(done - last)
+		last = done
+		if callback != nil {
+			callback(done, total)
+		}
+	}
+}
+
+// batchExitCode returns the exit code of the downloads with codes, which is
+// the number of the failed ones if continueOnError is set, and the exit code
+// of the interruption is preferred.
+func batchExitCode(codes []int, failed int, continueOnError bool) int {
+	code := 0
+	for _, c := range codes {
+		if c > code {
+			code = c
+		}
+	}
+	if code == 1 && continueOnError {
+		code = failed
+		if code > maxFailedExitCode {
+			code = maxFailedExitCode
+		}
+	}
+	return code
+}
+
+// report logs and prints the result of downloading the file of runtime, and
+// returns the exit code of it.
+func report(runtime *cfg.Context, dd *downloader.DirectDownloader, cost float64, err error) int {
+	reason := fmt.Sprintf("reason:%d(%s)", runtime.BackSourceReason, runtime.BackSourceReasonDesc())
+	if runtime.TraceRequests {
+		reason += " requestId:" + runtime.RequestID
+	}
+	if err != nil {
+		code := exitCode(err)
+		runtime.ClientLogger.Errorf("download FAIL cost:%.3fs %s: %v", cost, reason, err)
+		util.Printer.Println(fmt.Sprintf("download FAIL(%d) cost(%.3fs) length:%d %s error:%v",
+			code, cost, dd.Total(), reason, err))
+		return code
+	}
+	if runtime.Preheat {
+		files, size := cacheUsage(runtime)
+		reason += fmt.Sprintf(" cache(files:%d size:%d)", files, size)
+	}
+	resolved := ""
+	if u := dd.ResolvedURL(); !util.IsEmptyStr(u) && u != runtime.URL {
+		resolved = " url:" + cfg.RedactURL(u)
+	}
+	runtime.ClientLogger.Infof("download SUCCESS length:%d cost:%.3fs speed:%.0fB/s %s%s",
+		dd.Total(), cost, throughput(dd.Total()-dd.Resumed(), cost), reason, resolved)
+	printInfo(runtime, fmt.Sprintf("download SUCCESS(0) cost(%.3fs) length:%d %s",
+		cost, dd.Total(), reason))
+	return 0
+}
+
+// printInfo prints the msg which isn't an error unless runtime is quiet.
+func printInfo(runtime *cfg.Context, msg string) {
+	if !runtime.Quiet {
+		util.Printer.Println(msg)
+	}
+}
+
+// throughput returns the average bytes per second transferred in cost
+// seconds, and it's 0 if cost is not positive.
+func throughput(length int64, cost float64) float64 {
+	if cost <= 0 {
+		return 0
+	}
+	return float64(length) / cost
+}
+
+// result is the summary of the download written to cfg.Ctx.ResultFile in
+// json, so that the callers don't have to parse the output.
+type result struct {
+	URL              string  `json:"url"`
+	Output           string  `json:"output"`
+	Length           int64   `json:"length"`
+	Cost             float64 `json:"cost"`
+	Pattern          string  `json:"pattern"`
+	BackSourceReason int     `json:"backSourceReason"`
+	ReasonDesc       string  `json:"reasonDesc"`
+	Md5              string  `json:"md5,omitempty"`
+	Success          bool    `json:"success"`
+	Error            string  `json:"error,omitempty"`
+	// RequestID is sent to source if TraceRequests is set.
+	RequestID string `json:"requestId,omitempty"`
+	// Labels are the ones of the runtime context as they are.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// newResult creates the result of runtime, and the md5 of the output is
+// computed if the download succeeds and it's not streamed to stdout or unix
+// socket.
+func newResult(runtime *cfg.Context, length int64, cost float64, err error) *result {
+	r := &result{
+		URL:              runtime.URL,
+		Output:           runtime.Output,
+		Length:           length,
+		Cost:             cost,
+		Pattern:          runtime.Pattern,
+		BackSourceReason: runtime.BackSourceReason,
+		ReasonDesc:       runtime.BackSourceReasonDesc(),
+		Success:          err == nil,
+		Labels:           runtime.Labels,
+	}
+	if runtime.TraceRequests {
+		r.RequestID = runtime.RequestID
+	}
+	if runtime.Preheat {
+		// the output is removed after it's cached
+		r.Output = ""
+	}
+	if err != nil {
+		r.Error = err.Error()
+	} else if !runtime.StreamsOutput() && !runtime.Preheat {
+		r.Md5 = util.Md5Sum(runtime.Output)
+	}
+	return r
+}
+
+// summary aggregates the results of downloading cfg.Ctx.URLs, and it's
+// written to cfg.Ctx.ResultFile instead of the result of each url.
+type summary struct {
+	Length  int64     `json:"length"`
+	Cost    float64   `json:"cost"`
+	Failed  int       `json:"failed"`
+	Success bool      `json:"success"`
+	Results []*result `json:"results"`
+	// CacheFiles and CacheSize are the occupancy of CacheDir after
+	// preheating, and they're zero if Preheat is not set.
+	CacheFiles int   `json:"cacheFiles,omitempty"`
+	CacheSize  int64 `json:"cacheSize,omitempty"`
+}
+
+// newSummary aggregates the results, it succeeds only if all of them
+// succeed.
+func newSummary(results []*result, cost float64) *summary {
+	s := &summary{Cost: cost, Results: results}
+	for _, r := range results {
+		s.Length += r.Length
+		if !r.Success {
+			s.Failed++
+		}
+	}
+	s.Success = s.Failed == 0
+	return s
+}
+
+func writeResult(path string, r interface{}) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// dryRun checks the source of runtime without registering to supernode and
+// transferring any bytes.
+func dryRun(runtime *cfg.Context) {
+	ctx, cancel := newDeadlineContext(context.Background(), runtime)
+	defer cancel()
+	length, err := downloader.StatSource(ctx, runtime)
+	if err != nil {
+		runtime.ClientLogger.Errorf("dry run FAIL: %v", err)
+		util.Printer.Println(fmt.Sprintf("dry run FAIL(1) error:%v", err))
+		os.Exit(1)
+	}
+	runtime.ClientLogger.Infof("dry run SUCCESS output:%s length:%d",
+		runtime.Output, length)
+	printInfo(runtime, fmt.Sprintf("dry run SUCCESS(0) output:%s length:%d",
+		runtime.Output, length))
+}
+
+// verifyOnly verifies the existing output of runtime against its digest
+// without downloading, and exits with 1 if it doesn't match.
+func verifyOnly(runtime *cfg.Context) {
+	ctx, cancel := newDeadlineContext(context.Background(), runtime)
+	defer cancel()
+	dd := downloader.NewDirectDownloader(runtime)
+	if err := dd.Verify(ctx); err != nil {
+		runtime.ClientLogger.Errorf("verify FAIL output:%s: %v", runtime.Output, err)
+		util.Printer.Println(fmt.Sprintf("verify FAIL(1) output:%s error:%v", runtime.Output, err))
+		os.Exit(1)
+	}
+	runtime.ClientLogger.Infof("verify SUCCESS output:%s length:%d digest:%s",
+		runtime.Output, dd.Total(), dd.Digest)
+	printInfo(runtime, fmt.Sprintf("verify SUCCESS(0) output:%s length:%d digest:%s",
+		runtime.Output, dd.Total(), dd.Digest))
+}
+
+// interruptSignals are the signals canceling the download if
+// CleanOnInterrupt of the runtime context is set.
+var interruptSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// interruptedError means the download is canceled by the signal.
+type interruptedError struct {
+	sig os.Signal
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("download interrupted by signal %v", e.sig)
+}
+
+// lockOutput acquires the lock of runtime.Output with cfg.LockFileSuffix if
+// runtime.LockOutput is set and the output isn't streamed, and it fails with
+// errors.OutputLockedError if the lock is held by another dfget. The returned
+// function releases and removes the lock.
+func lockOutput(runtime *cfg.Context) (func(), error) {
+	if !runtime.LockOutput || runtime.StreamsOutput() {
+		return func() {}, nil
+	}
+	path := runtime.Output + cfg.LockFileSuffix
+	lock, err := util.TryLockFile(path)
+	if err == util.ErrFileLocked {
+		return nil, &errors.OutputLockedError{Path: runtime.Output, Pid: util.LockHolder(path)}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lock output[%s] error: %v", runtime.Output, err)
+	}
+	return func() {
+		if err := lock.Unlock(); err != nil {
+			runtime.ClientLogger.Warnf("unlock output[%s] error: %v", runtime.Output, err)
+		}
+	}, nil
+}
+
+// exitCode returns the exit code of dfget failing with err, it's 128 plus
+// the number of the signal if the download is interrupted, otherwise 1.
+func exitCode(err error) int {
+	if e, ok := err.(*interruptedError); ok {
+		if sig, ok := e.sig.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+	}
+	return 1
+}
+
+// downloadFile runs the downloader and cleans up its temporary files no
+// matter whether it succeeds. The download is canceled when runtime.Timeout
+// elapses, or when one of interruptSignals is received if
+// runtime.CleanOnInterrupt is set. It's canceled as well once goctx is done,
+// and goctx.Err() is returned then. The output is locked until it's cleaned
+// up, see lockOutput.
+func downloadFile(goctx context.Context, runtime *cfg.Context, d downloader.Downloader) error {
+	unlock, err := lockOutput(runtime)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer d.Cleanup()
+	ctx, cancel := newDeadlineContext(goctx, runtime)
+	defer cancel()
+	interrupted := make(chan os.Signal, 1)
+	if runtime.CleanOnInterrupt {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, interruptSignals...)
+		defer signal.Stop(sigs)
+		go func() {
+			select {
+			case sig := <-sigs:
+				interrupted <- sig
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	// The 'source' pattern never registers to supernode and downloads the
+	// file from source directly, and so do the other patterns for now.
+	err = d.Run(ctx)
+	select {
+	case sig := <-interrupted:
+		runtime.ClientLogger.Warnf("download is interrupted by signal %v", sig)
+		return &interruptedError{sig: sig}
+	default:
+	}
+	if err != nil && goctx.Err() != nil {
+		runtime.ClientLogger.Warnf("download is canceled: %v", err)
+		return goctx.Err()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("download timeout(%v): %v", runtime.Timeout, err)
+	}
+	return err
+}
+
+// runPostHook runs the command of runtime.PostHook with shell after the file
+// is downloaded, and its output is logged at debug level. The file is kept
+// even if the command fails. The command is killed once goctx is done.
+func runPostHook(goctx context.Context, runtime *cfg.Context) error {
+	command, err := runtime.PostHookCommand()
+	if err != nil || util.IsEmptyStr(command) {
+		return err
+	}
+	ctx, cancel := newDeadlineContext(goctx, runtime)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	runtime.ClientLogger.Debugf("post hook[%s] stdout:%s stderr:%s", command, stdout.String(), stderr.String())
+	if err != nil {
+		return fmt.Errorf("run post hook[%s] error: %v", command, err)
+	}
+	return nil
+}
+
+// newDeadlineContext returns a context with the deadline of runtime.Timeout
+// since the start of runtime, or without deadline if the timeout is 0.
+func newDeadlineContext(parent context.Context, runtime *cfg.Context) (context.Context, context.CancelFunc) {
+	if runtime.Timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, runtime.StartTime.Add(runtime.Timeout))
 }
 
 func initialize() {
 	initParameters()
 	initLog()
+	if len(unknownConfigKeys) > 0 {
+		cfg.Ctx.ClientLogger.Warnf("ignore unknown keys%v in config file[%s]",
+			unknownConfigKeys, cfg.Ctx.YAMLConfig)
+	}
+	// cleaning the work home needs no url
+	if cfg.Ctx.Clean {
+		runClean()
+	}
 	cfg.AssertContext(cfg.Ctx)
 	cfg.Ctx.ClientLogger.Infof("cmd params:%v", os.Args)
 	initProperties()
@@ -81,17 +779,50 @@ func initProperties() {
 
 func initLog() {
 	var (
-		logPath  = path.Join(cfg.Ctx.WorkHome, "logs")
+		// the work home is expanded by AssertContext later
+		workHome = os.ExpandEnv(cfg.Ctx.WorkHome)
+		logPath  = path.Join(workHome, "logs")
 		logLevel = "info"
 	)
+	// the logs are placed in the work home, so it's checked before
+	// AssertContext to fail clearly
+	panicIf(util.EnsureWritableDir(workHome), "invalid workhome")
 	if cfg.Ctx.Verbose {
 		logLevel = "debug"
 	}
+	if cfg.Ctx.Quiet {
+		logLevel = "error"
+	}
 	cfg.Ctx.ClientLogger = util.CreateLogger(logPath, "dfclient.log", logLevel, cfg.Ctx.Sign)
+	cfg.Ctx.ServerLogger = util.CreateLogger(logPath, "dfserver.log", logLevel, cfg.Ctx.Sign)
+	// the call system is defaulted here as AssertContext does, because the
+	// logs are created before it
+	if util.IsEmptyStr(cfg.Ctx.CallSystem) {
+		cfg.Ctx.CallSystem = cfg.DefaultCallSystem()
+	}
+	util.AddLogFields(cfg.Ctx.ClientLogger, logrus.Fields{"callSystem": cfg.Ctx.CallSystem})
+	if cfg.Ctx.LogJSON {
+		fields := logrus.Fields{
+			"sign":    cfg.Ctx.Sign,
+			"url":     cfg.RedactURL(cfg.Ctx.URL),
+			"pattern": cfg.Ctx.Pattern,
+		}
+		util.SetJSONFormatter(cfg.Ctx.ClientLogger, fields)
+		util.SetJSONFormatter(cfg.Ctx.ServerLogger, fields)
+	}
+	labels := make(logrus.Fields, len(cfg.Ctx.Labels))
+	for k, v := range cfg.Ctx.Labels {
+		labels[k] = v
+	}
+	util.AddLogFields(cfg.Ctx.ClientLogger, labels)
+	if cfg.Ctx.StreamsOutput() {
+		// keep stdout clean for the downloaded content, and the progress
+		// goes to stderr as well when it's streamed to unix socket
+		util.Printer.Out = os.Stderr
+	}
 	if cfg.Ctx.Console {
 		util.AddConsoleLog(cfg.Ctx.ClientLogger)
 	}
-	cfg.Ctx.ServerLogger = util.CreateLogger(logPath, "dfserver.log", logLevel, cfg.Ctx.Sign)
 }
 
 func panicIf(err error, msg string) {
@@ -18,12 +18,28 @@ package cli
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	dferrors "github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/alibaba/Dragonfly/dfget/types"
 	"github.com/alibaba/Dragonfly/dfget/util"
 	"github.com/go-check/check"
 	"github.com/spf13/pflag"
@@ -47,31 +63,166 @@ func (suite *CliSuite) SetUpTest(c *check.C) {
 func (suite *CliSuite) Test_setupFlags_noArguments(c *check.C) {
 	setupFlags(nil)
 	c.Assert(cfg.Ctx.LocalLimit, check.Equals, 20971520)
+	c.Assert(cfg.Ctx.MaxRetries, check.Equals, cfg.DefaultMaxRetries)
+	c.Assert(cfg.Ctx.RetryInterval, check.Equals, cfg.DefaultRetryInterval)
+	c.Assert(cfg.Ctx.RetryJitter, check.Equals, true)
+	c.Assert(cfg.Ctx.NodeFailureThreshold, check.Equals, cfg.DefaultNodeFailureThreshold)
+	c.Assert(cfg.Ctx.NodeCooldown, check.Equals, cfg.DefaultNodeCooldown)
+	c.Assert(cfg.Ctx.IdleTimeout, check.Equals, time.Duration(0))
+	c.Assert(cfg.Ctx.Concurrency, check.Equals, cfg.DefaultConcurrency)
+	c.Assert(cfg.Ctx.AutoConcurrency, check.Equals, false)
 	c.Assert(cfg.Ctx.Notbs, check.Equals, false)
+	c.Assert(cfg.Ctx.Resume, check.Equals, false)
+	c.Assert(cfg.Ctx.DryRun, check.Equals, false)
+	c.Assert(cfg.Ctx.Netrc, check.Equals, false)
+	c.Assert(cfg.Ctx.AcceptEncoding, check.Equals, false)
+	c.Assert(cfg.Ctx.StrictSize, check.Equals, false)
+	c.Assert(cfg.Ctx.Preheat, check.Equals, false)
+	c.Assert(cfg.Ctx.CacheDir, check.Equals, "")
+	c.Assert(cfg.Ctx.Proxy, check.Equals, "")
+	c.Assert(cfg.Ctx.ClientCert, check.Equals, "")
+	c.Assert(cfg.Ctx.ClientKey, check.Equals, "")
+	c.Assert(cfg.Ctx.CACert, check.Equals, "")
+	c.Assert(cfg.Ctx.Insecure, check.Equals, false)
+	c.Assert(cfg.Ctx.MkdirParents, check.Equals, false)
+	c.Assert(cfg.Ctx.ResultFile, check.Equals, "")
+	c.Assert(cfg.Ctx.PostHook, check.Equals, "")
+	c.Assert(cfg.Ctx.CleanOnInterrupt, check.Equals, true)
+	c.Assert(cfg.Ctx.Atomic, check.Equals, true)
+	c.Assert(cfg.Ctx.LockOutput, check.Equals, true)
+	c.Assert(cfg.Ctx.NoServe, check.Equals, false)
+	c.Assert(cfg.Ctx.CompressOutput, check.Equals, false)
+	c.Assert(cfg.Ctx.CompressStdout, check.Equals, false)
+	c.Assert(cfg.Ctx.PeerStats, check.Equals, false)
+	c.Assert(cfg.Ctx.Expect100, check.Equals, false)
+	c.Assert(cfg.Ctx.URLs, check.IsNil)
+	c.Assert(cfg.Ctx.FallbackURLs, check.IsNil)
+	c.Assert(cfg.Ctx.Manifest, check.Equals, "")
+	c.Assert(cfg.Ctx.Clean, check.Equals, false)
+	c.Assert(cfg.Ctx.CleanOlderThan, check.Equals, cfg.DefaultCleanOlderThan)
+	c.Assert(cfg.Ctx.FileMode, check.Equals, os.FileMode(0))
+	c.Assert(cfg.Ctx.OutputUID, check.Equals, "")
+	c.Assert(cfg.Ctx.OutputGID, check.Equals, "")
+	c.Assert(cfg.Ctx.UploadLimit, check.Equals, 0)
+	c.Assert(cfg.Ctx.LimitSchedule, check.IsNil)
+	c.Assert(cfg.Ctx.RangeStart, check.Equals, int64(0))
+	c.Assert(cfg.Ctx.RangeEnd, check.Equals, int64(0))
+	c.Assert(strings.HasSuffix(cfg.Ctx.NetrcFile, ".netrc"), check.Equals, true)
+	c.Assert(strings.HasSuffix(cfg.Ctx.WorkHome, ".small-dragonfly"), check.Equals, true)
 	c.Assert(cfg.Ctx.DFDaemon, check.Equals, false)
 	c.Assert(cfg.Ctx.Version, check.Equals, false)
 	c.Assert(cfg.Ctx.ShowBar, check.Equals, false)
 	c.Assert(cfg.Ctx.Console, check.Equals, false)
 	c.Assert(cfg.Ctx.Verbose, check.Equals, false)
+	c.Assert(cfg.Ctx.Quiet, check.Equals, false)
+	c.Assert(cfg.Ctx.TrustManifest, check.Equals, false)
+	c.Assert(cfg.Ctx.ContinueOnError, check.Equals, false)
+	c.Assert(cfg.Ctx.UserAgent, check.Equals, cfg.NewContext().UserAgent)
+	c.Assert(cfg.Ctx.NoFollowSymlinks, check.Equals, false)
+	c.Assert(cfg.Ctx.Labels, check.IsNil)
+	c.Assert(cfg.Ctx.PieceSize, check.Equals, 0)
+	c.Assert(cfg.Ctx.Force, check.Equals, false)
+	c.Assert(cfg.Ctx.VerifyOnly, check.Equals, false)
+	c.Assert(cfg.Ctx.FetchRemoteDigest, check.Equals, false)
+	c.Assert(cfg.Ctx.RequireRemoteDigest, check.Equals, false)
+	c.Assert(cfg.Ctx.WriteChecksumSidecar, check.Equals, false)
+	c.Assert(cfg.Ctx.SystemdNotify, check.Equals, false)
+	c.Assert(cfg.Ctx.BackSourceStatusAllow, check.IsNil)
+	c.Assert(cfg.Ctx.S3Endpoint, check.Equals, "")
+	c.Assert(cfg.Ctx.S3Region, check.Equals, "")
+	c.Assert(cfg.Ctx.DockerAuthConfig, check.Equals, cfg.NewContext().DockerAuthConfig)
+	c.Assert(cfg.Ctx.ProgressJSON, check.Equals, false)
+	c.Assert(cfg.Ctx.MaxConnsPerHost, check.Equals, 0)
+	c.Assert(cfg.Ctx.ForceHTTP2, check.Equals, false)
+	c.Assert(cfg.Ctx.TraceRequests, check.Equals, false)
+	c.Assert(cfg.Ctx.IdleConnTimeout, check.Equals, cfg.DefaultIdleConnTimeout)
+	c.Assert(cfg.Ctx.MaxRedirects, check.Equals, cfg.DefaultMaxRedirects)
+	c.Assert(cfg.Ctx.LogJSON, check.Equals, false)
 	c.Assert(cfg.Ctx.Help, check.Equals, false)
 }
 
 func (suite *CliSuite) Test_setupFlags_withArguments(c *check.C) {
 	arguments := map[string]string{
-		"url":        "http://www.taobao.com",
-		"output":     "/tmp/" + os.Args[0] + ".test",
-		"locallimit": "30M",
-		"totallimit": "50M",
-		"timeout":    "10",
-		"md5":        "123",
-		"identifier": "456",
-		"callsystem": "unit-test",
-		"filter":     "x&y",
-		"pattern":    "cdn",
-		"header":     "a:0,b:1,c:2",
-		"node":       "1,2",
-		"notbs":      "true",
-		"verbose":    "true",
+		"url":                   "http://www.taobao.com",
+		"urls":                  "http://a.b/c,http://a.b/d",
+		"fallbackurls":          "http://a.c/c,http://a.d/c",
+		"manifest":              "/tmp/manifest",
+		"trustmanifest":         "true",
+		"continueonerror":       "true",
+		"useragent":             "custom/1.0",
+		"nofollowsymlinks":      "true",
+		"label":                 "pipeline=12,commit=abc",
+		"piecesize":             "16M",
+		"force":                 "true",
+		"verifyonly":            "true",
+		"checksumsidecar":       "true",
+		"systemdnotify":         "true",
+		"backsourcestatusallow": "200,203,206",
+		"s3endpoint":            "http://127.0.0.1:9000",
+		"s3region":              "cn-north-1",
+		"progressjson":          "true",
+		"output":                "/tmp/" + os.Args[0] + ".test",
+		"locallimit":            "30M",
+		"totallimit":            "50M",
+		"uploadlimit":           "10M",
+		"noserve":               "true",
+		"limitschedule":         "09:00-18:00=2M,22:00-06:00=100M",
+		"maxsize":               "100M",
+		"range":                 "10-99",
+		"timeout":               "10",
+		"idletimeout":           "30s",
+		"md5":                   "123",
+		"digest":                "sha1:456",
+		"fetchremotedigest":     "true",
+		"requireremotedigest":   "true",
+		"identifier":            "456",
+		"taskid":                "0123456789abcdef",
+		"callsystem":            "unit-test",
+		"filter":                "x&y",
+		"pattern":               "cdn",
+		"header":                "a:0,b:1,c:2",
+		"node":                  "1,2",
+		"retry":                 "5",
+		"retryinterval":         "10s",
+		"nodefailurethreshold":  "5",
+		"nodecooldown":          "1m0s",
+		"concurrency":           "3",
+		"maxconnsperhost":       "2",
+		"forcehttp2":            "true",
+		"tracerequests":         "true",
+		"idleconntimeout":       "30s",
+		"maxredirects":          "3",
+		"autoconcurrency":       "true",
+		"notbs":                 "true",
+		"resume":                "true",
+		"dryrun":                "true",
+		"compressoutput":        "true",
+		"compressstdout":        "true",
+		"peerstats":             "true",
+		"expect100":             "true",
+		"clean":                 "true",
+		"cleanolderthan":        "1h0m0s",
+		"netrc":                 "true",
+		"acceptencoding":        "true",
+		"strictsize":            "true",
+		"cachedir":              "/tmp/dfget_cache",
+		"preheat":               "true",
+		"proxy":                 "http://127.0.0.1:3128",
+		"clientcert":            "/tmp/client.crt",
+		"clientkey":             "/tmp/client.key",
+		"cacert":                "/tmp/ca.crt",
+		"insecure":              "true",
+		"mkdirparents":          "true",
+		"resultfile":            "/tmp/dfget_result",
+		"posthook":              "chmod +x {{.Output}}",
+		"filemode":              "0755",
+		"outputuid":             "1000",
+		"outputgid":             "daemon",
+		"netrcfile":             "/tmp/netrc",
+		"dockerauthconfig":      "/tmp/docker/config.json",
+		"workhome":              "/tmp/dfget_home",
+		"verbose":               "true",
+		"quiet":                 "true",
 	}
 	var args []string
 	for k, v := range arguments {
@@ -84,21 +235,91 @@ func (suite *CliSuite) Test_setupFlags_withArguments(c *check.C) {
 		expected interface{}
 	}{
 		{cfg.Ctx.URL, arguments["url"]},
+		{strings.Join(cfg.Ctx.URLs, ","), arguments["urls"]},
+		{strings.Join(cfg.Ctx.FallbackURLs, ","), arguments["fallbackurls"]},
+		{cfg.Ctx.Manifest, arguments["manifest"]},
+		{cfg.Ctx.TrustManifest, arguments["trustmanifest"] == "true"},
+		{cfg.Ctx.ContinueOnError, arguments["continueonerror"] == "true"},
+		{cfg.Ctx.UserAgent, arguments["useragent"]},
+		{cfg.Ctx.NoFollowSymlinks, arguments["nofollowsymlinks"] == "true"},
+		{fmt.Sprint(cfg.Ctx.Labels), "map[commit:abc pipeline:12]"},
+		{strconv.Itoa(cfg.Ctx.PieceSize/1024/1024) + "M", arguments["piecesize"]},
+		{cfg.Ctx.Force, arguments["force"] == "true"},
+		{cfg.Ctx.VerifyOnly, arguments["verifyonly"] == "true"},
+		{cfg.Ctx.WriteChecksumSidecar, arguments["checksumsidecar"] == "true"},
+		{cfg.Ctx.SystemdNotify, arguments["systemdnotify"] == "true"},
+		{fmt.Sprint(cfg.Ctx.BackSourceStatusAllow), "[200 203 206]"},
+		{cfg.Ctx.S3Endpoint, arguments["s3endpoint"]},
+		{cfg.Ctx.S3Region, arguments["s3region"]},
+		{cfg.Ctx.DockerAuthConfig, arguments["dockerauthconfig"]},
+		{cfg.Ctx.ProgressJSON, arguments["progressjson"] == "true"},
+		{cfg.Ctx.ShowBar, false},
 		{cfg.Ctx.Output, arguments["output"]},
 		{strconv.Itoa(cfg.Ctx.LocalLimit/1024/1024) + "M",
 			arguments["locallimit"]},
 		{strconv.Itoa(cfg.Ctx.TotalLimit/1024/1024) + "M",
 			arguments["totallimit"]},
-		{strconv.Itoa(cfg.Ctx.Timeout), arguments["timeout"]},
+		{strconv.Itoa(cfg.Ctx.UploadLimit/1024/1024) + "M",
+			arguments["uploadlimit"]},
+		{cfg.Ctx.NoServe, arguments["noserve"] == "true"},
+		{cfg.Ctx.CompressOutput, arguments["compressoutput"] == "true"},
+		{cfg.Ctx.CompressStdout, arguments["compressstdout"] == "true"},
+		{cfg.Ctx.PeerStats, arguments["peerstats"] == "true"},
+		{cfg.Ctx.Expect100, arguments["expect100"] == "true"},
+		{strings.Join(cfg.Ctx.LimitSchedule, ","), arguments["limitschedule"]},
+		{strconv.FormatInt(cfg.Ctx.MaxSize/1024/1024, 10) + "M",
+			arguments["maxsize"]},
+		{strconv.FormatInt(cfg.Ctx.RangeStart, 10) + "-" + strconv.FormatInt(cfg.Ctx.RangeEnd, 10),
+			arguments["range"]},
+		{strconv.Itoa(int(cfg.Ctx.Timeout / time.Second)), arguments["timeout"]},
+		{cfg.Ctx.IdleTimeout.String(), arguments["idletimeout"]},
 		{cfg.Ctx.Md5, arguments["md5"]},
+		{cfg.Ctx.Digest, arguments["digest"]},
+		{cfg.Ctx.FetchRemoteDigest, arguments["fetchremotedigest"] == "true"},
+		{cfg.Ctx.RequireRemoteDigest, arguments["requireremotedigest"] == "true"},
 		{cfg.Ctx.Identifier, arguments["identifier"]},
+		{cfg.Ctx.TaskID, arguments["taskid"]},
 		{cfg.Ctx.CallSystem, arguments["callsystem"]},
 		{strings.Join(cfg.Ctx.Filter, "&"), arguments["filter"]},
 		{cfg.Ctx.Pattern, arguments["pattern"]},
 		{strings.Join(cfg.Ctx.Header, ","), arguments["header"]},
 		{strings.Join(cfg.Ctx.Node, ","), arguments["node"]},
+		{strconv.Itoa(cfg.Ctx.MaxRetries), arguments["retry"]},
+		{cfg.Ctx.RetryInterval.String(), arguments["retryinterval"]},
+		{strconv.Itoa(cfg.Ctx.NodeFailureThreshold), arguments["nodefailurethreshold"]},
+		{cfg.Ctx.NodeCooldown.String(), arguments["nodecooldown"]},
+		{strconv.Itoa(cfg.Ctx.Concurrency), arguments["concurrency"]},
+		{strconv.Itoa(cfg.Ctx.MaxConnsPerHost), arguments["maxconnsperhost"]},
+		{cfg.Ctx.ForceHTTP2, arguments["forcehttp2"] == "true"},
+		{cfg.Ctx.TraceRequests, arguments["tracerequests"] == "true"},
+		{cfg.Ctx.IdleConnTimeout.String(), arguments["idleconntimeout"]},
+		{strconv.Itoa(cfg.Ctx.MaxRedirects), arguments["maxredirects"]},
+		{cfg.Ctx.AutoConcurrency, arguments["autoconcurrency"] == "true"},
 		{cfg.Ctx.Notbs, arguments["notbs"] == "true"},
+		{cfg.Ctx.Resume, arguments["resume"] == "true"},
+		{cfg.Ctx.DryRun, arguments["dryrun"] == "true"},
+		{cfg.Ctx.Clean, arguments["clean"] == "true"},
+		{cfg.Ctx.CleanOlderThan.String(), arguments["cleanolderthan"]},
+		{cfg.Ctx.Netrc, arguments["netrc"] == "true"},
+		{cfg.Ctx.AcceptEncoding, arguments["acceptencoding"] == "true"},
+		{cfg.Ctx.StrictSize, arguments["strictsize"] == "true"},
+		{cfg.Ctx.Preheat, arguments["preheat"] == "true"},
+		{cfg.Ctx.CacheDir, arguments["cachedir"]},
+		{cfg.Ctx.Proxy, arguments["proxy"]},
+		{cfg.Ctx.ClientCert, arguments["clientcert"]},
+		{cfg.Ctx.ClientKey, arguments["clientkey"]},
+		{cfg.Ctx.CACert, arguments["cacert"]},
+		{cfg.Ctx.Insecure, arguments["insecure"] == "true"},
+		{cfg.Ctx.MkdirParents, arguments["mkdirparents"] == "true"},
+		{cfg.Ctx.ResultFile, arguments["resultfile"]},
+		{cfg.Ctx.PostHook, arguments["posthook"]},
+		{cfg.Ctx.NetrcFile, arguments["netrcfile"]},
+		{cfg.Ctx.WorkHome, arguments["workhome"]},
+		{"0" + strconv.FormatUint(uint64(cfg.Ctx.FileMode), 8), arguments["filemode"]},
+		{cfg.Ctx.OutputUID, arguments["outputuid"]},
+		{cfg.Ctx.OutputGID, arguments["outputgid"]},
 		{cfg.Ctx.Verbose, arguments["notbs"] == "true"},
+		{cfg.Ctx.Quiet, arguments["quiet"] == "true"},
 		{cfg.Ctx.DFDaemon, false},
 		{cfg.Ctx.Version, false},
 		{cfg.Ctx.ShowBar, false},
@@ -111,6 +332,29 @@ func (suite *CliSuite) Test_setupFlags_withArguments(c *check.C) {
 	}
 }
 
+func (suite *CliSuite) Test_setupFlags_withConfigFile(c *check.C) {
+	f, err := ioutil.TempFile("/tmp", "dfget_config")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("localLimit: 10485760\npattern: cdn\nnode: [127.0.0.2]\nnotbs: true\nfoo: bar\n")
+	f.Close()
+
+	setupFlags([]string{"--url", "http://a.b", "--config", f.Name(), "-p", "source", "-n", "127.0.0.3"})
+	c.Assert(cfg.Ctx.YAMLConfig, check.Equals, f.Name())
+	c.Assert(cfg.Ctx.URL, check.Equals, "http://a.b")
+	c.Assert(cfg.Ctx.LocalLimit, check.Equals, 10485760)
+	c.Assert(cfg.Ctx.Notbs, check.Equals, true)
+	c.Assert(cfg.Ctx.Pattern, check.Equals, cfg.PatternSource)
+	c.Assert(cfg.Ctx.Node, check.DeepEquals, []string{"127.0.0.3"})
+	c.Assert(unknownConfigKeys, check.DeepEquals, []string{"foo"})
+}
+
+func (suite *CliSuite) Test_setupFlags_quiet(c *check.C) {
+	setupFlags([]string{"--url", "http://a.b", "--showbar", "--console", "--quiet"})
+	c.Assert(cfg.Ctx.Quiet, check.Equals, true)
+	c.Assert(cfg.Ctx.ShowBar, check.Equals, false)
+}
+
 func (suite *CliSuite) TestUsage(c *check.C) {
 	var buffer bytes.Buffer
 	cliOut = &buffer
@@ -136,7 +380,10 @@ func (suite *CliSuite) Test_transLimit(c *check.C) {
 		"20m":   {20971520, ""},
 		"10k":   {10240, ""},
 		"10K":   {10240, ""},
-		"10x":   {0, "invalid unit 'x' of '10x', 'KkMm' are supported"},
+		"1g":    {1073741824, ""},
+		"1G":    {1073741824, ""},
+		"10x":   {0, "invalid unit 'x' of '10x', 'KkMmGg' are supported"},
+		"1024":  {0, "invalid unit '4' of '1024', 'KkMmGg' are supported"},
 		"10.0x": {0, "invalid syntax"},
 		"ab":    {0, "invalid syntax"},
 		"abM":   {0, "invalid syntax"},
@@ -153,3 +400,606 @@ func (suite *CliSuite) Test_transLimit(c *check.C) {
 		}
 	}
 }
+
+func (suite *CliSuite) Test_transLabels(c *check.C) {
+	labels, err := transLabels([]string{"pipeline=12", "commit=abc=def", "empty="})
+	c.Assert(err, check.IsNil)
+	c.Assert(labels, check.DeepEquals,
+		map[string]string{"pipeline": "12", "commit": "abc=def", "empty": ""})
+
+	_, err = transLabels([]string{"pipeline=12", "commit"})
+	c.Assert(err, check.ErrorMatches, "label\\[commit\\] is not in the format of 'key=value'")
+}
+
+func (suite *CliSuite) Test_transRange(c *check.C) {
+	var cases = map[string]struct {
+		start int64
+		end   int64
+		err   string
+	}{
+		"0-1023": {0, 1023, ""},
+		"10-10":  {10, 10, ""},
+		"10":     {0, 0, "not in the format of 'start-end'"},
+		"a-10":   {0, 0, "invalid syntax"},
+		"10-":    {0, 0, "invalid syntax"},
+		"-1-10":  {0, 0, "invalid syntax"},
+	}
+
+	for k, v := range cases {
+		start, end, e := transRange(k)
+		c.Assert(start, check.Equals, v.start, check.Commentf("%s", k))
+		c.Assert(end, check.Equals, v.end, check.Commentf("%s", k))
+		if util.IsEmptyStr(v.err) {
+			c.Assert(e, check.IsNil)
+		} else {
+			c.Assert(e, check.NotNil)
+			c.Assert(strings.Contains(e.Error(), v.err), check.Equals, true, check.Commentf("%s", k))
+		}
+	}
+}
+
+// blockingDownloader blocks until the context is done.
+type blockingDownloader struct {
+	cleaned bool
+}
+
+func (d *blockingDownloader) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (d *blockingDownloader) Cleanup() {
+	d.cleaned = true
+}
+
+func (suite *CliSuite) Test_downloadFile_timeout(c *check.C) {
+	cfg.Ctx.Timeout = 10 * time.Millisecond
+	d := &blockingDownloader{}
+	err := downloadFile(context.Background(), cfg.Ctx, d)
+	c.Assert(err, check.ErrorMatches, "download timeout.*")
+	c.Assert(d.cleaned, check.Equals, true)
+}
+
+func (suite *CliSuite) Test_downloadFile_canceled(c *check.C) {
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.Timeout = 5 * time.Second
+	goctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d := &blockingDownloader{}
+	err := downloadFile(goctx, cfg.Ctx, d)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+	c.Assert(d.cleaned, check.Equals, true)
+
+	goctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	d = &blockingDownloader{}
+	c.Assert(downloadFile(goctx, cfg.Ctx, d), check.Equals, context.Canceled)
+	c.Assert(d.cleaned, check.Equals, true)
+}
+
+// lockCheckingDownloader records whether the output is locked when it runs
+// and when it's cleaned up.
+type lockCheckingDownloader struct {
+	output string
+	locked []bool
+}
+
+func (d *lockCheckingDownloader) Run(ctx context.Context) error {
+	d.check()
+	return nil
+}
+
+func (d *lockCheckingDownloader) Cleanup() {
+	d.check()
+}
+
+func (d *lockCheckingDownloader) check() {
+	lock, err := util.TryLockFile(d.output + cfg.LockFileSuffix)
+	if err == nil {
+		lock.Unlock()
+	}
+	d.locked = append(d.locked, err == util.ErrFileLocked)
+}
+
+func (suite *CliSuite) Test_downloadFile_lockOutput(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_lock")
+	defer os.RemoveAll(tmpDir)
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.Output = filepath.Join(tmpDir, "file")
+	lockFile := cfg.Ctx.Output + cfg.LockFileSuffix
+
+	// it fails fast if the output is locked by another one
+	lock, err := util.TryLockFile(lockFile)
+	c.Assert(err, check.IsNil)
+	d := &lockCheckingDownloader{output: cfg.Ctx.Output}
+	err = downloadFile(context.Background(), cfg.Ctx, d)
+	c.Assert(err, check.DeepEquals, &dferrors.OutputLockedError{Path: cfg.Ctx.Output, Pid: os.Getpid()})
+	c.Assert(d.locked, check.HasLen, 0)
+	lock.Unlock()
+
+	// the lock is held until it's cleaned up, and removed then
+	c.Assert(downloadFile(context.Background(), cfg.Ctx, d), check.IsNil)
+	c.Assert(d.locked, check.DeepEquals, []bool{true, true})
+	_, err = os.Stat(lockFile)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	// neither the streamed output nor the one with LockOutput unset is locked
+	for _, output := range []string{cfg.StdoutOutput, cfg.Ctx.Output} {
+		cfg.Ctx.Output, cfg.Ctx.LockOutput = output, output == cfg.StdoutOutput
+		d = &lockCheckingDownloader{output: output}
+		c.Assert(downloadFile(context.Background(), cfg.Ctx, d), check.IsNil)
+		c.Assert(d.locked, check.DeepEquals, []bool{false, false})
+	}
+}
+
+// interruptedDownloader interrupts dfget itself and blocks until the context
+// is done.
+type interruptedDownloader struct {
+	blockingDownloader
+}
+
+func (d *interruptedDownloader) Run(ctx context.Context) error {
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	return d.blockingDownloader.Run(ctx)
+}
+
+func (suite *CliSuite) Test_downloadFile_interrupted(c *check.C) {
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.Timeout = 5 * time.Second
+	d := &interruptedDownloader{}
+	err := downloadFile(context.Background(), cfg.Ctx, d)
+	c.Assert(err, check.ErrorMatches, "download interrupted by signal terminated")
+	c.Assert(exitCode(err), check.Equals, 128+int(syscall.SIGTERM))
+	c.Assert(d.cleaned, check.Equals, true)
+}
+
+func (suite *CliSuite) Test_exitCode(c *check.C) {
+	c.Assert(exitCode(errors.New("download timeout")), check.Equals, 1)
+	c.Assert(exitCode(&interruptedError{sig: syscall.SIGINT}), check.Equals, 130)
+}
+
+func (suite *CliSuite) Test_writeResult(c *check.C) {
+	f, err := ioutil.TempFile("/tmp", "dfget_result")
+	c.Assert(err, check.IsNil)
+	f.WriteString("dragonfly")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	cfg.Ctx.URL = "http://a.b/c"
+	cfg.Ctx.Output = f.Name()
+	cfg.Ctx.Pattern = cfg.PatternSource
+	cfg.Ctx.BackSourceReason = cfg.BackSourceReasonInitError
+	cfg.Ctx.Labels = map[string]string{"pipeline": "12"}
+	var cases = []struct {
+		err      error
+		expected result
+	}{
+		{nil, result{URL: cfg.Ctx.URL, Output: f.Name(), Length: 9, Cost: 1.5,
+			Pattern: cfg.PatternSource, BackSourceReason: cfg.BackSourceReasonInitError,
+			ReasonDesc: "init error", Md5: "7fc8baba8e7696d6c3b286f738245592", Success: true,
+			Labels: map[string]string{"pipeline": "12"}}},
+		{errors.New("x"), result{URL: cfg.Ctx.URL, Output: f.Name(), Length: 9, Cost: 1.5,
+			Pattern: cfg.PatternSource, BackSourceReason: cfg.BackSourceReasonInitError,
+			ReasonDesc: "init error", Error: "x", Labels: map[string]string{"pipeline": "12"}}},
+	}
+
+	for _, v := range cases {
+		path := f.Name() + ".json"
+		c.Assert(writeResult(path, newResult(cfg.Ctx, 9, 1.5, v.err)), check.IsNil)
+		data, _ := ioutil.ReadFile(path)
+		os.Remove(path)
+		var actual result
+		c.Assert(json.Unmarshal(data, &actual), check.IsNil)
+		c.Assert(actual, check.DeepEquals, v.expected)
+	}
+
+	// the request id is in the result only if the requests are traced
+	cfg.Ctx.RequestID = "123-1500000000.000"
+	c.Assert(newResult(cfg.Ctx, 9, 1.5, nil).RequestID, check.Equals, "")
+	cfg.Ctx.TraceRequests = true
+	c.Assert(newResult(cfg.Ctx, 9, 1.5, nil).RequestID, check.Equals, cfg.Ctx.RequestID)
+}
+
+func (suite *CliSuite) Test_download_notbs(c *check.C) {
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.URL = "http://127.0.0.1:1/file"
+	cfg.Ctx.Pattern = cfg.PatternP2P
+	cfg.Ctx.Notbs = true
+	_, err := download(context.Background(), cfg.Ctx, nil)
+	c.Assert(err, check.Equals, dferrors.ErrBackSourceDisabled)
+	c.Assert(cfg.Ctx.BackSourceReason, check.Equals,
+		cfg.BackSourceReasonRegisterFail+cfg.ForceNotBackSourceAddition)
+}
+
+func (suite *CliSuite) Test_download_register(c *check.C) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		json.NewEncoder(w).Encode(&types.RegisterResponse{
+			BaseResponse: types.NewBaseResponse(cfg.HTTPSuccess, ""),
+			Data:         &types.RegisterResponseData{TaskID: "task"},
+		})
+	}))
+	defer server.Close()
+
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.URL = "http://127.0.0.1:1/file"
+	cfg.Ctx.Output = "/tmp/file"
+	cfg.Ctx.Pattern = cfg.PatternP2P
+	cfg.Ctx.Notbs = true
+	cfg.Ctx.NoServe = true
+	cfg.Ctx.MaxRetries = 0
+	var cases = []struct {
+		node   string
+		reason int
+	}{
+		{strings.TrimPrefix(server.URL, "http://"), cfg.BackSourceReasonInitError},
+		{"127.0.0.1:1", cfg.BackSourceReasonRegisterFail},
+	}
+	for _, v := range cases {
+		form = nil
+		cfg.Ctx.Node = []string{v.node}
+		_, err := download(context.Background(), cfg.Ctx, nil)
+		c.Assert(err, check.Equals, dferrors.ErrBackSourceDisabled)
+		c.Assert(cfg.Ctx.BackSourceReason, check.Equals, v.reason+cfg.ForceNotBackSourceAddition)
+		if v.reason == cfg.BackSourceReasonInitError {
+			c.Assert(form.Get("rawUrl"), check.Equals, cfg.Ctx.URL)
+			c.Assert(form.Get("downloadOnly"), check.Equals, "true")
+		}
+	}
+
+	// the registration is canceled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := download(ctx, cfg.Ctx, nil)
+	c.Assert(err, check.Equals, context.Canceled)
+}
+
+func (suite *CliSuite) Test_newSession(c *check.C) {
+	cfg.Ctx.Node = nil
+	c.Assert(newSession(cfg.Ctx), check.IsNil)
+	cfg.Ctx.Node = []string{"127.0.0.1:1"}
+	cfg.Ctx.Pattern = cfg.PatternSource
+	c.Assert(newSession(cfg.Ctx), check.IsNil)
+	cfg.Ctx.Pattern = cfg.PatternP2P
+	c.Assert(newSession(cfg.Ctx), check.NotNil)
+}
+
+func (suite *CliSuite) Test_download_systemdNotify(c *check.C) {
+	// the server is both the supernode and the source
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/peer/registry" {
+			json.NewEncoder(w).Encode(&types.RegisterResponse{
+				BaseResponse: types.NewBaseResponse(cfg.HTTPSuccess, ""),
+				Data:         &types.RegisterResponseData{TaskID: "task"},
+			})
+			return
+		}
+		fmt.Fprint(w, "dragonfly")
+	}))
+	defer server.Close()
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_notify")
+	defer os.RemoveAll(tmpDir)
+	name := filepath.Join(tmpDir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	defer os.Setenv(util.NotifySocketEnv, os.Getenv(util.NotifySocketEnv))
+	os.Setenv(util.NotifySocketEnv, name)
+
+	runtime := cfg.NewContext()
+	runtime.ClientLogger = logrus.New()
+	runtime.ClientLogger.Out = ioutil.Discard
+	runtime.ServerLogger = runtime.ClientLogger
+	runtime.URL = server.URL + "/file"
+	runtime.Output = filepath.Join(tmpDir, "file")
+	runtime.WorkHome = tmpDir
+	runtime.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	runtime.CleanOnInterrupt = false
+	runtime.SystemdNotify = true
+	_, err = download(context.Background(), runtime, nil)
+	c.Assert(err, check.IsNil)
+
+	buf := make([]byte, 256)
+	for _, expected := range []string{
+		"READY=1",
+		"STATUS=downloading " + runtime.URL,
+		"STATUS=downloaded " + runtime.URL,
+	} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		c.Assert(err, check.IsNil)
+		c.Assert(string(buf[:n]), check.Equals, expected)
+	}
+}
+
+func (suite *CliSuite) Test_printInfo(c *check.C) {
+	buf := &bytes.Buffer{}
+	util.Printer.Out = buf
+	defer func() { util.Printer.Out = nil }()
+
+	printInfo(cfg.Ctx, "dragonfly")
+	c.Assert(buf.String(), check.Equals, "dragonfly\n")
+
+	buf.Reset()
+	cfg.Ctx.Quiet = true
+	printInfo(cfg.Ctx, "dragonfly")
+	c.Assert(buf.String(), check.Equals, "")
+}
+
+func (suite *CliSuite) Test_newSummary(c *check.C) {
+	var results = []*result{
+		{URL: "http://a.b/c", Length: 9, Success: true},
+		{URL: "http://a.b/d", Length: 3, Error: "x"},
+	}
+	c.Assert(newSummary(results, 1.5), check.DeepEquals,
+		&summary{Length: 12, Cost: 1.5, Failed: 1, Results: results})
+	c.Assert(newSummary(results[:1], 1.5), check.DeepEquals,
+		&summary{Length: 9, Cost: 1.5, Success: true, Results: results[:1]})
+}
+
+func (suite *CliSuite) Test_throughput(c *check.C) {
+	var cases = []struct {
+		length   int64
+		cost     float64
+		expected float64
+	}{
+		{0, 1, 0},
+		{1024, 0, 0},
+		{1024, -1, 0},
+		{1024, 0.5, 2048},
+		{3000, 1.5, 2000},
+	}
+
+	for _, v := range cases {
+		c.Assert(throughput(v.length, v.cost), check.Equals, v.expected, check.Commentf("%v", v))
+	}
+}
+
+func (suite *CliSuite) Test_runPostHook(c *check.C) {
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	c.Assert(runPostHook(context.Background(), cfg.Ctx), check.IsNil)
+
+	f, err := ioutil.TempFile("/tmp", "dfget_hook")
+	c.Assert(err, check.IsNil)
+	f.Close()
+	defer os.Remove(f.Name())
+	cfg.Ctx.URL = "http://a.b/c?x=1&y='2'"
+	cfg.Ctx.Output = f.Name()
+
+	cfg.Ctx.PostHook = "echo {{.URL}} > {{.Output}}"
+	c.Assert(runPostHook(context.Background(), cfg.Ctx), check.IsNil)
+	content, _ := ioutil.ReadFile(f.Name())
+	c.Assert(string(content), check.Equals, cfg.Ctx.URL+"\n")
+
+	cfg.Ctx.PostHook = "exit 3"
+	c.Assert(runPostHook(context.Background(), cfg.Ctx), check.ErrorMatches, "run post hook.*exit status 3")
+	_, err = os.Stat(f.Name())
+	c.Assert(err, check.IsNil)
+}
+
+func (suite *CliSuite) Test_downloadURLs(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/notexist" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, "dragonfly")
+	}))
+	defer server.Close()
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_urls")
+	defer os.RemoveAll(tmpDir)
+	util.Printer.Out = ioutil.Discard
+	defer func() { util.Printer.Out = nil }()
+
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.ServerLogger = cfg.Ctx.ClientLogger
+	cfg.Ctx.WorkHome = tmpDir
+	cfg.Ctx.Pattern = cfg.PatternSource
+	cfg.Ctx.CleanOnInterrupt = false
+	cfg.Ctx.Concurrency = 1
+	cfg.Ctx.Output = tmpDir
+	cfg.Ctx.URLs = []string{server.URL + "/a", server.URL + "/notexist", server.URL + "/b"}
+	runtimes, err := cfg.Ctx.SplitURLs()
+	c.Assert(err, check.IsNil)
+
+	// the ones after the failed one are skipped
+	results, codes := downloadURLs(runtimes)
+	c.Assert(codes, check.DeepEquals, []int{0, 1, 1})
+	c.Assert(results[0].Success, check.Equals, true)
+	c.Assert(results[1].Error, check.Matches, ".*response code:404")
+	c.Assert(results[2].Error, check.Equals, "skipped since url["+server.URL+"/notexist] failed")
+
+	for _, runtime := range runtimes {
+		runtime.ContinueOnError = true
+	}
+	results, codes = downloadURLs(runtimes)
+	c.Assert(codes, check.DeepEquals, []int{0, 1, 0})
+	c.Assert(results[2].Success, check.Equals, true)
+
+	// the auto concurrency starts from one, and the downloads are all done
+	cfg.Ctx.Concurrency = 3
+	cfg.Ctx.AutoConcurrency = true
+	var progressed int64
+	for _, runtime := range runtimes {
+		runtime.OnProgress = func(done, total int64) { atomic.AddInt64(&progressed, 1) }
+	}
+	results, codes = downloadURLs(runtimes)
+	c.Assert(codes, check.DeepEquals, []int{0, 1, 0})
+	c.Assert(results[0].Success, check.Equals, true)
+	c.Assert(results[2].Success, check.Equals, true)
+	c.Assert(progressed > 0, check.Equals, true)
+}
+
+func (suite *CliSuite) Test_batchExitCode(c *check.C) {
+	failures := make([]int, maxFailedExitCode+10)
+	for i := range failures {
+		failures[i] = 1
+	}
+	var cases = []struct {
+		codes           []int
+		continueOnError bool
+		expected        int
+	}{
+		{[]int{0, 0}, false, 0},
+		{[]int{0, 0}, true, 0},
+		{[]int{1, 0, 1}, false, 1},
+		{[]int{1, 0, 1}, true, 2},
+		{[]int{1, 130, 1}, true, 130},
+		{failures, true, maxFailedExitCode},
+	}
+
+	for _, v := range cases {
+		failed := 0
+		for _, code := range v.codes {
+			if code != 0 {
+				failed++
+			}
+		}
+		c.Assert(batchExitCode(v.codes, failed, v.continueOnError), check.Equals, v.expected,
+			check.Commentf("%v", v))
+	}
+}
+
+func (suite *CliSuite) TestDownload(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "dragonfly")
+	}))
+	defer server.Close()
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_download")
+	defer os.RemoveAll(tmpDir)
+
+	runtime := cfg.NewContext()
+	runtime.ClientLogger = logrus.New()
+	runtime.ClientLogger.Out = ioutil.Discard
+	runtime.ServerLogger = runtime.ClientLogger
+	runtime.WorkHome = tmpDir
+	runtime.Pattern = cfg.PatternSource
+	runtime.CleanOnInterrupt = false
+	runtime.Md5 = "7fc8baba8e7696d6c3b286f738245592"
+
+	// the invalid context is returned as an error rather than panicking
+	_, err := Download(runtime)
+	c.Assert(err, check.ErrorMatches, "invalid url.*")
+
+	runtime.URL = server.URL + "/file"
+	runtime.Output = filepath.Join(tmpDir, "file")
+	output, err := Download(runtime)
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, runtime.Output)
+	content, _ := ioutil.ReadFile(output)
+	c.Assert(string(content), check.Equals, "dragonfly")
+
+	// the existing output is verified without downloading
+	runtime.VerifyOnly = true
+	output, err = Download(runtime)
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, runtime.Output)
+	// the remote digest is fetched with the context of the caller
+	runtime.FetchRemoteDigest = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = DownloadContext(ctx, runtime)
+	c.Assert(err, check.ErrorMatches, ".*context canceled")
+	runtime.VerifyOnly, runtime.FetchRemoteDigest = false, false
+
+	// the source is only checked
+	runtime.DryRun = true
+	runtime.Output = filepath.Join(tmpDir, "dryrun")
+	output, err = Download(runtime)
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "")
+	_, err = os.Stat(runtime.Output)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	runtime.DryRun = false
+
+	runtime.Md5 = "d41d8cd98f00b204e9800998ecf8427e"
+	_, err = Download(runtime)
+	c.Assert(err, check.ErrorMatches, "md5 not match.*")
+}
+
+func (suite *CliSuite) TestDownload_preheat(c *check.C) {
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/file" {
+			w.Header().Set("ETag", etag)
+		}
+		fmt.Fprint(w, "dragonfly")
+	}))
+	defer server.Close()
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_preheat")
+	defer os.RemoveAll(tmpDir)
+
+	runtime := cfg.NewContext()
+	runtime.ClientLogger = logrus.New()
+	runtime.ClientLogger.Out = ioutil.Discard
+	runtime.ServerLogger = runtime.ClientLogger
+	runtime.WorkHome = tmpDir
+	runtime.Pattern = cfg.PatternSource
+	runtime.CleanOnInterrupt = false
+	runtime.Preheat = true
+	runtime.CacheDir = filepath.Join(tmpDir, "cache")
+	runtime.URL = server.URL + "/file"
+
+	output, err := Download(runtime)
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "")
+	files, size := cacheUsage(runtime)
+	c.Assert([]int64{int64(files), size}, check.DeepEquals, []int64{1, 9})
+	r := newResult(runtime, size, 0, nil)
+	c.Assert([]string{r.Output, r.Md5}, check.DeepEquals, []string{"", ""})
+	// nothing is left besides the cache
+	entries, _ := ioutil.ReadDir(filepath.Join(tmpDir, "preheat"))
+	c.Assert(entries, check.HasLen, 0)
+
+	// the source without validators can't be cached
+	runtime.URL, runtime.Output = server.URL+"/nocache", ""
+	_, err = Download(runtime)
+	c.Assert(err, check.ErrorMatches, ".*can't be cached")
+	entries, _ = ioutil.ReadDir(filepath.Join(tmpDir, "preheat"))
+	c.Assert(entries, check.HasLen, 0)
+}
+
+func (suite *CliSuite) TestDownloadContext(c *check.C) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		fmt.Fprint(w, "dragonfly")
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_download")
+	defer os.RemoveAll(tmpDir)
+
+	runtime := cfg.NewContext()
+	runtime.ClientLogger = logrus.New()
+	runtime.ClientLogger.Out = ioutil.Discard
+	runtime.ServerLogger = runtime.ClientLogger
+	runtime.WorkHome = tmpDir
+	runtime.Pattern = cfg.PatternSource
+	runtime.CleanOnInterrupt = false
+	runtime.Atomic = false
+	runtime.URL = server.URL + "/file"
+	runtime.Output = filepath.Join(tmpDir, "file")
+
+	goctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := DownloadContext(goctx, runtime)
+	c.Assert(err, check.Equals, context.Canceled)
+	// the partial output is removed
+	_, err = os.Stat(runtime.Output)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
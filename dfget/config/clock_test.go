@@ -0,0 +1,69 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"time"
+
+	"github.com/go-check/check"
+)
+
+// fakeClock is frozen at now, and sleeping advances it immediately.
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time { return f.now }
+
+func (f *fakeClock) Sleep(d time.Duration) { f.now = f.now.Add(d) }
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- f.now
+	return ch
+}
+
+// AfterFunc returns the timer which never fires, since the time only moves
+// by sleeping.
+func (f *fakeClock) AfterFunc(d time.Duration, fn func()) Timer {
+	t := time.AfterFunc(time.Hour, fn)
+	t.Stop()
+	return t
+}
+
+func (suite *ConfigSuite) TestSince(c *check.C) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	defer func(old Clock) { DefaultClock = old }(DefaultClock)
+	DefaultClock = clock
+
+	start := DefaultClock.Now()
+	DefaultClock.Sleep(time.Minute)
+	c.Assert(Since(start), check.Equals, time.Minute)
+	c.Assert(<-DefaultClock.After(time.Second), check.Equals, start.Add(time.Minute+time.Second))
+}
+
+func (suite *ConfigSuite) TestSystemClock(c *check.C) {
+	var clock Clock = SystemClock{}
+	before := time.Now()
+	clock.Sleep(time.Millisecond)
+	c.Assert(clock.Now().Sub(before) >= time.Millisecond, check.Equals, true)
+	c.Assert((<-clock.After(time.Millisecond)).After(before), check.Equals, true)
+	fired := make(chan struct{})
+	clock.AfterFunc(time.Millisecond, func() { close(fired) })
+	<-fired
+}
@@ -18,19 +18,31 @@
 package config
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/alibaba/Dragonfly/dfget/util"
+	"github.com/alibaba/Dragonfly/version"
 )
 
 var (
@@ -39,8 +51,35 @@ var (
 
 	// Ctx holds all the runtime Context information.
 	Ctx *Context
+
+	// SensitiveQueryKeys are the query keys of url whose values are redacted
+	// in Context.String(), and they're matched case-insensitively.
+	SensitiveQueryKeys = []string{
+		"signature", "sign", "token", "access_token", "auth",
+		"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token",
+	}
+
+	// SensitiveHeaders are the headers whose values are redacted in
+	// Context.String(), and they're matched case-insensitively.
+	SensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+	md5Reg = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	hexReg = regexp.MustCompile(`^[0-9a-f]+$`)
+	// taskIDReg matches the task ids supplied by users instead of the ones
+	// derived by supernode.
+	taskIDReg = regexp.MustCompile(`^[0-9a-fA-F]{16,128}$`)
+	// geteuid returns the effective user id deciding whether the owner of
+	// the output can be changed, and it's replaced by tests.
+	geteuid = os.Geteuid
+	// outputTemplateReg matches the tokens of the output template.
+	outputTemplateReg = regexp.MustCompile(`\{[^{}]*\}`)
+
+	ipv6URLReg = regexp.MustCompile(`(https?|HTTPS?|ftps?|FTPS?)://\[([0-9a-fA-F:.]+)\](:\d*)?([/?#]|$)`)
 )
 
+// redacted replaces the values of sensitive information.
+const redacted = "***"
+
 func init() {
 	Reset()
 }
@@ -55,6 +94,18 @@ func Reset() {
 	Ctx = NewContext()
 }
 
+// ResetKeepLoggers resets configuration and Context like Reset, except that
+// the loggers of Context are kept, so that the embedders don't have to set
+// them up again between downloads.
+func ResetKeepLoggers() {
+	var clientLogger, serverLogger *logrus.Logger
+	if Ctx != nil {
+		clientLogger, serverLogger = Ctx.ClientLogger, Ctx.ServerLogger
+	}
+	Reset()
+	Ctx.ClientLogger, Ctx.ServerLogger = clientLogger, serverLogger
+}
+
 // ----------------------------------------------------------------------------
 
 // Properties holds all configurable Properties.
@@ -72,108 +123,835 @@ func (p *Properties) Load(path string) error {
 
 // Context holds all the runtime context information.
 type Context struct {
-	URL             string   `json:"url"`
-	Output          string   `json:"output"`
-	LocalLimit      int      `json:"localLimit,omitempty"`
-	TotalLimit      int      `json:"totalLimit,omitempty"`
-	Timeout         int      `json:"timeout,omitempty"`
-	Md5             string   `json:"md5,omitempty"`
-	Identifier      string   `json:"identifier,omitempty"`
-	CallSystem      string   `json:"callSystem,omitempty"`
-	Pattern         string   `json:"pattern,omitempty"`
-	Filter          []string `json:"filter,omitempty"`
-	Header          []string `json:"header,omitempty"`
-	Node            []string `json:"node,omitempty"`
-	Notbs           bool     `json:"notbs,omitempty"`
-	DFDaemon        bool     `json:"dfdaemon,omitempty"`
-	Version         bool     `json:"version,omitempty"`
-	ShowBar         bool     `json:"showBar,omitempty"`
-	Console         bool     `json:"console,omitempty"`
-	Verbose         bool     `json:"verbose,omitempty"`
-	Help            bool     `json:"help,omitempty"`
-	ClientQueueSize int      `json:"clientQueueSize,omitempty"`
-
-	StartTime  time.Time `json:"startTime"`
-	Sign       string    `json:"sign"`
-	User       string    `json:"user"`
-	WorkHome   string    `json:"workHome"`
-	ConfigFile string    `json:"configFile"`
+	URL             string        `json:"url"`
+	Output          string        `json:"output"`
+	LocalLimit      int           `json:"localLimit,omitempty"`
+	TotalLimit      int           `json:"totalLimit,omitempty"`
+	UploadLimit     int           `json:"uploadLimit,omitempty"`
+	LimitSchedule   []string      `json:"limitSchedule,omitempty"`
+	MaxSize         int64         `json:"maxSize,omitempty"`
+	RangeStart      int64         `json:"rangeStart,omitempty"`
+	RangeEnd        int64         `json:"rangeEnd,omitempty"`
+	Timeout         time.Duration `json:"timeout,omitempty"`
+	IdleTimeout     time.Duration `json:"idleTimeout,omitempty"`
+	Md5             string        `json:"md5,omitempty"`
+	Digest          string        `json:"digest,omitempty"`
+	Identifier      string        `json:"identifier,omitempty"`
+	TaskID          string        `json:"taskId,omitempty"`
+	CallSystem      string        `json:"callSystem,omitempty"`
+	Pattern         string        `json:"pattern,omitempty"`
+	Filter          []string      `json:"filter,omitempty"`
+	Header          []string      `json:"header,omitempty"`
+	Node            []string      `json:"node,omitempty"`
+	Notbs           bool          `json:"notbs,omitempty"`
+	Resume          bool          `json:"resume,omitempty"`
+	DryRun          bool          `json:"dryRun,omitempty"`
+	Clean           bool          `json:"clean,omitempty"`
+	Netrc           bool          `json:"netrc,omitempty"`
+	AcceptEncoding  bool          `json:"acceptEncoding,omitempty"`
+	StrictSize      bool          `json:"strictSize,omitempty"`
+	MkdirParents    bool          `json:"mkdirParents,omitempty"`
+	CacheDir        string        `json:"cacheDir,omitempty"`
+	Proxy           string        `json:"proxy,omitempty"`
+	ClientCert      string        `json:"clientCert,omitempty"`
+	ClientKey       string        `json:"clientKey,omitempty"`
+	CACert          string        `json:"caCert,omitempty"`
+	Insecure        bool          `json:"insecure,omitempty"`
+	ResultFile      string        `json:"resultFile,omitempty"`
+	PostHook        string        `json:"postHook,omitempty"`
+	DFDaemon        bool          `json:"dfdaemon,omitempty"`
+	Version         bool          `json:"version,omitempty"`
+	ShowBar         bool          `json:"showBar,omitempty"`
+	Console         bool          `json:"console,omitempty"`
+	Verbose         bool          `json:"verbose,omitempty"`
+	Quiet           bool          `json:"quiet,omitempty"`
+	LogJSON         bool          `json:"logJSON,omitempty"`
+	Help            bool          `json:"help,omitempty"`
+	ClientQueueSize int           `json:"clientQueueSize,omitempty"`
+
+	// BackSourceReason is the reason why the file is downloaded from source,
+	// it's one of the BackSourceReason constants.
+	BackSourceReason int `json:"backSourceReason,omitempty"`
+
+	// MaxRetries is how many times the requests to supernode are retried,
+	// and the interval between retries grows exponentially up to RetryInterval.
+	// RetryJitter picks a random interval between 0 and the grown one, so
+	// that the clients don't retry in lockstep.
+	MaxRetries    int           `json:"maxRetries"`
+	RetryInterval time.Duration `json:"retryInterval"`
+	RetryJitter   bool          `json:"retryJitter"`
+
+	// FileMode is the permission bits of the output set after the download
+	// is verified, the default permission is kept if it's 0.
+	FileMode os.FileMode `json:"fileMode,omitempty"`
+
+	// Concurrency is the number of goroutines fetching pieces, and all of
+	// them share the rate limit of LocalLimit.
+	Concurrency int `json:"concurrency"`
+
+	// MaxConnsPerHost limits the requests in flight to each host of source,
+	// and so the connections, which is shared by all the downloads of the
+	// process with the same limit, and 0 means unlimited.
+	MaxConnsPerHost int `json:"maxConnsPerHost,omitempty"`
+
+	// UserAgent is the User-Agent of the requests to source, and the one in
+	// Header takes precedence. Go's default one is sent if it's empty.
+	UserAgent string `json:"userAgent,omitempty"`
+
+	// NoFollowSymlinks refuses to write the output through a symlink, so that
+	// a stale or malicious one can't redirect it to somewhere unexpected.
+	NoFollowSymlinks bool `json:"noFollowSymlinks,omitempty"`
+
+	// Labels are the metadata of the download written to ResultFile and
+	// attached on the logs of ClientLogger by dfget, and they affect neither
+	// the task nor the cache. They're written in both JSON and the plain text
+	// logs.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// PieceSize is the piece size asked for when registering, and the
+	// supernode may clamp it. The default one of the supernode is used if
+	// it's 0, and a larger one for huge files reduces the requests of pieces.
+	PieceSize int `json:"pieceSize,omitempty"`
+
+	// Force fetches the file again ignoring all the caches, it asks the
+	// supernode to bypass its cached task when registering, and neither the
+	// local service file of the task nor the cache in CacheDir is reused,
+	// though the latter is still refreshed.
+	Force bool `json:"force,omitempty"`
+
+	// VerifyOnly hashes the existing output and checks it against Md5 or
+	// Digest without downloading or contacting supernodes, and the url is
+	// optional then. The entries of Manifest are verified with their own
+	// digests.
+	VerifyOnly bool `json:"verifyOnly,omitempty"`
+
+	// BackSourceStatusAllow are the status codes of the http source whose
+	// responses are downloaded, and the other ones fail the download with
+	// errors.SourceStatusError. They're 200 and 206 if it's empty, and 206 is
+	// accepted only for the range requested.
+	BackSourceStatusAllow []int `json:"backSourceStatusAllow,omitempty"`
+
+	// SystemdNotify sends 'READY=1' to systemd once the task is registered to
+	// a supernode, and the state changes as 'STATUS=' lines, through the
+	// socket of util.NotifySocketEnv, so that dfget can be run by the units
+	// of 'Type=notify'. It does nothing if the socket isn't set, and it can't
+	// be used with the pattern 'source' which never registers.
+	SystemdNotify bool `json:"systemdNotify,omitempty"`
+
+	// NodeFailureThreshold is how many consecutive failures against a
+	// supernode trip it, and the tripped one is skipped for NodeCooldown
+	// in favor of the next node or the source. The breaker is disabled if
+	// NodeFailureThreshold is 0, and its state is shared by all the downloads
+	// of the process, such as the ones of URLs or Manifest.
+	NodeFailureThreshold int           `json:"nodeFailureThreshold"`
+	NodeCooldown         time.Duration `json:"nodeCooldown"`
+
+	// WriteChecksumSidecar writes the checksum of the downloaded file to
+	// '<output>.<algo>' in the format of sha256sum, and the algo is the one
+	// of Digest, or sha256 if it's empty. It can't be used with the outputs
+	// streamed.
+	WriteChecksumSidecar bool `json:"writeChecksumSidecar,omitempty"`
+
+	// AutoConcurrency tunes the parallel downloads of URLs or Manifest by
+	// the throughput they achieve, which starts from one and is capped by
+	// Concurrency, instead of running Concurrency of them all the time.
+	AutoConcurrency bool `json:"autoConcurrency,omitempty"`
+
+	// ForceHTTP2 attempts HTTP/2 to the https source, which requires dfget
+	// built with go1.13 or later, and IdleConnTimeout is how long an idle
+	// connection to source is kept alive for reuse, 0 means no limit.
+	// Neither of them affects the connections to peers.
+	ForceHTTP2      bool          `json:"forceHTTP2,omitempty"`
+	IdleConnTimeout time.Duration `json:"idleConnTimeout"`
+
+	// TraceRequests sends RequestID in the header 'X-Request-Id' of every
+	// request to source, so that they can be correlated with the access logs
+	// of the origin. RequestID is Sign if it's empty, and the one of each
+	// entry of URLs or Manifest is suffixed with its index starting from 1.
+	TraceRequests bool   `json:"traceRequests,omitempty"`
+	RequestID     string `json:"requestId,omitempty"`
+
+	// OutputUID and OutputGID are the owner of the output changed to after
+	// the download is verified, which are either the numeric ids or the
+	// names of the user and the group, and the empty one is kept as is.
+	// Changing them requires root, and the output can't be streamed.
+	OutputUID string `json:"outputUid,omitempty"`
+	OutputGID string `json:"outputGid,omitempty"`
+
+	// Preheat fetches the file into the local CacheDir without writing it to
+	// any output, so that the following downloads of it on this host are
+	// served from the cache by its ETag and Last-Modified, and nothing is
+	// seeded to supernodes or peers. Output must be empty and CacheDir must
+	// be set then, and the file is downloaded to WorkHome and removed once
+	// it's cached.
+	Preheat bool `json:"preheat,omitempty"`
+
+	// FallbackURLs are the mirrors of URL tried in order once requesting the
+	// source of the previous one fails, such as the connection is refused or
+	// the status code isn't allowed by BackSourceStatusAllow. The task and the
+	// cache are still of URL, so that the mirrors share them.
+	FallbackURLs []string `json:"fallbackUrls,omitempty"`
+
+	// NoServe registers the task as download-only with the port 0, so that
+	// the supernode never schedules the pieces of this peer to the others.
+	// UploadLimit is ignored then.
+	NoServe bool `json:"noServe,omitempty"`
+
+	// CompressOutput writes the content to Output in gzip, which is suffixed
+	// with CompressedOutputSuffix unless it already is. Md5 and Digest are
+	// still verified against the uncompressed content, and a compressed output
+	// can't be resumed. Unlike AcceptEncoding, it changes the file stored.
+	// The gzip is written to stdout only if CompressStdout is set as well.
+	CompressOutput bool `json:"compressOutput,omitempty"`
+	CompressStdout bool `json:"compressStdout,omitempty"`
+
+	// PeerStats collects the number of the pieces and the bytes fetched from
+	// each peer and the average latency of them. It's rejected until the
+	// pieces are fetched from peers, since P2PDownloader is not ported yet.
+	PeerStats bool `json:"peerStats,omitempty"`
+
+	// Expect100 sends 'Expect: 100-continue' with the requests to source
+	// unless the headers carry an Expect. It only applies to the requests
+	// with a body, whose body is sent after the source replies 100 Continue
+	// or the ExpectContinueTimeout of the transport elapses, so downloading
+	// by GET and HEAD only carries the header without waiting. The requests
+	// to supernodes and peers are never affected.
+	Expect100 bool `json:"expect100,omitempty"`
+
+	// MaxRedirects is the number of the redirects followed by each request
+	// to source, and the request fails with 'too many redirects' once it's
+	// exceeded. No redirect is followed if it's 0, and the redirect fails as
+	// errors.SourceStatusError then. Each hop is logged at debug level.
+	MaxRedirects int `json:"maxRedirects"`
+
+	// FetchRemoteDigest requests the digest published beside the url, which
+	// is '<url>.<algo>' with the algo of Digest or md5 if it's empty, and the
+	// downloaded file is verified against it. It must match Digest or Md5 if
+	// either is specified. The download goes on without it if the source
+	// replies 404, unless RequireRemoteDigest is set. The digest beside each
+	// of FallbackURLs is requested in order once the previous one fails.
+	FetchRemoteDigest   bool `json:"fetchRemoteDigest,omitempty"`
+	RequireRemoteDigest bool `json:"requireRemoteDigest,omitempty"`
+
+	// S3Endpoint is the http(s) url of the S3-compatible service serving the
+	// urls in the format of 's3://bucket/key', and the requests to it are
+	// signed with the credentials in the environment variables
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, which
+	// are never kept in the context. S3Region is DefaultS3Region if it's
+	// empty.
+	S3Endpoint string `json:"s3Endpoint,omitempty"`
+	S3Region   string `json:"s3Region,omitempty"`
+
+	// DockerAuthConfig is the docker config file, and the auth of the registry
+	// matching the host of source is used as the basic auth unless the url,
+	// the headers or netrc carries a credential. It's the config.json in
+	// $DOCKER_CONFIG or ~/.docker by default, and it's ignored if it doesn't
+	// exist.
+	DockerAuthConfig string `json:"dockerAuthConfig,omitempty"`
+
+	// ProgressJSON writes the progress to stderr as the newline-delimited
+	// json events like '{"url":..,"done":..,"total":..,"rate":..}', which are
+	// throttled and the final one carries the status and the error of the
+	// download. ShowBar is ignored if it's set.
+	ProgressJSON bool `json:"progressJSON,omitempty"`
+
+	// CleanOlderThan is the default threshold for Clean, the task files in
+	// the work home not modified for it are removed.
+	CleanOlderThan time.Duration `json:"cleanOlderThan"`
+
+	// URLs are downloaded in one invocation instead of URL, and each of them
+	// is written to the file named by the url in the directory of Output.
+	URLs []string `json:"urls,omitempty"`
+	// Manifest is the file listing the files to download instead of URL, and
+	// each of its lines is in the format of 'path  md5  url'.
+	Manifest string `json:"manifest,omitempty"`
+	// TrustManifest allows the paths of the entries of Manifest to be
+	// absolute or out of the directory of Output, otherwise such a manifest
+	// is rejected, so that the one from elsewhere can't overwrite any file.
+	TrustManifest bool `json:"trustManifest,omitempty"`
+	// ContinueOnError keeps downloading the rest of URLs or the entries of
+	// Manifest after one of them fails, otherwise the ones not started yet
+	// are skipped.
+	ContinueOnError bool `json:"continueOnError"`
+
+	// CleanOnInterrupt cancels the download when dfget is interrupted by
+	// SIGINT or SIGTERM, so that the partial output is removed unless Resume
+	// is set, and dfget exits with 128 plus the number of the signal.
+	CleanOnInterrupt bool `json:"cleanOnInterrupt"`
+
+	// Atomic downloads the file to Output with TempFileSuffix, which is
+	// renamed to Output only after it's verified, so that the partial file
+	// is never observed at Output. It's ignored if Output is stdout, and the
+	// temporary file is the one resumed if Resume is set.
+	Atomic bool `json:"atomic"`
+
+	// LockOutput holds the advisory lock of Output with LockFileSuffix while
+	// downloading, so that the download fails fast if Output is being
+	// downloaded by another dfget. The lock file is removed after the
+	// download, and it's ignored if Output is streamed.
+	LockOutput bool `json:"lockOutput"`
+
+	StartTime time.Time `json:"startTime"`
+	Sign      string    `json:"sign"`
+	// SignOverride replaces the Sign generated by NewContext when the ctx is
+	// validated, so that the embedders can get reproducible output. It
+	// bypasses the uniqueness of Sign, which identifies the peer and its
+	// files on supernode, so it must only be used in tests.
+	SignOverride string `json:"signOverride,omitempty"`
+	User         string `json:"user"`
+	WorkHome     string `json:"workHome"`
+	NetrcFile    string `json:"netrcFile"`
+	ConfigFile   string `json:"configFile"`
+	YAMLConfig   string `json:"yamlConfig"`
 
 	ClientLogger *logrus.Logger `json:"-"`
 	ServerLogger *logrus.Logger `json:"-"`
+
+	// OnProgress is called with the downloaded and total bytes whenever
+	// some content is written, the total is -1 if it's unknown.
+	// OnComplete is called with the output and the result when the download
+	// finishes. Both of them are invoked from the downloading goroutine, so
+	// the callers must serialize their own state. ShowBar is ignored if
+	// OnProgress is set.
+	OnProgress func(done, total int64)      `json:"-"`
+	OnComplete func(path string, err error) `json:"-"`
+
+	// NodeResolver returns the supernodes to register to, and it overrides
+	// Node if it's set. It's called before the registration and each retry
+	// of it on the downloading goroutine, so that the nodes can be picked by
+	// the callers at runtime, e.g. from a service discovery.
+	NodeResolver func() []string `json:"-"`
+
+	// Metrics records the metrics of downloading if it's set.
+	Metrics MetricsRecorder `json:"-"`
+
+	// hasRange is set by SetRange, so that the range ending at 0 isn't
+	// regarded as no range.
+	hasRange bool
+}
+
+// MetricsRecorder is the sink of the metrics of downloading, so that they can
+// be exported to a monitoring system such as Prometheus without depending on
+// it. The implementations must be safe for concurrent use, because the
+// downloads of urls run concurrently.
+type MetricsRecorder interface {
+	// RecordBytes records n bytes received from source or peers, and the
+	// ones read from the cache aren't counted.
+	RecordBytes(n int64)
+	// RecordDuration records the cost of a download and its result.
+	RecordDuration(d time.Duration, err error)
+	// RecordBackSource records that a download goes back to source for the
+	// BackSourceReason.
+	RecordBackSource(reason int)
 }
 
+// String returns the json of ctx, and the password and the values of
+// SensitiveQueryKeys in url, urls and fallbackUrls, SensitiveHeaders and the password of proxy are
+// redacted.
 func (ctx *Context) String() string {
-	js, _ := json.Marshal(ctx)
+	c := *ctx
+	c.URL = RedactURL(ctx.URL)
+	c.URLs = redactURLs(ctx.URLs)
+	c.FallbackURLs = redactURLs(ctx.FallbackURLs)
+	c.Header = redactHeaders(ctx.Header)
+	c.Proxy = redactPassword(ctx.Proxy)
+	c.S3Endpoint = redactPassword(ctx.S3Endpoint)
+	js, _ := json.Marshal(&c)
 	return fmt.Sprintf("%s", js)
 }
 
+// redactPassword replaces the password in the userinfo of the url.
+func redactPassword(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawURL
+	}
+	// the username is escaped so the first '@' ends the userinfo, and the
+	// password is inserted as is to avoid escaping the redacted
+	u.User = url.User(u.User.Username())
+	s := u.String()
+	at := strings.IndexByte(s, '@')
+	return s[:at] + ":" + redacted + s[at:]
+}
+
+// RedactURL replaces the password and the values of SensitiveQueryKeys in
+// the url, so that it can be logged.
+func RedactURL(rawURL string) string {
+	return redactPassword(redactURL(rawURL))
+}
+
+// redactURL replaces the values of SensitiveQueryKeys in the url, and the
+// rest of it is kept as is.
+func redactURL(rawURL string) string {
+	start := strings.IndexByte(rawURL, '?')
+	if start < 0 {
+		return rawURL
+	}
+	end := len(rawURL)
+	if idx := strings.IndexByte(rawURL[start:], '#'); idx >= 0 {
+		end = start + idx
+	}
+
+	params := strings.Split(rawURL[start+1:end], "&")
+	for i, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 && containsFold(SensitiveQueryKeys, kv[0]) {
+			params[i] = kv[0] + "=" + redacted
+		}
+	}
+	return rawURL[:start+1] + strings.Join(params, "&") + rawURL[end:]
+}
+
+// redactURLs returns a copy of urls in which each url is redacted by
+// RedactURL.
+func redactURLs(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+	result := make([]string, len(urls))
+	for i, u := range urls {
+		result[i] = RedactURL(u)
+	}
+	return result
+}
+
+// redactHeaders returns a copy of headers in which the values of
+// SensitiveHeaders are replaced.
+func redactHeaders(headers []string) []string {
+	if headers == nil {
+		return nil
+	}
+	result := make([]string, len(headers))
+	for i, header := range headers {
+		result[i] = header
+		if kv := strings.SplitN(header, ":", 2); len(kv) == 2 &&
+			containsFold(SensitiveHeaders, strings.TrimSpace(kv[0])) {
+			result[i] = kv[0] + ":" + redacted
+		}
+	}
+	return result
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
 // NewContext creates and initialize a Context.
 func NewContext() *Context {
 	ctx := new(Context)
-	ctx.StartTime = time.Now()
-	ctx.Sign = fmt.Sprintf("%d-%.3f",
-		os.Getpid(), float64(time.Now().UnixNano())/float64(time.Second))
+	ctx.sign()
 
 	if currentUser, err := user.Current(); err == nil {
 		ctx.User = currentUser.Username
 		ctx.WorkHome = path.Join(currentUser.HomeDir, ".small-dragonfly")
+		ctx.NetrcFile = path.Join(currentUser.HomeDir, ".netrc")
+		ctx.DockerAuthConfig = path.Join(currentUser.HomeDir, ".docker", DockerConfigFileName)
 	} else {
 		panic(fmt.Errorf("get user error: %s", err))
 	}
+	if dir := os.Getenv(DockerConfigEnv); dir != "" {
+		ctx.DockerAuthConfig = path.Join(dir, DockerConfigFileName)
+	}
 	ctx.ConfigFile = DefaultConfigFile
+	ctx.MaxRetries = DefaultMaxRetries
+	ctx.RetryInterval = DefaultRetryInterval
+	ctx.RetryJitter = true
+	ctx.NodeFailureThreshold = DefaultNodeFailureThreshold
+	ctx.NodeCooldown = DefaultNodeCooldown
+	ctx.IdleConnTimeout = DefaultIdleConnTimeout
+	ctx.MaxRedirects = DefaultMaxRedirects
+	ctx.Concurrency = DefaultConcurrency
+	ctx.UserAgent = "dfget/" + version.DFGetVersion
+	ctx.CleanOnInterrupt = true
+	ctx.Atomic = true
+	ctx.LockOutput = true
+	ctx.CleanOlderThan = DefaultCleanOlderThan
 	return ctx
 }
 
+var backSourceReasonDesc = map[int]string{
+	BackSourceReasonNone:          "none",
+	BackSourceReasonRegisterFail:  "register fail",
+	BackSourceReasonMd5NotMatch:   "md5 not match",
+	BackSourceReasonDownloadError: "download error",
+	BackSourceReasonNoSpace:       "no space",
+	BackSourceReasonInitError:     "init error",
+	BackSourceReasonWriteError:    "write error",
+	BackSourceReasonHostSysError:  "host system error",
+}
+
+// BackSourceReasonDesc returns the human-readable description of the
+// BackSourceReason.
+func (ctx *Context) BackSourceReasonDesc() string {
+	reason, suffix := ctx.BackSourceReason, ""
+	if reason >= ForceNotBackSourceAddition {
+		reason, suffix = reason-ForceNotBackSourceAddition, ", not back source"
+	}
+	desc, ok := backSourceReasonDesc[reason]
+	if !ok {
+		desc = "unknown"
+	}
+	return desc + suffix
+}
+
+// Clone returns a deep copy of the ctx, and the StartTime and Sign of the
+// copy are regenerated so that each download has its own signature.
+// The loggers are shared between the ctx and its copy.
+func (ctx *Context) Clone() *Context {
+	c := *ctx
+	c.URLs = copyStrings(ctx.URLs)
+	c.FallbackURLs = copyStrings(ctx.FallbackURLs)
+	c.Filter = copyStrings(ctx.Filter)
+	c.Header = copyStrings(ctx.Header)
+	c.Node = copyStrings(ctx.Node)
+	c.LimitSchedule = copyStrings(ctx.LimitSchedule)
+	if ctx.BackSourceStatusAllow != nil {
+		c.BackSourceStatusAllow = append([]int(nil), ctx.BackSourceStatusAllow...)
+	}
+	if ctx.Labels != nil {
+		c.Labels = make(map[string]string, len(ctx.Labels))
+		for k, v := range ctx.Labels {
+			c.Labels[k] = v
+		}
+	}
+	c.sign()
+	return &c
+}
+
+// sign initializes the StartTime and generates the Sign with it.
+func (ctx *Context) sign() {
+	ctx.StartTime = DefaultClock.Now()
+	ctx.Sign = fmt.Sprintf("%d-%.3f",
+		os.Getpid(), float64(ctx.StartTime.UnixNano())/float64(time.Second))
+}
+
+func copyStrings(src []string) []string {
+	if src == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(src)), src...)
+}
+
 // AssertContext checks the ctx and panic if any error happens.
 func AssertContext(ctx *Context) {
 	util.PanicIfNil(ctx, "runtime context is not initialized")
 	util.PanicIfNil(ctx.ClientLogger, "client log is not initialized")
 	util.PanicIfNil(ctx.ServerLogger, "server log is not initialized")
 
-	defer func() {
-		if err := recover(); err != nil {
-			ctx.ClientLogger.Panic(err)
+	if err := ctx.Validate(); err != nil {
+		ctx.ClientLogger.Panic(err)
+	}
+	for _, warning := range ctx.Warnings() {
+		ctx.ClientLogger.Warn(warning)
+	}
+}
+
+// Warnings returns the options of ctx which are allowed by Validate but
+// probably not intended, and they're logged by AssertContext.
+func (ctx *Context) Warnings() []string {
+	var warnings []string
+	// the peer never serving the pieces reduces the health of p2p
+	if ctx.NoServe {
+		warnings = append(warnings, "noserve is set, the pieces are never served to other peers, "+
+			"which reduces the health of p2p")
+		if ctx.UploadLimit > 0 {
+			warnings = append(warnings,
+				fmt.Sprintf("uploadlimit[%d] is ignored since noserve is set", ctx.UploadLimit))
+		}
+	}
+	return warnings
+}
+
+// Validate checks the ctx and returns the first error found, it neither
+// logs nor panics so that it can be used programmatically.
+// Some fields such as Output are normalized during the checking.
+func (ctx *Context) Validate() error {
+	if util.IsNil(ctx.ClientLogger) {
+		return errors.New("client log is not initialized")
+	}
+	if util.IsNil(ctx.ServerLogger) {
+		return errors.New("server log is not initialized")
+	}
+
+	for _, c := range checkers {
+		if err := c.check(ctx); err != nil {
+			return fmt.Errorf("%s: %v", c.msg, err)
 		}
-	}()
+	}
+	return nil
+}
+
+// checkers verify the ctx in order, some of them depend on the previous ones,
+// such as checkOutput must be called after checkURL.
+var checkers = []struct {
+	check func(*Context) error
+	msg   string
+}{
+	{checkSign, "invalid sign override"},
+	{checkURL, "invalid url"},
+	{checkManifest, "invalid manifest"},
+	{checkOutput, "invalid output"},
+	{checkCompressOutput, "invalid compress output"},
+	{checkMd5, "invalid md5"},
+	{checkDigest, "invalid digest"},
+	{checkRemoteDigest, "invalid remote digest"},
+	{checkVerifyOnly, "invalid verify only"},
+	{checkChecksumSidecar, "invalid checksum sidecar"},
+	{checkOutputOwner, "invalid output owner"},
+	{checkIdentifier, "invalid identifier"},
+	{checkTaskID, "invalid task id"},
+	{checkPattern, "invalid pattern"},
+	{checkCallSystem, "invalid call system"},
+	{checkMaxSize, "invalid max size"},
+	{checkPieceSize, "invalid piece size"},
+	{checkUploadLimit, "invalid upload limit"},
+	{checkLimitSchedule, "invalid limit schedule"},
+	{checkRange, "invalid range"},
+	{checkFilter, "invalid filter"},
+	{checkHeader, "invalid header"},
+	{checkUserAgent, "invalid user agent"},
+	{checkRequestID, "invalid request id"},
+	{checkProxy, "invalid proxy"},
+	{checkBackSourceStatusAllow, "invalid back source status allow"},
+	{checkS3, "invalid s3"},
+	{checkTLS, "invalid tls"},
+	{checkNodes, "invalid node"},
+	{checkRetry, "invalid retry"},
+	{checkNodeBreaker, "invalid node breaker"},
+	{checkConcurrency, "invalid concurrency"},
+	{checkMaxConnsPerHost, "invalid max conns per host"},
+	{checkIdleConnTimeout, "invalid idle conn timeout"},
+	{checkMaxRedirects, "invalid max redirects"},
+	{checkTimeout, "invalid timeout"},
+	{checkIdleTimeout, "invalid idle timeout"},
+	{checkFileMode, "invalid file mode"},
+	{checkWorkHome, "invalid workhome"},
+	{checkPreheat, "invalid preheat"},
+	{checkCacheDir, "invalid cache dir"},
+	{checkPostHook, "invalid post hook"},
+	{checkQuiet, "invalid quiet"},
+	{checkLabels, "invalid labels"},
+	{checkPeerStats, "invalid peer stats"},
+}
 
-	util.PanicIfError(checkURL(ctx), "invalid url")
-	util.PanicIfError(checkOutput(ctx), "invalid output")
+// checkSign replaces the Sign with SignOverride if it's set, and it must be
+// usable in file names and urls.
+func checkSign(ctx *Context) error {
+	if util.IsEmptyStr(ctx.SignOverride) {
+		return nil
+	}
+	for _, r := range ctx.SignOverride {
+		if r == '/' || r == '?' || r == '#' || r == '%' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("%q contains invalid character", ctx.SignOverride)
+		}
+	}
+	ctx.Sign = ctx.SignOverride
+	return nil
 }
 
+// checkURL verifies the url, or each of the urls if URLs is specified, and
+// both of them can't be specified at the same time. Each of FallbackURLs is
+// verified as the url, and they can't be shared by URLs or Manifest.
 func checkURL(ctx *Context) error {
-	// shorter than the shortest case 'http://a.b'
-	if len(ctx.URL) < 10 {
-		return fmt.Errorf(ctx.URL)
+	if len(ctx.FallbackURLs) > 0 && (len(ctx.URLs) > 0 || !util.IsEmptyStr(ctx.Manifest)) {
+		return fmt.Errorf("fallback urls can't be shared by urls or manifest")
+	}
+	// the urls of the manifest are checked by checkManifest
+	if !util.IsEmptyStr(ctx.Manifest) {
+		return nil
+	}
+	if ctx.VerifyOnly && len(ctx.URLs) == 0 && util.IsEmptyStr(ctx.URL) {
+		return nil
+	}
+	if len(ctx.URLs) == 0 {
+		if err := ctx.validateSourceURL(ctx.URL); err != nil {
+			return err
+		}
+		for _, u := range ctx.FallbackURLs {
+			if err := ctx.validateSourceURL(u); err != nil {
+				return fmt.Errorf("fallback %v", err)
+			}
+		}
+		return nil
 	}
-	reg := regexp.MustCompile(`(https?|HTTPS?)://([\w-]+\.)+[\w-]+(/[\w- ./?%&=]*)?`)
-	if url := reg.FindString(ctx.URL); util.IsEmptyStr(url) {
-		return fmt.Errorf(ctx.URL)
+	if !util.IsEmptyStr(ctx.URL) {
+		return fmt.Errorf("%s conflicts with urls", ctx.URL)
+	}
+	for _, u := range ctx.URLs {
+		if err := ctx.validateSourceURL(u); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// This function must be called after checkURL
-func checkOutput(ctx *Context) error {
-	if util.IsEmptyStr(ctx.Output) {
-		url := strings.TrimRight(ctx.URL, "/")
-		idx := strings.LastIndexByte(url, '/')
-		if idx < 0 {
-			return fmt.Errorf("get output from url[%s] error", ctx.URL)
+// validateSourceURL verifies the url, and the s3 url requires S3Endpoint.
+func (ctx *Context) validateSourceURL(rawURL string) error {
+	if IsS3URL(rawURL) && util.IsEmptyStr(ctx.S3Endpoint) {
+		return fmt.Errorf("%s requires s3 endpoint", rawURL)
+	}
+	return validateURL(rawURL)
+}
+
+func validateURL(rawURL string) error {
+	if IsS3URL(rawURL) {
+		_, _, err := ParseS3URL(rawURL)
+		return err
+	}
+	// shorter than the shortest case 'ftp://a.b'
+	if len(rawURL) < 9 {
+		return errors.New(rawURL)
+	}
+	reg := regexp.MustCompile(`(https?|HTTPS?|ftps?|FTPS?)://([\w-]+\.)+[\w-]+(/[\w- ./?%&=]*)?`)
+	if url := reg.FindString(rawURL); !util.IsEmptyStr(url) {
+		return nil
+	}
+	// the host is a bracketed IPv6 literal such as 'http://[2001:db8::1]:8080/file'
+	if m := ipv6URLReg.FindStringSubmatch(rawURL); m != nil && net.ParseIP(m[2]) != nil {
+		return nil
+	}
+	return errors.New(rawURL)
+}
+
+// IsS3URL reports whether rawURL is of the scheme 's3', whose object is
+// requested from S3Endpoint.
+func IsS3URL(rawURL string) bool {
+	return len(rawURL) > len(SchemaS3) && strings.EqualFold(rawURL[:len(SchemaS3)+1], SchemaS3+":")
+}
+
+// ParseS3URL parses the url in the format of 's3://bucket/key'.
+func ParseS3URL(rawURL string) (bucket, key string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.EqualFold(u.Scheme, SchemaS3) {
+		return "", "", fmt.Errorf("%s is not s3 url", rawURL)
+	}
+	bucket, key = u.Host, strings.TrimPrefix(u.Path, "/")
+	if util.IsEmptyStr(bucket) || util.IsEmptyStr(key) || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("%s is not in the format of 's3://bucket/key'", rawURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", "", fmt.Errorf("query and fragment of s3 url[%s] are not supported", rawURL)
+	}
+	return bucket, key, nil
+}
+
+// outputNameOfURL returns the last segment of rawURL percent-decoded, with
+// the query and the fragment stripped. It doesn't parse rawURL, because the
+// urls without scheme such as '127.0.0.1:8080/a' are accepted by checkURL.
+// The output must be given explicitly if the name is empty or unsafe.
+// If fileOnly is set, the name of the file in a directory must be the last
+// segment of the path, and the url ending with '/' or without path, whose
+// host would be the name otherwise, is rejected.
+func outputNameOfURL(rawURL string, fileOnly bool) (string, error) {
+	u := rawURL
+	if idx := strings.IndexAny(u, "?#"); idx >= 0 {
+		u = u[:idx]
+	}
+	if fileOnly {
+		hostPath := u
+		if idx := strings.Index(u, "://"); idx >= 0 {
+			hostPath = u[idx+len("://"):]
+		}
+		if strings.HasSuffix(u, "/") || !strings.Contains(hostPath, "/") {
+			return "", fmt.Errorf("get file name from url[%s] error", rawURL)
+		}
+	}
+	u = strings.TrimRight(u, "/")
+	idx := strings.LastIndexByte(u, '/')
+	if idx < 0 {
+		return "", fmt.Errorf("get output from url[%s] error, output is required", rawURL)
+	}
+	name, err := url.PathUnescape(u[idx+1:])
+	if err != nil || util.IsEmptyStr(name) || name == "." || name == ".." ||
+		strings.ContainsAny(name, "/\x00") {
+		return "", fmt.Errorf("get output from url[%s] error, output is required", rawURL)
+	}
+	return name, nil
+}
+
+func isDir(name string) bool {
+	f, err := os.Stat(name)
+	return err == nil && f.IsDir()
+}
+
+// ResolveOutput returns the absolute path of output. The output is derived
+// from the last part of url by outputNameOfURL if it's empty, and a relative
+// output is resolved against the current working directory.
+func ResolveOutput(url, output string) (string, error) {
+	if util.IsEmptyStr(output) {
+		name, err := outputNameOfURL(url, false)
+		if err != nil {
+			return "", err
 		}
-		ctx.Output = url[idx+1:]
+		output = name
 	}
 
-	if !filepath.IsAbs(ctx.Output) {
-		absPath, err := filepath.Abs(ctx.Output)
+	if !filepath.IsAbs(output) {
+		absPath, err := filepath.Abs(output)
 		if err != nil {
-			return fmt.Errorf("get absolute path[%s] error: %v", ctx.Output, err)
+			return "", fmt.Errorf("get absolute path[%s] error: %v", output, err)
 		}
-		ctx.Output = absPath
+		output = absPath
+	}
+	return output, nil
+}
+
+// This function must be called after checkURL, and the output '-' means
+// writing to stdout which needs no checking. The output prefixed with
+// UnixSocketOutputPrefix is checked by checkOutputSocket instead.
+// If the output is an existing directory, the file name is derived from
+// the path of url and the file is placed in that directory.
+// The missing parent directories of the output are created if MkdirParents
+// is set. The output of URLs is checked by checkOutputDir instead.
+// The output must not be a symlink if NoFollowSymlinks is set.
+// The environment variables such as $VAR or ${VAR} in the output are expanded
+// first, and the unset ones are replaced with empty strings. Then the tokens
+// of the template are replaced with the parts of url, see
+// ExpandOutputTemplate.
+func checkOutput(ctx *Context) error {
+	// the output of preheating is set by checkPreheat
+	if ctx.Preheat {
+		return nil
+	}
+	ctx.Output = os.ExpandEnv(ctx.Output)
+	if len(ctx.URLs) > 0 || !util.IsEmptyStr(ctx.Manifest) {
+		return checkOutputDir(ctx)
+	}
+	if ctx.Output == StdoutOutput {
+		return nil
+	}
+	if strings.HasPrefix(ctx.Output, UnixSocketOutputPrefix) {
+		return checkOutputSocket(ctx)
+	}
+	output, err := ExpandOutputTemplate(ctx.URL, ctx.Output)
+	if err != nil {
+		return err
 	}
+	if output, err = ResolveOutput(ctx.URL, output); err != nil {
+		return err
+	}
+	ctx.Output = output
 
-	if f, err := os.Stat(ctx.Output); err == nil && f.IsDir() {
-		return fmt.Errorf("path[%s] is directory but requires file path", ctx.Output)
+	if isDir(ctx.Output) {
+		name, err := outputNameOfURL(ctx.URL, true)
+		if err != nil || isDir(filepath.Join(ctx.Output, name)) {
+			return fmt.Errorf("path[%s] is directory but requires file path", ctx.Output)
+		}
+		ctx.Output = filepath.Join(ctx.Output, name)
+	}
+	if ctx.CompressOutput && !strings.HasSuffix(ctx.Output, CompressedOutputSuffix) {
+		ctx.Output += CompressedOutputSuffix
+	}
+	if ctx.NoFollowSymlinks && util.IsSymlink(ctx.Output) {
+		return fmt.Errorf("path[%s] is symlink but nofollowsymlinks is set", ctx.Output)
 	}
 
 	// check permission
@@ -184,5 +962,1002 @@ func checkOutput(ctx *Context) error {
 			return fmt.Errorf("user[%s] path[%s] %v", ctx.User, ctx.Output, err)
 		}
 	}
+
+	if ctx.MkdirParents {
+		if err := os.MkdirAll(filepath.Dir(ctx.Output), 0755); err != nil {
+			return fmt.Errorf("user[%s] create parent directory of path[%s] error: %v",
+				ctx.User, ctx.Output, err)
+		}
+	}
+	return nil
+}
+
+// checkCompressOutput verifies that the compressed output is neither resumed
+// nor written to stdout unless CompressStdout is set, and the checksum sidecar
+// and Preheat can't be used with it, because both of them are of the
+// uncompressed content.
+func checkCompressOutput(ctx *Context) error {
+	if !ctx.CompressOutput {
+		return nil
+	}
+	if ctx.Output == StdoutOutput && !ctx.CompressStdout {
+		return fmt.Errorf("gzip can't be written to stdout unless compress stdout is set")
+	}
+	if ctx.Resume {
+		return fmt.Errorf("compressed output can't be resumed")
+	}
+	if ctx.WriteChecksumSidecar {
+		return fmt.Errorf("compressed output conflicts with checksum sidecar")
+	}
+	if ctx.Preheat {
+		return fmt.Errorf("compressed output conflicts with preheat")
+	}
+	return nil
+}
+
+// ExpandOutputTemplate replaces the tokens in output with the parts of the
+// url, and output is returned as is if it contains no tokens. {base} is the
+// last segment of the path which must not be empty, {dir} is the directory of
+// the path without the leading '/' or '.' if it's the root, {host} is the
+// host name without port, and {ext} is the extension of {base} with the dot.
+// For example, the output '{host}/{dir}/{base}' of the url
+// 'http://a.b/releases/v1.2.3/app.tar.gz' is 'a.b/releases/v1.2.3/app.tar.gz'.
+func ExpandOutputTemplate(rawURL, output string) (string, error) {
+	if !outputTemplateReg.MatchString(output) {
+		return output, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("parse url[%s] error: %v", rawURL, err)
+	}
+	p := path.Clean("/" + u.Path)
+	dir := strings.TrimPrefix(path.Dir(p), "/")
+	if dir == "" {
+		dir = "."
+	}
+	var base string
+	if !strings.HasSuffix(u.Path, "/") && p != "/" {
+		base = path.Base(p)
+	}
+	values := map[string]string{
+		"{base}": base,
+		"{dir}":  dir,
+		"{host}": u.Hostname(),
+		"{ext}":  path.Ext(base),
+	}
+
+	for _, token := range outputTemplateReg.FindAllString(output, -1) {
+		value, ok := values[token]
+		if !ok {
+			return "", fmt.Errorf("invalid output template[%s] token:%s", output, token)
+		}
+		if token == "{base}" && util.IsEmptyStr(value) {
+			return "", fmt.Errorf("get file name from url[%s] error", rawURL)
+		}
+	}
+	return outputTemplateReg.ReplaceAllStringFunc(output, func(token string) string {
+		return values[token]
+	}), nil
+}
+
+// checkOutputSocket verifies that the directory of the unix socket exists, and
+// the path of the socket is made absolute. The socket is connected when
+// downloading, so it isn't required to exist yet.
+func checkOutputSocket(ctx *Context) error {
+	path := strings.TrimPrefix(ctx.Output, UnixSocketOutputPrefix)
+	if util.IsEmptyStr(path) {
+		return fmt.Errorf("empty path of unix socket")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("get absolute path[%s] error: %v", path, err)
+	}
+	if !isDir(filepath.Dir(path)) {
+		return fmt.Errorf("directory of unix socket[%s] doesn't exist", path)
+	}
+	ctx.Output = UnixSocketOutputPrefix + path
+	return nil
+}
+
+// OutputSocket returns the path of the unix socket which the output is
+// streamed to, and it's empty if the output is not a unix socket.
+func (ctx *Context) OutputSocket() string {
+	if strings.HasPrefix(ctx.Output, UnixSocketOutputPrefix) {
+		return strings.TrimPrefix(ctx.Output, UnixSocketOutputPrefix)
+	}
+	return ""
+}
+
+// OutputFIFO reports whether the output is an existing named pipe, which the
+// file is streamed to as it's downloaded.
+func (ctx *Context) OutputFIFO() bool {
+	return ctx.Output != StdoutOutput && ctx.OutputSocket() == "" && util.IsFIFO(ctx.Output)
+}
+
+// StreamsOutput reports whether the file is streamed to stdout, a unix socket
+// or a named pipe instead of being written to a file.
+func (ctx *Context) StreamsOutput() bool {
+	return ctx.Output == StdoutOutput || ctx.OutputSocket() != "" || ctx.OutputFIFO()
+}
+
+// checkOutputDir verifies that the output of URLs or Manifest is a directory,
+// which is the current working directory if it's empty and is created if
+// MkdirParents is set. The files named by the urls in it must be distinct.
+func checkOutputDir(ctx *Context) error {
+	if ctx.Output == StdoutOutput || strings.HasPrefix(ctx.Output, UnixSocketOutputPrefix) {
+		return fmt.Errorf("urls can't be streamed to unix socket or stdout")
+	}
+	output, err := filepath.Abs(ctx.Output)
+	if err != nil {
+		return fmt.Errorf("get absolute path[%s] error: %v", ctx.Output, err)
+	}
+	ctx.Output = output
+	if outputTemplateReg.MatchString(ctx.Output) {
+		return fmt.Errorf("output template can't be used with urls")
+	}
+	if ctx.MkdirParents {
+		if err := os.MkdirAll(ctx.Output, 0755); err != nil {
+			return fmt.Errorf("user[%s] create directory[%s] error: %v", ctx.User, ctx.Output, err)
+		}
+	}
+	if !isDir(ctx.Output) {
+		return fmt.Errorf("path[%s] is not directory but urls require one", ctx.Output)
+	}
+
+	names := make(map[string]string, len(ctx.URLs))
+	for _, u := range ctx.URLs {
+		name, err := outputNameOfURL(u, true)
+		if err != nil {
+			return err
+		}
+		if prev, ok := names[name]; ok {
+			return fmt.Errorf("url[%s] and url[%s] are both written to %s", prev, u, name)
+		}
+		names[name] = u
+	}
+	return nil
+}
+
+// SplitURLs returns a copy of ctx for each of URLs, whose Output is the file
+// named by the url in the directory of ctx.Output, and each copy is
+// validated.
+func (ctx *Context) SplitURLs() ([]*Context, error) {
+	ctxs := make([]*Context, 0, len(ctx.URLs))
+	for i, u := range ctx.URLs {
+		c := ctx.Clone()
+		c.URL, c.URLs = u, nil
+		c.RequestID = ctx.splitRequestID(i)
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("url[%s] %v", u, err)
+		}
+		ctxs = append(ctxs, c)
+	}
+	return ctxs, nil
+}
+
+// splitRequestID returns the request id of the i-th copy of ctx split by
+// SplitURLs or SplitManifest.
+func (ctx *Context) splitRequestID(i int) string {
+	if !ctx.TraceRequests || util.IsEmptyStr(ctx.RequestID) {
+		return ""
+	}
+	return ctx.RequestID + "-" + strconv.Itoa(i+1)
+}
+
+// checkRequestID verifies that the request id has no control characters if
+// the requests are traced, and it's set to Sign if it's empty.
+func checkRequestID(ctx *Context) error {
+	if !ctx.TraceRequests {
+		return nil
+	}
+	if util.IsEmptyStr(ctx.RequestID) {
+		ctx.RequestID = ctx.Sign
+	}
+	for _, r := range ctx.RequestID {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%q contains control character", ctx.RequestID)
+		}
+	}
+	return nil
+}
+
+// checkMd5 verifies the format of md5 before downloading, and an empty md5
+// is valid because the md5 verification is optional.
+func checkMd5(ctx *Context) error {
+	if util.IsEmptyStr(ctx.Md5) {
+		return nil
+	}
+	if !md5Reg.MatchString(ctx.Md5) {
+		return errors.New(ctx.Md5)
+	}
+	return nil
+}
+
+// checkDigest verifies the digest, and it must be consistent with md5 if
+// both of them are md5. Neither of them can be specified with URLs.
+func checkDigest(ctx *Context) error {
+	if len(ctx.URLs) > 0 && !util.IsEmptyStr(ctx.ExpectedDigest()) {
+		return fmt.Errorf("md5 and digest can't be shared by urls")
+	}
+	if util.IsEmptyStr(ctx.Digest) {
+		return nil
+	}
+	algo, hex, err := ParseDigest(ctx.Digest)
+	if err != nil {
+		return err
+	}
+	if algo == DigestMD5 && !util.IsEmptyStr(ctx.Md5) && hex != ctx.Md5 && !ctx.HasRange() {
+		return fmt.Errorf("digest[%s] conflicts with md5[%s]", ctx.Digest, ctx.Md5)
+	}
+	return nil
+}
+
+// checkRemoteDigest verifies that the remote digest is fetched if it's
+// required, and it's of the whole file so the range can't be verified with it.
+func checkRemoteDigest(ctx *Context) error {
+	if ctx.RequireRemoteDigest && !ctx.FetchRemoteDigest {
+		return fmt.Errorf("remote digest can't be required unless it's fetched")
+	}
+	if ctx.FetchRemoteDigest && ctx.HasRange() {
+		return fmt.Errorf("range can't be verified with the remote digest of the whole file")
+	}
+	return nil
+}
+
+// checkVerifyOnly verifies that the output to verify is an existing file and
+// the digest is specified or fetched, and it must be called after checkOutput.
+func checkVerifyOnly(ctx *Context) error {
+	if !ctx.VerifyOnly || !util.IsEmptyStr(ctx.Manifest) {
+		return nil
+	}
+	if len(ctx.URLs) > 0 {
+		return fmt.Errorf("urls can't be verified since they can't share the digest")
+	}
+	if util.IsEmptyStr(ctx.ExpectedDigest()) && !ctx.FetchRemoteDigest {
+		return fmt.Errorf("md5 or digest is required")
+	}
+	if ctx.StreamsOutput() {
+		return fmt.Errorf("output[%s] is streamed and can't be verified", ctx.Output)
+	}
+	if info, err := os.Stat(ctx.Output); err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("output[%s] is not an existing file", ctx.Output)
+	}
+	return nil
+}
+
+// checkChecksumSidecar verifies that the output isn't streamed if the
+// checksum sidecar is written, and it must be called after checkOutput.
+func checkChecksumSidecar(ctx *Context) error {
+	if !ctx.WriteChecksumSidecar || len(ctx.URLs) > 0 || !util.IsEmptyStr(ctx.Manifest) {
+		return nil
+	}
+	if ctx.StreamsOutput() {
+		return fmt.Errorf("output[%s] is streamed and has no checksum sidecar", ctx.Output)
+	}
+	return nil
+}
+
+// ParseDigest parses the digest in the format of 'algo:hex', the algo can be
+// md5, sha1 or sha256, and the hex must match the length of the algo.
+func ParseDigest(digest string) (algo, hex string, err error) {
+	kv := strings.SplitN(digest, ":", 2)
+	if len(kv) != 2 {
+		return "", "", fmt.Errorf("digest[%s] is not in the format of 'algo:hex'", digest)
+	}
+	algo, hex = strings.ToLower(kv[0]), strings.ToLower(kv[1])
+	h := util.NewHash(algo)
+	if h == nil {
+		return "", "", fmt.Errorf("unsupported digest algorithm[%s]", kv[0])
+	}
+	if len(hex) != h.Size()*2 || !hexReg.MatchString(hex) {
+		return "", "", fmt.Errorf("malformed %s hex[%s]", algo, kv[1])
+	}
+	return algo, hex, nil
+}
+
+// checkIdentifier verifies that the identifier has no control characters,
+// and an empty one means the task is shared by url and md5.
+func checkIdentifier(ctx *Context) error {
+	for _, r := range ctx.Identifier {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%q contains control character", ctx.Identifier)
+		}
+	}
+	return nil
+}
+
+// checkTaskID verifies that the task id is a hex token of 16 to 128
+// characters, and an empty one means the task id is derived by supernode
+// from url, md5 and identifier.
+func checkTaskID(ctx *Context) error {
+	if util.IsEmptyStr(ctx.TaskID) {
+		return nil
+	}
+	if !taskIDReg.MatchString(ctx.TaskID) {
+		return fmt.Errorf("%q is not a hex token of 16 to 128 characters", ctx.TaskID)
+	}
+	if len(ctx.URLs) > 0 {
+		return fmt.Errorf("task id conflicts with urls")
+	}
+	return nil
+}
+
+// ExpectedDigest returns the digest in the format of 'algo:hex' that the
+// downloaded file should match, Md5 is a shorthand for 'md5:hex' when Digest
+// is empty. It's empty if neither of them is specified.
+// Md5 is of the whole file, so only Digest is of the slice if HasRange.
+func (ctx *Context) ExpectedDigest() string {
+	if !util.IsEmptyStr(ctx.Digest) {
+		return ctx.Digest
+	}
+	if !util.IsEmptyStr(ctx.Md5) && !ctx.HasRange() {
+		return DigestMD5 + ":" + ctx.Md5
+	}
+	return ""
+}
+
+// checkPattern verifies the download pattern, it must be one of 'p2p', 'cdn'
+// and 'source', and it will be set to 'p2p' if it's empty.
+func checkPattern(ctx *Context) error {
+	switch ctx.Pattern {
+	case "":
+		ctx.Pattern = PatternP2P
+	case PatternP2P, PatternCDN:
+	case PatternSource:
+		if ctx.Notbs {
+			return fmt.Errorf("%s conflicts with notbs", ctx.Pattern)
+		}
+		if ctx.SystemdNotify {
+			return fmt.Errorf("%s never registers to supernode and can't notify systemd of ready", ctx.Pattern)
+		}
+	default:
+		return errors.New(ctx.Pattern)
+	}
+	return nil
+}
+
+// checkCallSystem sets the call system to DefaultCallSystem if it's empty,
+// so that supernode can always tell where the task comes from.
+func checkCallSystem(ctx *Context) error {
+	if util.IsEmptyStr(ctx.CallSystem) {
+		ctx.CallSystem = DefaultCallSystem()
+	}
+	return nil
+}
+
+// DefaultCallSystem returns the call system of the context without one,
+// which is the name of the binary.
+func DefaultCallSystem() string {
+	return filepath.Base(os.Args[0])
+}
+
+// checkFilter verifies the keys of the query params filtered from the url
+// to compute the task, and an empty filter means nothing is filtered.
+func checkFilter(ctx *Context) error {
+	for _, key := range ctx.Filter {
+		if util.IsEmptyStr(key) || strings.ContainsAny(key, "=&?# ") {
+			return fmt.Errorf("invalid key[%s]", key)
+		}
+	}
+	return nil
+}
+
+// checkProxy verifies the proxy of the requests to source, and an empty one
+// means the proxy environment variables are used.
+func checkProxy(ctx *Context) error {
+	if util.IsEmptyStr(ctx.Proxy) {
+		return nil
+	}
+	u, err := url.Parse(ctx.Proxy)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case SchemaHTTP, SchemaHTTPS, "socks5":
+	default:
+		return fmt.Errorf("unsupported scheme of proxy[%s]", ctx.Proxy)
+	}
+	if util.IsEmptyStr(u.Hostname()) {
+		return fmt.Errorf("no host in proxy[%s]", ctx.Proxy)
+	}
+	return nil
+}
+
+func checkTLS(ctx *Context) error {
+	_, err := ctx.SourceTLSConfig()
+	return err
+}
+
+// SourceTLSConfig returns the tls config of the requests to source with the
+// client certificate and the CA bundle, and the certificate of source isn't
+// verified if Insecure is set. It's nil if none of them is set.
+func (ctx *Context) SourceTLSConfig() (*tls.Config, error) {
+	if util.IsEmptyStr(ctx.ClientCert) && util.IsEmptyStr(ctx.ClientKey) &&
+		util.IsEmptyStr(ctx.CACert) && !ctx.Insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: ctx.Insecure}
+	if !util.IsEmptyStr(ctx.ClientCert) || !util.IsEmptyStr(ctx.ClientKey) {
+		if util.IsEmptyStr(ctx.ClientCert) || util.IsEmptyStr(ctx.ClientKey) {
+			return nil, fmt.Errorf("client cert and key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(ctx.ClientCert, ctx.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert[%s] and key[%s] error: %v",
+				ctx.ClientCert, ctx.ClientKey, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if !util.IsEmptyStr(ctx.CACert) {
+		pem, err := ioutil.ReadFile(ctx.CACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in ca cert[%s]", ctx.CACert)
+		}
+	}
+	return config, nil
+}
+
+// checkMaxSize verifies the max size of the downloaded file,
+// 0 represents that don't limit the size.
+func checkMaxSize(ctx *Context) error {
+	if ctx.MaxSize < 0 {
+		return fmt.Errorf("%d", ctx.MaxSize)
+	}
+	return nil
+}
+
+// checkPieceSize verifies that the piece size is a power of 2 between
+// MinPieceSize and MaxPieceSize, 0 represents the default of supernode.
+func checkPieceSize(ctx *Context) error {
+	if ctx.PieceSize == 0 {
+		return nil
+	}
+	if ctx.PieceSize < MinPieceSize || ctx.PieceSize > MaxPieceSize {
+		return fmt.Errorf("%d is out of range[%d, %d]", ctx.PieceSize, MinPieceSize, MaxPieceSize)
+	}
+	if ctx.PieceSize&(ctx.PieceSize-1) != 0 {
+		return fmt.Errorf("%d is not a power of 2", ctx.PieceSize)
+	}
+	return nil
+}
+
+// checkUploadLimit verifies the rate limit of serving pieces to other peers,
+// 0 represents that don't limit the rate.
+func checkUploadLimit(ctx *Context) error {
+	if ctx.UploadLimit < 0 {
+		return fmt.Errorf("%d", ctx.UploadLimit)
+	}
+	return nil
+}
+
+// checkPeerStats rejects PeerStats, because no piece is fetched from peers
+// until P2PDownloader is ported, and the stats would always be empty.
+func checkPeerStats(ctx *Context) error {
+	if ctx.PeerStats {
+		return fmt.Errorf("peer stats can't be collected since p2p downloading is not supported yet")
+	}
+	return nil
+}
+
+// checkLimitSchedule verifies the periods of the day and the rate limits of
+// them.
+func checkLimitSchedule(ctx *Context) error {
+	for _, entry := range ctx.LimitSchedule {
+		if _, err := ParseLimitPeriod(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LimitPeriod is a period of the day during which the rate of downloading
+// is limited by Rate instead of LocalLimit.
+type LimitPeriod struct {
+	// Start and End are the offsets since midnight, and the period spans
+	// midnight if End is before Start.
+	Start time.Duration
+	End   time.Duration
+	// Rate is bytes per second, 0 represents that don't limit the rate.
+	Rate int
+}
+
+// Contains reports whether the wall-clock time of t is in the period.
+func (lp *LimitPeriod) Contains(t time.Time) bool {
+	y, m, d := t.Date()
+	offset := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if lp.Start < lp.End {
+		return offset >= lp.Start && offset < lp.End
+	}
+	return offset >= lp.Start || offset < lp.End
+}
+
+// ParseLimitPeriod parses the rate limit of a period of the day in the format
+// of 'hh:mm-hh:mm=rate', eg: '09:00-18:00=2M', and the period spans midnight
+// if the end is before the start.
+func ParseLimitPeriod(entry string) (*LimitPeriod, error) {
+	idx := strings.LastIndexByte(entry, '=')
+	if idx < 0 {
+		return nil, fmt.Errorf("%s is not in the format of 'hh:mm-hh:mm=rate'", entry)
+	}
+	times := strings.Split(entry[:idx], "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("invalid period of %s", entry)
+	}
+	start, err := parseClock(times[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid start of %s: %v", entry, err)
+	}
+	end, err := parseClock(times[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid end of %s: %v", entry, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("empty period of %s", entry)
+	}
+	rate, err := ParseLimit(entry[idx+1:])
+	if err != nil || rate < 0 {
+		return nil, fmt.Errorf("invalid rate of %s", entry)
+	}
+	return &LimitPeriod{Start: start, End: end, Rate: rate}, nil
+}
+
+// parseClock parses the time of the day in the format of 'hh:mm', and
+// '24:00' is the end of the day.
+func parseClock(s string) (time.Duration, error) {
+	hm := strings.Split(strings.TrimSpace(s), ":")
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("%s is not in the format of 'hh:mm'", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid hour of %s", s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid minute of %s", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// ParseLimit parses the rate limit or size in the format of 20M/m/K/k/G/g,
+// and an empty one is 0.
+func ParseLimit(limit string) (int, error) {
+	if util.IsEmptyStr(limit) {
+		return 0, nil
+	}
+	l := len(limit)
+	i, err := strconv.Atoi(limit[:l-1])
+
+	if err != nil {
+		return 0, err
+	}
+
+	unit := limit[l-1]
+	if unit == 'k' || unit == 'K' {
+		return i * 1024, nil
+	}
+	if unit == 'm' || unit == 'M' {
+		return i * 1024 * 1024, nil
+	}
+	if unit == 'g' || unit == 'G' {
+		return i * 1024 * 1024 * 1024, nil
+	}
+	return 0, fmt.Errorf("invalid unit '%c' of '%s', 'KkMmGg' are supported",
+		unit, limit)
+}
+
+// LimitAt returns the rate limit of downloading in effect at t, which is the
+// one of the first period in LimitSchedule containing t, or LocalLimit if
+// none of them does.
+func (ctx *Context) LimitAt(t time.Time) int {
+	for _, entry := range ctx.LimitSchedule {
+		if lp, err := ParseLimitPeriod(entry); err == nil && lp.Contains(t) {
+			return lp.Rate
+		}
+	}
+	return ctx.LocalLimit
+}
+
+// checkRange verifies the byte range of the source to download, and it
+// conflicts with resume because the target holds the slice only.
+func checkRange(ctx *Context) error {
+	if ctx.RangeStart < 0 {
+		return fmt.Errorf("range start[%d] must not be negative", ctx.RangeStart)
+	}
+	if ctx.RangeEnd < ctx.RangeStart {
+		return fmt.Errorf("range end[%d] is less than range start[%d]", ctx.RangeEnd, ctx.RangeStart)
+	}
+	if ctx.HasRange() && ctx.Resume {
+		return fmt.Errorf("range conflicts with resume")
+	}
+	return nil
+}
+
+// HasRange reports whether only the bytes from RangeStart to RangeEnd, both
+// inclusive, of the source are downloaded, it's disabled if RangeEnd is 0
+// unless the range is set by SetRange.
+func (ctx *Context) HasRange() bool {
+	return ctx.hasRange || ctx.RangeEnd > 0
+}
+
+// SetRange sets the range to download from start to end, both inclusive, so
+// that the range of the first byte, '0-0', is downloaded as well.
+func (ctx *Context) SetRange(start, end int64) {
+	ctx.RangeStart, ctx.RangeEnd, ctx.hasRange = start, end, true
+}
+
+// checkHeader verifies that each header is in the format of 'key:value'.
+func checkHeader(ctx *Context) error {
+	for _, header := range ctx.Header {
+		idx := strings.IndexByte(header, ':')
+		if idx < 0 || util.IsEmptyStr(strings.TrimSpace(header[:idx])) {
+			return errors.New(header)
+		}
+	}
+	return nil
+}
+
+// checkUserAgent verifies that the user agent can't inject other headers
+// into the requests to source.
+func checkUserAgent(ctx *Context) error {
+	if strings.ContainsAny(ctx.UserAgent, "\r\n") {
+		return fmt.Errorf("%q contains CR or LF", ctx.UserAgent)
+	}
+	return nil
+}
+
+// defaultBackSourceStatusAllow are the status codes allowed if
+// BackSourceStatusAllow is empty.
+var defaultBackSourceStatusAllow = []int{200, 206}
+
+// checkBackSourceStatusAllow verifies that the allowed status codes are
+// between 100 and 599.
+func checkBackSourceStatusAllow(ctx *Context) error {
+	for _, code := range ctx.BackSourceStatusAllow {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("status code[%d] is out of range[100, 599]", code)
+		}
+	}
+	return nil
+}
+
+// BackSourceStatusAllowed reports whether the response of the status code
+// from source is allowed to be downloaded.
+func (ctx *Context) BackSourceStatusAllowed(code int) bool {
+	allow := ctx.BackSourceStatusAllow
+	if len(allow) == 0 {
+		allow = defaultBackSourceStatusAllow
+	}
+	for _, c := range allow {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// checkS3 verifies that S3Endpoint is a http(s) url without credentials, and
+// S3Region is defaulted if it's empty.
+func checkS3(ctx *Context) error {
+	if util.IsEmptyStr(ctx.S3Endpoint) {
+		return nil
+	}
+	u, err := url.Parse(ctx.S3Endpoint)
+	if err != nil || (u.Scheme != SchemaHTTP && u.Scheme != SchemaHTTPS) || util.IsEmptyStr(u.Host) {
+		return fmt.Errorf("endpoint[%s] is not http(s) url", redactPassword(ctx.S3Endpoint))
+	}
+	if u.User != nil {
+		return fmt.Errorf("endpoint[%s] can't carry credentials, set them by environment variables",
+			redactPassword(ctx.S3Endpoint))
+	}
+	if util.IsEmptyStr(ctx.S3Region) {
+		ctx.S3Region = DefaultS3Region
+	}
+	return nil
+}
+
+// checkNodes verifies the addresses and weights of supernodes, and an empty
+// node list is valid because the nodes in config file will be used.
+func checkNodes(ctx *Context) error {
+	for _, node := range ctx.Node {
+		if _, _, err := ParseNode(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseNode parses the supernode in the format of 'host[:port][=weight]',
+// the port is 8002 and the weight is 1 if they're omitted.
+func ParseNode(node string) (addr string, weight int, err error) {
+	addr, weight = node, DefaultNodeWeight
+	if idx := strings.LastIndexByte(node, '='); idx >= 0 {
+		addr = node[:idx]
+		if weight, err = strconv.Atoi(node[idx+1:]); err != nil || weight <= 0 {
+			return "", 0, fmt.Errorf("invalid weight of node[%s]", node)
+		}
+	}
+	if util.IsEmptyStr(addr) {
+		return "", 0, fmt.Errorf("empty address of node[%s]", node)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// the port is omitted, and brackets are only stripped in pairs
+		host, port = addr, strconv.Itoa(DefaultSupernodePort)
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+	}
+	if util.IsEmptyStr(host) || strings.ContainsAny(host, "[]/ ") ||
+		(strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+		return "", 0, fmt.Errorf("invalid host of node[%s]", node)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return "", 0, fmt.Errorf("invalid port of node[%s]", node)
+	}
+	return net.JoinHostPort(host, port), weight, nil
+}
+
+func checkRetry(ctx *Context) error {
+	if ctx.MaxRetries < 0 {
+		return fmt.Errorf("max retries[%d] must not be negative", ctx.MaxRetries)
+	}
+	if ctx.RetryInterval < 0 {
+		return fmt.Errorf("retry interval[%v] must not be negative", ctx.RetryInterval)
+	}
+	return nil
+}
+
+// checkNodeBreaker verifies that the threshold isn't negative, and the
+// cooldown is positive unless the breaker is disabled.
+func checkNodeBreaker(ctx *Context) error {
+	if ctx.NodeFailureThreshold < 0 {
+		return fmt.Errorf("node failure threshold[%d] must not be negative", ctx.NodeFailureThreshold)
+	}
+	if ctx.NodeFailureThreshold > 0 && ctx.NodeCooldown <= 0 {
+		return fmt.Errorf("node cooldown[%v] must be positive", ctx.NodeCooldown)
+	}
+	return nil
+}
+
+func checkConcurrency(ctx *Context) error {
+	if ctx.Concurrency < 1 {
+		return fmt.Errorf("concurrency[%d] must be at least 1", ctx.Concurrency)
+	}
+	return nil
+}
+
+func checkMaxConnsPerHost(ctx *Context) error {
+	if ctx.MaxConnsPerHost < 0 {
+		return fmt.Errorf("max conns per host[%d] must not be negative", ctx.MaxConnsPerHost)
+	}
+	return nil
+}
+
+func checkIdleConnTimeout(ctx *Context) error {
+	if ctx.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle conn timeout[%v] must not be negative", ctx.IdleConnTimeout)
+	}
+	return nil
+}
+
+func checkMaxRedirects(ctx *Context) error {
+	if ctx.MaxRedirects < 0 {
+		return fmt.Errorf("max redirects[%d] must not be negative", ctx.MaxRedirects)
+	}
+	return nil
+}
+
+// checkTimeout verifies the deadline of the whole download, and 0 means
+// no deadline.
+func checkTimeout(ctx *Context) error {
+	if ctx.Timeout < 0 {
+		return fmt.Errorf("timeout[%v] must not be negative", ctx.Timeout)
+	}
+	return nil
+}
+
+// checkIdleTimeout verifies how long the download waits for the bytes from
+// source before it's canceled, and 0 means waiting forever.
+func checkIdleTimeout(ctx *Context) error {
+	if ctx.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout[%v] must not be negative", ctx.IdleTimeout)
+	}
+	return nil
+}
+
+// checkFileMode verifies that the file mode only contains the permission
+// bits.
+func checkFileMode(ctx *Context) error {
+	if ctx.FileMode&^os.ModePerm != 0 {
+		return fmt.Errorf("file mode[%#o] has bits outside 0777", uint32(ctx.FileMode))
+	}
+	return nil
+}
+
+// checkOutputOwner verifies that the owner of the output resolves and can be
+// changed, and it must be called after checkOutput.
+func checkOutputOwner(ctx *Context) error {
+	if util.IsEmptyStr(ctx.OutputUID) && util.IsEmptyStr(ctx.OutputGID) {
+		return nil
+	}
+	if _, _, err := ctx.OutputOwner(); err != nil {
+		return err
+	}
+	if euid := geteuid(); euid != 0 {
+		return fmt.Errorf("changing the owner of output requires root, but the user[%s] is uid:%d",
+			ctx.User, euid)
+	}
+	if len(ctx.URLs) == 0 && util.IsEmptyStr(ctx.Manifest) && ctx.StreamsOutput() {
+		return fmt.Errorf("output[%s] is streamed and its owner can't be changed", ctx.Output)
+	}
+	return nil
+}
+
+// OutputOwner resolves OutputUID and OutputGID to the numeric ids, and the
+// empty one is resolved to -1 which keeps the owner as is.
+func (ctx *Context) OutputOwner() (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if !util.IsEmptyStr(ctx.OutputUID) {
+		id := ctx.OutputUID
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(id)
+			if err != nil {
+				return -1, -1, fmt.Errorf("lookup user[%s] error: %v", id, err)
+			}
+			id = u.Uid
+		}
+		if uid, err = parseOwnerID(id); err != nil {
+			return -1, -1, fmt.Errorf("invalid uid[%s]", ctx.OutputUID)
+		}
+	}
+	if !util.IsEmptyStr(ctx.OutputGID) {
+		id := ctx.OutputGID
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(id)
+			if err != nil {
+				return -1, -1, fmt.Errorf("lookup group[%s] error: %v", id, err)
+			}
+			id = g.Gid
+		}
+		if gid, err = parseOwnerID(id); err != nil {
+			return -1, -1, fmt.Errorf("invalid gid[%s]", ctx.OutputGID)
+		}
+	}
+	return uid, gid, nil
+}
+
+func parseOwnerID(id string) (int, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 {
+		return -1, fmt.Errorf("invalid id[%s]", id)
+	}
+	return n, nil
+}
+
+// ParseFileMode parses the file mode in octal such as '0755' or '644'.
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode[%s]", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// checkWorkHome creates the work home where the logs and the data of dfget
+// are placed if it doesn't exist, and verifies that it's writable. The
+// environment variables in it are expanded as the ones in output.
+func checkWorkHome(ctx *Context) error {
+	ctx.WorkHome = os.ExpandEnv(ctx.WorkHome)
+	if util.IsEmptyStr(ctx.WorkHome) {
+		return errors.New("work home is empty")
+	}
+	return util.EnsureWritableDir(ctx.WorkHome)
+}
+
+// checkPreheat sets the output of preheating to the file in WorkHome, which
+// is unique to the url and the process, and CacheDir must be set since it's
+// the only place the file is kept. It must be called after checkWorkHome.
+func checkPreheat(ctx *Context) error {
+	if !ctx.Preheat {
+		return nil
+	}
+	if !util.IsEmptyStr(ctx.Manifest) {
+		return fmt.Errorf("manifest can't be preheated")
+	}
+	if ctx.VerifyOnly {
+		return fmt.Errorf("preheat conflicts with verify only")
+	}
+	if ctx.HasRange() {
+		return fmt.Errorf("range can't be preheated since it isn't cached")
+	}
+	if ctx.WriteChecksumSidecar {
+		return fmt.Errorf("checksum sidecar can't be written without output")
+	}
+	if util.IsEmptyStr(ctx.CacheDir) {
+		return fmt.Errorf("cache dir is required to keep the preheated file")
+	}
+	// the urls are preheated by the copies of SplitURLs
+	if len(ctx.URLs) > 0 {
+		return nil
+	}
+	dir := filepath.Join(ctx.WorkHome, "preheat")
+	output := filepath.Join(dir, fmt.Sprintf("%s-%x", ctx.Sign, sha1.Sum([]byte(ctx.URL))))
+	if !util.IsEmptyStr(ctx.Output) && ctx.Output != output {
+		return fmt.Errorf("output[%s] conflicts with preheat", ctx.Output)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create preheat directory[%s] error: %v", dir, err)
+	}
+	ctx.Output = output
+	return nil
+}
+
+// checkCacheDir creates the cache dir if it doesn't exist, and verifies that
+// it's writable.
+func checkCacheDir(ctx *Context) error {
+	if util.IsEmptyStr(ctx.CacheDir) {
+		return nil
+	}
+	return util.EnsureWritableDir(ctx.CacheDir)
+}
+
+func checkPostHook(ctx *Context) error {
+	_, err := ctx.PostHookCommand()
+	return err
+}
+
+// PostHookCommand renders the PostHook template into the shell command run
+// after the download succeeds, and the placeholders {{.Output}} and {{.URL}}
+// are replaced with the shell-quoted values. It's empty if PostHook is empty.
+func (ctx *Context) PostHookCommand() (string, error) {
+	if util.IsEmptyStr(ctx.PostHook) {
+		return "", nil
+	}
+	tmpl, err := template.New("postHook").Option("missingkey=error").Parse(ctx.PostHook)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, struct{ Output, URL string }{
+		Output: shellQuote(ctx.Output),
+		URL:    shellQuote(ctx.URL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// shellQuote quotes s with single quotes so that it's a single word of shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// checkLabels verifies that the keys of labels aren't empty, and neither the
+// keys nor the values contain CR or LF.
+func checkLabels(ctx *Context) error {
+	for k, v := range ctx.Labels {
+		if util.IsEmptyStr(k) {
+			return fmt.Errorf("empty key of label[%s]", v)
+		}
+		if strings.ContainsAny(k, "\r\n") || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("label[%q=%q] contains CR or LF", k, v)
+		}
+	}
+	return nil
+}
+
+// checkQuiet verifies that the quiet mode isn't asked for being verbose at
+// the same time.
+func checkQuiet(ctx *Context) error {
+	if ctx.Quiet && ctx.Verbose {
+		return fmt.Errorf("quiet conflicts with verbose")
+	}
 	return nil
 }
@@ -0,0 +1,161 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// unloadableKeys are the fields of Context generated at runtime which
+// can't be loaded from config file, and signOverride is excluded because the
+// logs are created with Sign before it's overridden.
+var unloadableKeys = map[string]bool{
+	"startTime":    true,
+	"sign":         true,
+	"signOverride": true,
+	"user":         true,
+	"yamlConfig":   true,
+}
+
+// LoadFile loads the yaml config file into ctx, the keys of it are the json
+// names of the Context fields such as 'node', 'localLimit' and 'workHome'.
+// The sizes are in bytes, the durations are like '10s' or '1m' and the file
+// mode is in octal like '0755'.
+// It returns the keys not matching any field so that the caller can warn.
+func (ctx *Context) LoadFile(path string) (unknown []string, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values, err := util.ParseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file[%s] error: %v", path, err)
+	}
+
+	fields := loadableFields(ctx)
+	for key, value := range values {
+		field, ok := fields[strings.ToLower(key)]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return nil, fmt.Errorf("invalid %s in config file[%s]: %v", key, path, err)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// loadableFields returns the fields of ctx indexed by the lower case of
+// their json names.
+func loadableFields(ctx *Context) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(ctx).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || unloadableKeys[name] {
+			continue
+		}
+		fields[strings.ToLower(name)] = v.Field(i)
+	}
+	return fields
+}
+
+// setField sets the value which is a string or []string parsed from yaml
+// to the field, and an empty list means null so it's ignored.
+func setField(field reflect.Value, value interface{}) error {
+	if list, ok := value.([]string); ok {
+		if field.Kind() == reflect.Slice {
+			return setList(field, list)
+		}
+		if len(list) == 0 {
+			return nil
+		}
+		return fmt.Errorf("list %v is not allowed", list)
+	}
+
+	s := value.(string)
+	if _, ok := field.Interface().(time.Duration); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	if _, ok := field.Interface().(os.FileMode); ok {
+		mode, err := ParseFileMode(s)
+		if err != nil {
+			return err
+		}
+		field.SetUint(uint64(mode))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case reflect.Slice:
+		return setList(field, []string{s})
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// setList sets the list to the field which is []string or []int, and each
+// item of []int is parsed in decimal.
+func setList(field reflect.Value, list []string) error {
+	switch field.Type().Elem().Kind() {
+	case reflect.String:
+		field.Set(reflect.ValueOf(list))
+	case reflect.Int:
+		ints := make([]int, len(list))
+		for i, s := range list {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			ints[i] = n
+		}
+		field.Set(reflect.ValueOf(ints))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
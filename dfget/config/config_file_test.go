@@ -0,0 +1,90 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/go-check/check"
+)
+
+func (suite *ConfigSuite) TestContext_LoadFile(c *check.C) {
+	f, err := ioutil.TempFile("/tmp", "dfget_config")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString(`
+node:
+  - 127.0.0.1:8002=2
+  - 127.0.0.2
+localLimit: 10485760
+maxSize: 1024
+pattern: cdn
+workHome: /tmp/dfget
+header: a:1
+notbs: true
+timeout: 1m
+fileMode: 0755
+backSourceStatusAllow: [200, 206]
+sign: x
+signOverride: y
+unknown: 1
+`)
+	f.Close()
+
+	sign := Ctx.Sign
+	unknown, err := Ctx.LoadFile(f.Name())
+	c.Assert(err, check.IsNil)
+	c.Assert(unknown, check.DeepEquals, []string{"sign", "signOverride", "unknown"})
+	c.Assert(Ctx.Node, check.DeepEquals, []string{"127.0.0.1:8002=2", "127.0.0.2"})
+	c.Assert(Ctx.LocalLimit, check.Equals, 10485760)
+	c.Assert(Ctx.MaxSize, check.Equals, int64(1024))
+	c.Assert(Ctx.Pattern, check.Equals, PatternCDN)
+	c.Assert(Ctx.WorkHome, check.Equals, "/tmp/dfget")
+	c.Assert(Ctx.Header, check.DeepEquals, []string{"a:1"})
+	c.Assert(Ctx.Notbs, check.Equals, true)
+	c.Assert(Ctx.Timeout, check.Equals, time.Minute)
+	c.Assert(Ctx.FileMode, check.Equals, os.FileMode(0755))
+	c.Assert(Ctx.BackSourceStatusAllow, check.DeepEquals, []int{200, 206})
+	c.Assert(Ctx.Sign, check.Equals, sign)
+
+	// the single item of the int list
+	ioutil.WriteFile(f.Name(), []byte("backSourceStatusAllow: 203"), 0644)
+	_, err = Ctx.LoadFile(f.Name())
+	c.Assert(err, check.IsNil)
+	c.Assert(Ctx.BackSourceStatusAllow, check.DeepEquals, []int{203})
+
+	var invalid = []string{
+		"localLimit: 10M",
+		"notbs: yes!",
+		"timeout: 10",
+		"fileMode: 0x644",
+		"pattern: [a, b]",
+		"node:\n  a: b",
+		"backSourceStatusAllow: [200, ok]",
+		"backSourceStatusAllow: ok",
+	}
+	for _, v := range invalid {
+		ioutil.WriteFile(f.Name(), []byte(v), 0644)
+		_, err := Ctx.LoadFile(f.Name())
+		c.Assert(err, check.NotNil, check.Commentf("config:%q", v))
+	}
+
+	_, err = Ctx.LoadFile(f.Name() + ".notexist")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
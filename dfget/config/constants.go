@@ -16,6 +16,8 @@
 
 package config
 
+import "time"
+
 /* the response code from supernode */
 const (
 	// HTTPSuccess represents the http request is success.
@@ -46,22 +48,98 @@ const (
 
 /* the reason of backing to source */
 const (
-	BackSourceReasonNone          = 0
-	BackSourceReasonRegisterFail  = 1
-	BackSourceReasonMd5NotMatch   = 2
+	// BackSourceReasonNone means the file is not downloaded from source
+	// because of p2p failure, such as the 'source' pattern.
+	BackSourceReasonNone = 0
+	// BackSourceReasonRegisterFail means registering to all supernodes fails.
+	BackSourceReasonRegisterFail = 1
+	// BackSourceReasonMd5NotMatch means the md5 of the file downloaded by
+	// p2p doesn't match the expected one.
+	BackSourceReasonMd5NotMatch = 2
+	// BackSourceReasonDownloadError means downloading pieces from peers or
+	// supernode fails.
 	BackSourceReasonDownloadError = 3
-	BackSourceReasonNoSpace       = 4
-	BackSourceReasonInitError     = 5
-	BackSourceReasonWriteError    = 6
-	BackSourceReasonHostSysError  = 7
-	ForceNotBackSourceAddition    = 1000
+	// BackSourceReasonNoSpace means there is no enough space for p2p.
+	BackSourceReasonNoSpace = 4
+	// BackSourceReasonInitError means initializing the p2p downloading fails.
+	BackSourceReasonInitError = 5
+	// BackSourceReasonWriteError means writing the pieces to file fails.
+	BackSourceReasonWriteError = 6
+	// BackSourceReasonHostSysError means the system of the host fails to p2p.
+	BackSourceReasonHostSysError = 7
+	// ForceNotBackSourceAddition is added to the reason when backing to
+	// source is disabled by '--notbs', and the download fails instead.
+	ForceNotBackSourceAddition = 1000
+)
+
+/* download pattern */
+const (
+	PatternP2P    = "p2p"
+	PatternCDN    = "cdn"
+	PatternSource = "source"
+)
+
+/* digest algorithm */
+const (
+	DigestMD5    = "md5"
+	DigestSHA1   = "sha1"
+	DigestSHA256 = "sha256"
 )
 
 /* others */
 const (
 	DefaultConfigFile      = "/etc/dragonfly.conf"
+	DefaultYAMLConfig      = "/etc/dragonfly/dfget.yml"
 	DefaultTimestampFormat = "2006-01-02 15:04:05"
+	StdoutOutput           = "-"
+	// UnixSocketOutputPrefix prefixes the path of the unix socket which the
+	// output is streamed to, eg: 'unix:/run/sidecar.sock'.
+	UnixSocketOutputPrefix = "unix:"
 	SchemaHTTP             = "http"
+	SchemaHTTPS            = "https"
+	SchemaFTP              = "ftp"
+	SchemaFTPS             = "ftps"
+	SchemaS3               = "s3"
+	DefaultS3Region        = "us-east-1"
+	DockerConfigEnv        = "DOCKER_CONFIG"
+	DockerConfigFileName   = "config.json"
+
+	DefaultSupernodePort = 8002
+	DefaultNodeWeight    = 1
+	DefaultMaxRetries    = 2
+	DefaultRetryInterval = 2 * time.Second
+	DefaultConcurrency   = 6
+
+	// DefaultIdleConnTimeout is how long an idle connection to source is
+	// kept alive, which is the same as http.DefaultTransport.
+	DefaultIdleConnTimeout = 90 * time.Second
+
+	// DefaultMaxRedirects is the number of the redirects followed by the
+	// requests to source, which is the same as http.Client.
+	DefaultMaxRedirects = 10
+
+	// DefaultNodeFailureThreshold and DefaultNodeCooldown configure the
+	// breaker of the supernodes.
+	DefaultNodeFailureThreshold = 3
+	DefaultNodeCooldown         = 30 * time.Second
+
+	// MinPieceSize and MaxPieceSize bound the piece size asked for by dfget.
+	MinPieceSize = 256 * 1024
+	MaxPieceSize = 64 * 1024 * 1024
+
+	// DataDirName is the directory in the work home where the task files
+	// shared with other peers are placed, and the files of a task are in
+	// use while its lock file with LockFileSuffix holds the pid of a running
+	// dfget.
+	DataDirName    = "data"
+	LockFileSuffix = ".lock"
+	// TempFileSuffix is appended to the output to name the file being
+	// downloaded if the download is atomic.
+	TempFileSuffix        = ".dfget.tmp"
+	DefaultCleanOlderThan = 24 * time.Hour
+
+	// CompressedOutputSuffix is appended to the output if it's compressed.
+	CompressedOutputSuffix = ".gz"
 
 	ServerPortLowerLimit = 15000
 	ServerPortUpperLimit = 65000
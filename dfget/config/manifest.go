@@ -0,0 +1,144 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// ManifestEntry is a file to download listed in the manifest.
+type ManifestEntry struct {
+	// Path is where the file is written, and it's relative to the output
+	// directory unless it's absolute, which requires TrustManifest.
+	Path string
+	Md5  string
+	URL  string
+}
+
+// ParseManifest parses the manifest whose lines are in the format of
+// 'path  md5  url', and the blank lines and the ones starting with '#' are
+// ignored. The paths of the entries must be distinct.
+func ParseManifest(path string) ([]*ManifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		entries []*ManifestEntry
+		paths   = make(map[string]int)
+		scanner = bufio.NewScanner(f)
+	)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if util.IsEmptyStr(line) || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d of %s is not in the format of 'path md5 url'", n, path)
+		}
+		entry := &ManifestEntry{Path: filepath.Clean(fields[0]), Md5: fields[1], URL: fields[2]}
+		if !md5Reg.MatchString(entry.Md5) {
+			return nil, fmt.Errorf("line %d of %s: invalid md5 %s", n, path, entry.Md5)
+		}
+		if err := validateURL(entry.URL); err != nil {
+			return nil, fmt.Errorf("line %d of %s: invalid url %v", n, path, err)
+		}
+		if prev, ok := paths[entry.Path]; ok {
+			return nil, fmt.Errorf("line %d of %s: path %s is the same as line %d", n, path, entry.Path, prev)
+		}
+		paths[entry.Path] = n
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no entry in %s", path)
+	}
+	return entries, nil
+}
+
+// checkManifest verifies all the entries of the manifest before downloading
+// any of them, and the url, md5 and digest of ctx conflict with it because
+// they're given by the entries.
+func checkManifest(ctx *Context) error {
+	if util.IsEmptyStr(ctx.Manifest) {
+		return nil
+	}
+	if !util.IsEmptyStr(ctx.URL) || len(ctx.URLs) > 0 {
+		return fmt.Errorf("manifest conflicts with url and urls")
+	}
+	if !util.IsEmptyStr(ctx.ExpectedDigest()) {
+		return fmt.Errorf("md5 and digest are given by the entries of manifest")
+	}
+	if !util.IsEmptyStr(ctx.TaskID) {
+		return fmt.Errorf("task id conflicts with manifest")
+	}
+	_, err := ctx.manifestEntries()
+	return err
+}
+
+// manifestEntries parses the Manifest, and the paths of its entries must be
+// in the directory of Output unless TrustManifest is set.
+func (ctx *Context) manifestEntries() ([]*ManifestEntry, error) {
+	entries, err := ParseManifest(ctx.Manifest)
+	if err != nil || ctx.TrustManifest {
+		return entries, err
+	}
+	for _, entry := range entries {
+		if filepath.IsAbs(entry.Path) || entry.Path == ".." ||
+			strings.HasPrefix(entry.Path, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("path %s of %s is out of the output directory, "+
+				"it requires trusting the manifest", entry.Path, ctx.Manifest)
+		}
+	}
+	return entries, nil
+}
+
+// SplitManifest returns a copy of ctx for each entry of the Manifest, whose
+// Output is the path of the entry in the directory of ctx.Output, and each
+// copy is validated.
+func (ctx *Context) SplitManifest() ([]*Context, error) {
+	entries, err := ctx.manifestEntries()
+	if err != nil {
+		return nil, err
+	}
+	ctxs := make([]*Context, 0, len(entries))
+	for i, entry := range entries {
+		c := ctx.Clone()
+		c.URL, c.Md5, c.Manifest = entry.URL, entry.Md5, ""
+		c.RequestID = ctx.splitRequestID(i)
+		c.Output = entry.Path
+		if !filepath.IsAbs(entry.Path) {
+			c.Output = filepath.Join(ctx.Output, entry.Path)
+		}
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("path[%s] %v", entry.Path, err)
+		}
+		ctxs = append(ctxs, c)
+	}
+	return ctxs, nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-check/check"
+)
+
+const testManifestMd5 = "7fc8baba8e7696d6c3b286f738245592"
+
+func writeManifest(c *check.C, dir, content string) string {
+	path := filepath.Join(dir, "manifest")
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+	return path
+}
+
+func (suite *ConfigSuite) TestParseManifest(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_manifest")
+	defer os.RemoveAll(tmpDir)
+
+	path := writeManifest(c, tmpDir, "# release files\n\n"+
+		"bin/dfget  "+testManifestMd5+"  http://a.b/dfget\n"+
+		"\t/tmp/c "+testManifestMd5+" http://a.b/c?x=1  \n")
+	entries, err := ParseManifest(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.DeepEquals, []*ManifestEntry{
+		{Path: "bin/dfget", Md5: testManifestMd5, URL: "http://a.b/dfget"},
+		{Path: "/tmp/c", Md5: testManifestMd5, URL: "http://a.b/c?x=1"},
+	})
+
+	var cases = map[string]string{
+		"":                                     "no entry.*",
+		"# comment\n":                          "no entry.*",
+		"a " + testManifestMd5 + "\n":          "line 1 .*not in the format.*",
+		"a 123 http://a.b/c\n":                 "line 1 .*invalid md5 123",
+		"# x\na " + testManifestMd5 + " abc\n": "line 2 .*invalid url abc",
+		"a " + testManifestMd5 + " http://a.b/c\n./a " + testManifestMd5 + " http://a.b/d\n": "line 2 .*path a is the same as line 1",
+	}
+	for k, v := range cases {
+		_, err := ParseManifest(writeManifest(c, tmpDir, k))
+		c.Assert(err, check.ErrorMatches, v, check.Commentf("manifest:%q", k))
+	}
+	_, err = ParseManifest(filepath.Join(tmpDir, "notexist"))
+	c.Assert(err, check.NotNil)
+}
+
+func (suite *ConfigSuite) TestCheckManifest(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_manifest")
+	defer os.RemoveAll(tmpDir)
+	c.Assert(checkManifest(Ctx), check.IsNil)
+
+	Ctx.Manifest = writeManifest(c, tmpDir, "a "+testManifestMd5+" http://a.b/c\n")
+	c.Assert(checkManifest(Ctx), check.IsNil)
+	c.Assert(checkURL(Ctx), check.IsNil)
+
+	Ctx.URL = "http://a.b/c"
+	c.Assert(checkManifest(Ctx), check.NotNil)
+	Ctx.URL, Ctx.Md5 = "", testManifestMd5
+	c.Assert(checkManifest(Ctx), check.NotNil)
+	Ctx.Md5, Ctx.TaskID = "", "0123456789abcdef"
+	c.Assert(checkManifest(Ctx), check.NotNil)
+
+	// the malformed manifest fails before any download
+	Ctx.TaskID = ""
+	Ctx.Manifest = writeManifest(c, tmpDir, "a "+testManifestMd5+" http://a.b/c\nb\n")
+	c.Assert(checkManifest(Ctx), check.NotNil)
+
+	// the paths out of the output directory require trusting the manifest
+	for _, p := range []string{"/etc/a", "..", "../a", "a/../../b"} {
+		Ctx.Manifest, Ctx.TrustManifest = writeManifest(c, tmpDir, p+" "+testManifestMd5+" http://a.b/c\n"), false
+		c.Assert(checkManifest(Ctx), check.ErrorMatches, ".*out of the output directory.*", check.Commentf("%s", p))
+		Ctx.TrustManifest = true
+		c.Assert(checkManifest(Ctx), check.IsNil, check.Commentf("%s", p))
+	}
+	Ctx.Manifest, Ctx.TrustManifest = writeManifest(c, tmpDir, "a/../b/..c "+testManifestMd5+" http://a.b/c\n"), false
+	c.Assert(checkManifest(Ctx), check.IsNil)
+}
+
+func (suite *ConfigSuite) TestContext_SplitManifest(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_manifest")
+	defer os.RemoveAll(tmpDir)
+	Ctx.ClientLogger = logrus.StandardLogger()
+	Ctx.ServerLogger = logrus.StandardLogger()
+	Ctx.Manifest = writeManifest(c, tmpDir, "bin/c "+testManifestMd5+" http://a.b/c\n"+
+		filepath.Join(tmpDir, "d")+" "+testManifestMd5+" http://a.b/d\n")
+	Ctx.Output = tmpDir
+	Ctx.MkdirParents = true
+	c.Assert(Ctx.Validate(), check.NotNil)
+	Ctx.TrustManifest = true
+	c.Assert(Ctx.Validate(), check.IsNil)
+
+	ctxs, err := Ctx.SplitManifest()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(ctxs), check.Equals, 2)
+	for i, v := range []struct{ url, output string }{
+		{"http://a.b/c", filepath.Join(tmpDir, "bin", "c")},
+		{"http://a.b/d", filepath.Join(tmpDir, "d")},
+	} {
+		c.Assert(ctxs[i].URL, check.Equals, v.url)
+		c.Assert(ctxs[i].Output, check.Equals, v.output)
+		c.Assert(ctxs[i].Md5, check.Equals, testManifestMd5)
+		c.Assert(ctxs[i].Manifest, check.Equals, "")
+	}
+	c.Assert(isDir(filepath.Join(tmpDir, "bin")), check.Equals, true)
+}
+
+func (suite *ConfigSuite) TestContext_SplitManifestRedacted(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_manifest")
+	defer os.RemoveAll(tmpDir)
+	Ctx.ClientLogger = logrus.StandardLogger()
+	Ctx.ServerLogger = logrus.StandardLogger()
+	Ctx.Manifest = writeManifest(c, tmpDir, "c "+testManifestMd5+" http://a.b/c?token=abc\n")
+	Ctx.Output = tmpDir
+
+	ctxs, err := Ctx.SplitManifest()
+	c.Assert(err, check.IsNil)
+	s := ctxs[0].String()
+	c.Assert(strings.Contains(s, `"url":"http://a.b/c?token=***"`), check.Equals, true, check.Commentf(s))
+	c.Assert(strings.Contains(s, "abc"), check.Equals, false, check.Commentf(s))
+}
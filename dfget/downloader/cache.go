@@ -0,0 +1,136 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// sourceCache keeps the files downloaded from source in a directory with the
+// ETag and Last-Modified of them, so that the source is requested
+// conditionally next time and the cached file is reused if it's not modified.
+type sourceCache struct {
+	dir string
+}
+
+// cacheEntry is the validators of the cached file of the url.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+func newSourceCache(dir string) *sourceCache {
+	if util.IsEmptyStr(dir) {
+		return nil
+	}
+	return &sourceCache{dir: dir}
+}
+
+// load returns the entry of the url, nil if the url is not cached.
+func (sc *sourceCache) load(rawURL string) *cacheEntry {
+	data, err := ioutil.ReadFile(sc.path(rawURL) + ".json")
+	if err != nil {
+		return nil
+	}
+	entry := new(cacheEntry)
+	if json.Unmarshal(data, entry) != nil || entry.URL != rawURL {
+		return nil
+	}
+	if _, err := os.Stat(sc.path(rawURL)); err != nil {
+		return nil
+	}
+	return entry
+}
+
+// open opens the cached file of the url as a source.
+func (sc *sourceCache) open(rawURL string) (*source, error) {
+	f, err := os.Open(sc.path(rawURL))
+	if err != nil {
+		return nil, fmt.Errorf("open cache of %s error: %v", rawURL, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat cache of %s error: %v", rawURL, err)
+	}
+	return &source{ReadCloser: f, length: info.Size(), cached: true}, nil
+}
+
+// store copies the file to the cache of the entry. The stale entry is removed
+// before the file is replaced, and the new one is written at last, so that
+// a file never gets loaded with the validators of another version.
+func (sc *sourceCache) store(entry *cacheEntry, file string) error {
+	src, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(sc.dir, ".cache")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	path := sc.path(entry.URL)
+	if err := os.Remove(path + ".json"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(entry)
+	return ioutil.WriteFile(path+".json", data, 0644)
+}
+
+// CacheUsage returns the number of the files cached in dir and the total size
+// of them, excluding their validators and the temporary files being stored.
+func CacheUsage(dir string) (files int, size int64, err error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".json") {
+			continue
+		}
+		files++
+		size += info.Size()
+	}
+	return files, size, nil
+}
+
+func (sc *sourceCache) path(rawURL string) string {
+	return filepath.Join(sc.dir, fmt.Sprintf("%x", sha1.Sum([]byte(rawURL))))
+}
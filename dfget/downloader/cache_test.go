@@ -0,0 +1,79 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-check/check"
+)
+
+func (s *DownloaderSuite) TestSourceCache(c *check.C) {
+	c.Assert(newSourceCache(""), check.IsNil)
+
+	dir, _ := ioutil.TempDir(s.workHome, "cache")
+	cache := newSourceCache(dir)
+	url := "http://a.b/c"
+	c.Assert(cache.load(url), check.IsNil)
+
+	file := s.target("cache.test")
+	defer os.Remove(file)
+	for _, v := range []string{"v1", "v2"} {
+		ioutil.WriteFile(file, []byte(testContent+v), 0644)
+		entry := &cacheEntry{URL: url, ETag: `"` + v + `"`}
+		c.Assert(cache.store(entry, file), check.IsNil)
+		c.Assert(cache.load(url), check.DeepEquals, entry)
+
+		src, err := cache.open(url)
+		c.Assert(err, check.IsNil)
+		content, _ := ioutil.ReadAll(src)
+		src.Close()
+		c.Assert(string(content), check.Equals, testContent+v)
+		c.Assert(src.length, check.Equals, int64(len(content)))
+		c.Assert(src.cached, check.Equals, true)
+	}
+	c.Assert(cache.load(url+"/d"), check.IsNil)
+
+	// the entry without the file is not loaded
+	os.Remove(cache.path(url))
+	c.Assert(cache.load(url), check.IsNil)
+}
+
+func (s *DownloaderSuite) TestCacheUsage(c *check.C) {
+	_, _, err := CacheUsage(s.target("cache.notexist"))
+	c.Assert(err, check.NotNil)
+
+	dir, _ := ioutil.TempDir(s.workHome, "cache")
+	files, size, err := CacheUsage(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert([]int64{int64(files), size}, check.DeepEquals, []int64{0, 0})
+
+	cache := newSourceCache(dir)
+	file := s.target("usage.test")
+	defer os.Remove(file)
+	ioutil.WriteFile(file, []byte(testContent), 0644)
+	for _, url := range []string{"http://a.b/c", "http://a.b/d"} {
+		c.Assert(cache.store(&cacheEntry{URL: url, ETag: `"v1"`}, file), check.IsNil)
+	}
+	// the temporary file being stored isn't counted
+	ioutil.WriteFile(filepath.Join(dir, ".cache123"), []byte(testContent), 0644)
+	files, size, err = CacheUsage(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert([]int64{int64(files), size}, check.DeepEquals, []int64{2, int64(2 * len(testContent))})
+}
@@ -0,0 +1,680 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// freeSpace is replaced by tests to simulate the full file system.
+var freeSpace = util.FreeSpace
+
+// DirectDownloader downloads the file from file source directly.
+type DirectDownloader struct {
+	URL string
+	// Target is where the content is written. It's streamed to stdout if
+	// Target is '-', to the unix socket connected if it's prefixed with
+	// 'unix:', or to Target if it's an existing named pipe, which blocks until
+	// a reader opens it.
+	Target string
+	// Digest is in the format of 'algo:hex', and it's not verified if empty.
+	// It's computed over the streamed bytes as well, and the resumed part of
+	// the target is read into it first. If the range of the runtime context
+	// is specified, it's the one of the slice taken from Digest rather than
+	// Md5 of the whole file.
+	Digest string
+
+	ctx    *cfg.Context
+	source *sourceClient
+	// cache is nil if CacheDir is not set. The target downloaded from source
+	// is cached with its ETag and Last-Modified, and the cache is reused if
+	// the source replies that it's not modified next time, unless Force is
+	// set. Neither the compressed target nor the slice of the range is cached.
+	cache *sourceCache
+	// stdout is where the content is written when Target is '-'.
+	stdout io.Writer
+	// file is where the content is written, and it's renamed to Target
+	// after verified if it's not Target, which is the case if Atomic is set.
+	file  string
+	total int64
+	// resumed is the length of the existing target continued from, which is
+	// only nonzero if Resume is set and the source supports range requests,
+	// or REST of ftp.
+	resumed int64
+	success bool
+	// dirty is set once the target file is opened for writing.
+	dirty bool
+	// keep is set when the downloaded part of the target is kept for
+	// resuming next time.
+	keep bool
+	// progress is nil if ProgressJSON is not set.
+	progress *jsonProgress
+	// sourceURL is the one of URL and FallbackURLs the source is opened from.
+	sourceURL string
+	// resolvedURL is the one the content is downloaded from after the
+	// redirects of sourceURL.
+	resolvedURL string
+}
+
+// NewDirectDownloader creates a DirectDownloader with the runtime context.
+func NewDirectDownloader(ctx *cfg.Context) *DirectDownloader {
+	file := ctx.Output
+	if ctx.Atomic && !ctx.StreamsOutput() {
+		file += cfg.TempFileSuffix
+	}
+	dd := &DirectDownloader{
+		URL:    ctx.URL,
+		Target: ctx.Output,
+		Digest: ctx.ExpectedDigest(),
+		ctx:    ctx,
+		source: newSourceClient(ctx),
+		cache:  newSourceCache(ctx.CacheDir),
+		stdout: os.Stdout,
+		file:   file,
+	}
+	if ctx.ProgressJSON {
+		dd.progress = newJSONProgress(os.Stderr, ctx.URL)
+	}
+	return dd
+}
+
+// Run downloads the file from source into Target and verifies it against
+// Digest, and the options of the runtime context apply as they're documented
+// on cfg.Context and the fields of dd. OnProgress, OnComplete, Metrics and
+// the ProgressJSON events are all handled on the goroutine calling Run.
+func (dd *DirectDownloader) Run(ctx context.Context) error {
+	start := cfg.DefaultClock.Now()
+	err := dd.run(ctx)
+	if dd.ctx.Metrics != nil {
+		dd.ctx.Metrics.RecordDuration(cfg.Since(start), err)
+	}
+	if dd.progress != nil {
+		dd.progress.finish(err)
+	}
+	if dd.ctx.OnComplete != nil {
+		dd.ctx.OnComplete(dd.Target, err)
+	}
+	return err
+}
+
+// run cancels the download once no bytes arrive from source for IdleTimeout
+// if it's set, and the time throttled by the rate limit isn't counted.
+func (dd *DirectDownloader) run(ctx context.Context) error {
+	if dd.ctx.IdleTimeout <= 0 {
+		return dd.download(ctx, nil)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := newIdleTimer(dd.ctx.IdleTimeout, cancel)
+	defer idle.pause()
+	err := dd.download(ctx, idle)
+	if err != nil && idle.expired() {
+		return fmt.Errorf("idle timeout(%v), no bytes received: %v", dd.ctx.IdleTimeout, err)
+	}
+	return err
+}
+
+// download transfers the file from source, and idle is nil if IdleTimeout
+// is not set.
+func (dd *DirectDownloader) download(ctx context.Context, idle *idleTimer) error {
+	dd.ctx.ClientLogger.Infof("start download %s from source", cfg.RedactURL(dd.URL))
+	streamed := dd.ctx.StreamsOutput()
+	var offset int64
+	if dd.ctx.Resume && !streamed && !dd.ctx.HasRange() {
+		if info, err := os.Stat(dd.file); err == nil && info.Mode().IsRegular() {
+			offset = info.Size()
+		}
+	}
+	if err := dd.fetchRemoteDigest(ctx); err != nil {
+		return err
+	}
+	src, err := dd.openSource(ctx, offset)
+	idle.pause()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	start := src.start
+
+	var dst io.Writer = dd.stdout
+	if socket := dd.ctx.OutputSocket(); socket != "" {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		if err != nil {
+			return fmt.Errorf("connect unix socket[%s] error: %v", socket, err)
+		}
+		defer conn.Close()
+		dst = conn
+	} else if dd.ctx.OutputFIFO() {
+		f, err := dd.openFIFO()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	} else if !streamed {
+		if dd.ctx.StrictSize && src.length > start {
+			if err := dd.checkFreeSpace(src.length - start); err != nil {
+				return err
+			}
+		}
+		f, err := dd.openTarget(start, offset)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dst = f
+	}
+	var gz *gzip.Writer
+	if dd.ctx.CompressOutput {
+		gz = gzip.NewWriter(dst)
+		dst = gz
+	}
+	// the digest is computed over the bytes streamed in, so that the target
+	// isn't read again after downloading
+	h := dd.newHash()
+	if h == nil && dd.ctx.WriteChecksumSidecar {
+		h = util.NewHash(cfg.DigestSHA256)
+	}
+	if h != nil {
+		if err := dd.hashResumed(h, start); err != nil {
+			return err
+		}
+		dst = io.MultiWriter(dst, h)
+	}
+	dd.resumed = start
+	onProgress := dd.ctx.OnProgress
+	if p := dd.progress; p != nil {
+		p.begin(start, src.length)
+		callback := onProgress
+		onProgress = func(done, total int64) {
+			p.update(done, total)
+			if callback != nil {
+				callback(done, total)
+			}
+		}
+	}
+	if onProgress != nil {
+		dst = &progressWriter{w: dst, done: start, total: src.length, onProgress: onProgress}
+	}
+
+	var reader io.Reader = src
+	if idle != nil {
+		reader = &idleReader{r: src, idle: idle}
+	}
+	if !src.cached && len(dd.ctx.LimitSchedule) > 0 {
+		reader = util.NewScheduledLimitReader(reader, dd.ctx.LimitAt, cfg.DefaultClock.Now)
+	} else if !src.cached {
+		reader = util.NewLimitReader(reader, dd.ctx.LocalLimit)
+	}
+	if dd.ctx.MaxSize > 0 {
+		// read one more byte to find out whether the file exceeds MaxSize
+		reader = io.LimitReader(reader, dd.ctx.MaxSize-start+1)
+	}
+	n, err := io.Copy(dst, reader)
+	dd.total = start + n
+	if dd.ctx.Metrics != nil && !src.cached {
+		dd.ctx.Metrics.RecordBytes(n)
+	}
+	if err != nil && !streamed && util.IsNoSpace(err) {
+		return dd.noSpace(dd.file, -1, err)
+	}
+	if err != nil {
+		dd.keep = dd.ctx.Resume
+		return fmt.Errorf("download from source error: %v", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil && !streamed && util.IsNoSpace(err) {
+			return dd.noSpace(dd.file, -1, err)
+		} else if err != nil {
+			return fmt.Errorf("compress output error: %v", err)
+		}
+	}
+	if dd.ctx.MaxSize > 0 && dd.total > dd.ctx.MaxSize {
+		return fmt.Errorf("file size exceeds the max size:%d", dd.ctx.MaxSize)
+	}
+	if dd.ctx.StrictSize {
+		// src is closed first since it holds the slot of the host, which the
+		// length requested again by checkSize waits for otherwise
+		src.Close()
+		if err := dd.checkSize(ctx, src.length); err != nil {
+			return err
+		}
+	}
+
+	if err := dd.verify(h); err != nil {
+		return err
+	}
+	if dd.ctx.FileMode != 0 && !streamed {
+		if err := os.Chmod(dd.file, dd.ctx.FileMode); err != nil {
+			return fmt.Errorf("chmod target file[%s] error: %v", dd.file, err)
+		}
+	}
+	if !streamed {
+		if err := dd.chown(dd.file); err != nil {
+			return err
+		}
+	}
+	if !streamed && dd.file != dd.Target {
+		if dd.ctx.NoFollowSymlinks && util.IsSymlink(dd.Target) {
+			return errSymlink(dd.Target)
+		}
+		if err := util.MoveFile(dd.file, dd.Target); util.IsNoSpace(err) {
+			return dd.noSpace(dd.Target, dd.total, err)
+		} else if err != nil {
+			return fmt.Errorf("move %s to target file[%s] error: %v", dd.file, dd.Target, err)
+		}
+	}
+	dd.success = true
+	if dd.ctx.Preheat {
+		return dd.preheat(src)
+	}
+	// the compressed target isn't the content of the source
+	if !streamed && !dd.ctx.HasRange() && !dd.ctx.CompressOutput {
+		dd.storeCache(src)
+	}
+	if dd.ctx.WriteChecksumSidecar && !streamed {
+		return dd.writeChecksumSidecar(h)
+	}
+	return nil
+}
+
+// writeChecksumSidecar writes the hex of h, which is of the algorithm of
+// Digest or sha256 if it's empty, to the file beside the Target suffixed
+// with the algorithm, in the format of 'hash  filename' like sha256sum.
+func (dd *DirectDownloader) writeChecksumSidecar(h hash.Hash) error {
+	algo, _, err := cfg.ParseDigest(dd.Digest)
+	if err != nil {
+		algo = cfg.DigestSHA256
+	}
+	path := dd.Target + "." + algo
+	if dd.ctx.NoFollowSymlinks && util.IsSymlink(path) {
+		return errSymlink(path)
+	}
+	line := fmt.Sprintf("%x  %s\n", h.Sum(nil), filepath.Base(dd.Target))
+	if err := ioutil.WriteFile(path, []byte(line), 0644); err != nil {
+		return fmt.Errorf("write checksum sidecar[%s] error: %v", path, err)
+	}
+	return dd.chown(path)
+}
+
+// chown changes the owner of the file to OutputUID and OutputGID, and it
+// does nothing if neither of them is set.
+func (dd *DirectDownloader) chown(path string) error {
+	uid, gid, err := dd.ctx.OutputOwner()
+	if err != nil || (uid < 0 && gid < 0) {
+		return err
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("chown file[%s] to %d:%d error: %v", path, uid, gid, err)
+	}
+	return nil
+}
+
+// openSource opens the source of URL, and each of FallbackURLs is tried in
+// order once opening the previous one fails, unless the download is canceled
+// or back-source is disabled. The one opened is logged if it's a fallback.
+func (dd *DirectDownloader) openSource(ctx context.Context, offset int64) (*source, error) {
+	dd.sourceURL = dd.URL
+	src, err := dd.openURL(ctx, dd.URL, offset)
+	for _, u := range dd.ctx.FallbackURLs {
+		if err == nil || ctx.Err() != nil || err == errors.ErrBackSourceDisabled || err == dd.source.err {
+			break
+		}
+		dd.ctx.ClientLogger.Warnf("download from %s error: %v, fall back to %s",
+			cfg.RedactURL(dd.sourceURL), err, cfg.RedactURL(u))
+		dd.sourceURL = u
+		src, err = dd.openURL(ctx, u, offset)
+	}
+	if err == nil && dd.sourceURL != dd.URL {
+		dd.ctx.ClientLogger.Infof("download %s from fallback url %s",
+			cfg.RedactURL(dd.URL), cfg.RedactURL(dd.sourceURL))
+	}
+	if err == nil {
+		dd.resolvedURL = dd.sourceURL
+		if !util.IsEmptyStr(src.url) {
+			dd.resolvedURL = src.url
+		}
+	}
+	return src, err
+}
+
+// openURL opens the source of rawURL, and it's requested conditionally if URL
+// is cached so that the cache is read instead if the source is not modified.
+// Only the slice is opened if the range is specified, which is never cached.
+func (dd *DirectDownloader) openURL(ctx context.Context, rawURL string, offset int64) (*source, error) {
+	if dd.ctx.HasRange() {
+		return dd.source.openSlice(ctx, rawURL, dd.ctx.RangeStart, dd.ctx.RangeEnd)
+	}
+	var entry *cacheEntry
+	if dd.cache != nil && offset == 0 && !dd.ctx.Force {
+		entry = dd.cache.load(dd.URL)
+	}
+	src, err := dd.source.openIfModified(ctx, rawURL, offset, -1, entry)
+	if err != nil || !src.notModified {
+		return src, err
+	}
+	src.Close()
+	dd.ctx.ClientLogger.Infof("source is not modified, reuse the cache in %s", dd.cache.dir)
+	return dd.cache.open(dd.URL)
+}
+
+// storeCache caches the target downloaded from the source with validators,
+// and the failure of it doesn't fail the download.
+func (dd *DirectDownloader) storeCache(src *source) {
+	if dd.cache == nil || src.cached || (util.IsEmptyStr(src.etag) && util.IsEmptyStr(src.lastModified)) {
+		return
+	}
+	entry := &cacheEntry{URL: dd.URL, ETag: src.etag, LastModified: src.lastModified}
+	if err := dd.cache.store(entry, dd.Target); err != nil {
+		dd.ctx.ClientLogger.Warnf("cache %s error: %v", cfg.RedactURL(dd.URL), err)
+	}
+}
+
+// preheat stores the Target to the cache as storeCache does, but it fails if
+// the source can't be cached. The Target is removed whether it's cached or not.
+func (dd *DirectDownloader) preheat(src *source) error {
+	defer os.Remove(dd.Target)
+	if dd.cache == nil {
+		return fmt.Errorf("cache dir is required to preheat %s", dd.URL)
+	}
+	if src.cached {
+		return nil
+	}
+	if util.IsEmptyStr(src.etag) && util.IsEmptyStr(src.lastModified) {
+		return fmt.Errorf("%s has neither etag nor last-modified and can't be cached", dd.URL)
+	}
+	entry := &cacheEntry{URL: dd.URL, ETag: src.etag, LastModified: src.lastModified}
+	if err := dd.cache.store(entry, dd.Target); err != nil {
+		return fmt.Errorf("cache %s error: %v", dd.URL, err)
+	}
+	return nil
+}
+
+// openFIFO opens the named pipe of the Target for writing.
+func (dd *DirectDownloader) openFIFO() (*os.File, error) {
+	flag := os.O_WRONLY
+	if dd.ctx.NoFollowSymlinks {
+		flag |= syscall.O_NOFOLLOW
+	}
+	f, err := os.OpenFile(dd.Target, flag, 0)
+	if err != nil && dd.ctx.NoFollowSymlinks && util.IsSymlink(dd.Target) {
+		return nil, errSymlink(dd.Target)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open fifo[%s] error: %v", dd.Target, err)
+	}
+	return f, nil
+}
+
+// openTarget opens the target file for appending if the download starts
+// from the existing part, otherwise it's truncated.
+func (dd *DirectDownloader) openTarget(start, offset int64) (*os.File, error) {
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if start > 0 {
+		flag = os.O_WRONLY | os.O_APPEND
+		dd.ctx.ClientLogger.Infof("resume download from %d bytes", start)
+	} else if offset > 0 {
+		dd.ctx.ClientLogger.Warnf("source doesn't support range, download from the beginning")
+	}
+	if dd.ctx.NoFollowSymlinks {
+		flag |= syscall.O_NOFOLLOW
+	}
+	f, err := os.OpenFile(dd.file, flag, 0644)
+	if err != nil && dd.ctx.NoFollowSymlinks && util.IsSymlink(dd.file) {
+		return nil, errSymlink(dd.file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open target file[%s] error: %v", dd.file, err)
+	}
+	dd.dirty = true
+	return f, nil
+}
+
+// checkFreeSpace verifies that the file system of the target has the space
+// for the required bytes, and the check is skipped if the free space is
+// unknown.
+func (dd *DirectDownloader) checkFreeSpace(required int64) error {
+	free, err := freeSpace(filepath.Dir(dd.file))
+	if err != nil {
+		dd.ctx.ClientLogger.Warnf("get free space of %s error: %v", dd.file, err)
+		return nil
+	}
+	if free < required {
+		return dd.noSpace(dd.file, required, nil)
+	}
+	return nil
+}
+
+// noSpace logs and returns the errors.NoSpaceError of path with the free space
+// at present, and the partial target isn't kept.
+func (dd *DirectDownloader) noSpace(path string, required int64, err error) error {
+	dd.keep = false
+	free, e := freeSpace(filepath.Dir(path))
+	if e != nil {
+		free = -1
+	}
+	noSpace := &errors.NoSpaceError{Path: path, Free: free, Required: required, Err: err}
+	dd.ctx.ClientLogger.Errorf("%v", noSpace)
+	return noSpace
+}
+
+func errSymlink(path string) error {
+	return fmt.Errorf("refuse to write through symlink[%s]", path)
+}
+
+// checkSize compares the number of bytes downloaded with the length of the
+// source, and the length is requested again if it's unknown unless only a
+// slice of it is downloaded.
+func (dd *DirectDownloader) checkSize(ctx context.Context, length int64) error {
+	if length < 0 && !dd.ctx.HasRange() {
+		var err error
+		if length, err = dd.source.stat(ctx, dd.sourceURL); err != nil {
+			return fmt.Errorf("get the length of source error: %v", err)
+		}
+	}
+	if length < 0 {
+		dd.ctx.ClientLogger.Warnf("the length of source is unknown, skip checking the size")
+		return nil
+	}
+	if dd.total != length {
+		return fmt.Errorf("size mismatch, expected:%d real:%d", length, dd.total)
+	}
+	return nil
+}
+
+// newHash returns the hash of the digest algorithm, nil if no digest.
+func (dd *DirectDownloader) newHash() hash.Hash {
+	if algo, _, err := cfg.ParseDigest(dd.Digest); err == nil {
+		return util.NewHash(algo)
+	}
+	return nil
+}
+
+// hashResumed writes the first n bytes of the target, which are resumed
+// rather than downloaded, to h.
+func (dd *DirectDownloader) hashResumed(h hash.Hash, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	f, err := os.Open(dd.file)
+	if err != nil {
+		return fmt.Errorf("open target file[%s] error: %v", dd.file, err)
+	}
+	defer f.Close()
+	if _, err := io.CopyN(h, f, n); err != nil {
+		return fmt.Errorf("read the resumed part of target file[%s] error: %v", dd.file, err)
+	}
+	return nil
+}
+
+// verify checks the digest of the bytes written to h, which are all the bytes
+// of the target.
+func (dd *DirectDownloader) verify(h hash.Hash) error {
+	if util.IsEmptyStr(dd.Digest) {
+		return nil
+	}
+	algo, expected, err := cfg.ParseDigest(dd.Digest)
+	if err != nil {
+		return err
+	}
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("%s not match, expected:%s real:%s", algo, expected, actual)
+	}
+	return nil
+}
+
+// Verify hashes the existing Target and checks it against Digest without
+// downloading, and Total is the length of the Target then. The Target is
+// decompressed first if CompressOutput is set. If FetchRemoteDigest is set,
+// the digest published beside URL is requested first, which is canceled once
+// ctx is done.
+func (dd *DirectDownloader) Verify(ctx context.Context) error {
+	if err := dd.fetchRemoteDigest(ctx); err != nil {
+		return err
+	}
+	h := dd.newHash()
+	if h == nil {
+		return fmt.Errorf("no digest to verify target file[%s]", dd.Target)
+	}
+	f, err := os.Open(dd.Target)
+	if err != nil {
+		return fmt.Errorf("open target file[%s] error: %v", dd.Target, err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if dd.ctx.CompressOutput {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("read target file[%s] error: %v", dd.Target, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	if dd.total, err = io.Copy(h, r); err != nil {
+		return fmt.Errorf("read target file[%s] error: %v", dd.Target, err)
+	}
+	return dd.verify(h)
+}
+
+// Cleanup removes the file written by Run when downloading fails, except
+// that it's kept for resuming.
+func (dd *DirectDownloader) Cleanup() {
+	if dd.dirty && !dd.success && !dd.keep {
+		os.Remove(dd.file)
+	}
+}
+
+// Resumed returns the number of bytes already present in the target file
+// before downloading.
+func (dd *DirectDownloader) Resumed() int64 {
+	return dd.resumed
+}
+
+// Total returns the number of bytes written to the target file.
+func (dd *DirectDownloader) Total() int64 {
+	return dd.total
+}
+
+// ResolvedURL returns the url the content is downloaded from, which differs
+// from URL if it's redirected or falls back, and it's empty before the
+// source is opened.
+func (dd *DirectDownloader) ResolvedURL() string {
+	return dd.resolvedURL
+}
+
+// progressWriter reports the progress after each write.
+type progressWriter struct {
+	w          io.Writer
+	done       int64
+	total      int64
+	onProgress func(done, total int64)
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	if n > 0 {
+		pw.done += int64(n)
+		pw.onProgress(pw.done, pw.total)
+	}
+	return n, err
+}
+
+// idleTimer calls onIdle once it's not paused for the timeout.
+type idleTimer struct {
+	timeout time.Duration
+	timer   cfg.Timer
+	fired   int32
+}
+
+// newIdleTimer creates an idleTimer of cfg.DefaultClock which is running.
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.timer = cfg.DefaultClock.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&t.fired, 1)
+		onIdle()
+	})
+	return t
+}
+
+// reset restarts the timer, and it's a no-op on the nil timer.
+func (t *idleTimer) reset() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+// pause stops the timer until it's reset, and it's a no-op on the nil timer.
+func (t *idleTimer) pause() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// expired reports whether onIdle has been called.
+func (t *idleTimer) expired() bool {
+	return atomic.LoadInt32(&t.fired) == 1
+}
+
+// idleReader runs the idle timer only while it's waiting for the bytes of
+// the underlying reader.
+type idleReader struct {
+	r    io.Reader
+	idle *idleTimer
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	ir.idle.reset()
+	n, err := ir.r.Read(p)
+	ir.idle.pause()
+	return n, err
+}
@@ -0,0 +1,1031 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/alibaba/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+const (
+	testContent    = "dragonfly"
+	testContentMd5 = "7fc8baba8e7696d6c3b286f738245592"
+	testContentSha = "e2ca6aec52558fcc04311983bad03e38ca5e799c239d202ae7a4f58aff8a6970"
+)
+
+func newTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/range" {
+			http.ServeContent(w, r, "range", time.Time{}, strings.NewReader(testContent))
+			return
+		}
+		if r.URL.Path == "/slow" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(testContent)))
+			fmt.Fprint(w, testContent[:1])
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		if r.URL.Path == "/encoding" {
+			// the content is encoded to the first accepted encoding
+			encoding := strings.TrimSpace(strings.Split(r.Header.Get("Accept-Encoding"), ",")[0])
+			var (
+				buf     bytes.Buffer
+				encoder io.WriteCloser
+			)
+			switch encoding {
+			case "gzip":
+				encoder = gzip.NewWriter(&buf)
+			case "deflate":
+				encoder = zlib.NewWriter(&buf)
+			default:
+				fmt.Fprint(w, testContent)
+				return
+			}
+			encoder.Write([]byte(testContent))
+			encoder.Close()
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(buf.Bytes())
+			return
+		}
+		if r.URL.Path == "/truncated" {
+			// the content length is only advertised by HEAD, and the
+			// response of GET is chunked
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Length", strconv.Itoa(len(testContent)+1))
+				return
+			}
+			fmt.Fprint(w, testContent)
+			w.(http.Flusher).Flush()
+			return
+		}
+		if r.URL.Path == "/etag" {
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprint(w, testContent)
+			return
+		}
+		if r.URL.Path == "/header" {
+			fmt.Fprintf(w, "%s|%s|%s", r.Host, r.Header.Get("Authorization"),
+				r.Header.Get("X-Tenant"))
+			return
+		}
+		if r.URL.Path != "/file" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, testContent)
+	}))
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_Run(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		path     string
+		md5      string
+		digest   string
+		maxSize  int64
+		expected string
+	}{
+		{"/file", "", "", 0, ""},
+		{"/file", testContentMd5, "", 0, ""},
+		{"/file", "d41d8cd98f00b204e9800998ecf8427e", "", 0, "md5 not match"},
+		{"/file", "", "sha256:" + testContentSha, 0, ""},
+		{"/file", testContentMd5, "sha256:" + strings.Repeat("0", 64), 0, "sha256 not match"},
+		{"/file", "", "sha1:" + strings.Repeat("0", 40), 0, "sha1 not match"},
+		{"/notexist", "", "", 0, "response code:404"},
+		{"/file", "", "", int64(len(testContent)), ""},
+		{"/file", "", "", int64(len(testContent) - 1), "exceeds the max size"},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Output = s.target("direct.test")
+		cfg.Ctx.Md5 = v.md5
+		cfg.Ctx.Digest = v.digest
+		cfg.Ctx.MaxSize = v.maxSize
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+
+		if v.expected == "" {
+			c.Assert(err, check.IsNil)
+			content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+			c.Assert(string(content), check.Equals, testContent)
+			c.Assert(dd.Total(), check.Equals, int64(len(testContent)))
+		} else {
+			c.Assert(err, check.ErrorMatches, ".*"+v.expected+".*")
+			_, err = os.Stat(cfg.Ctx.Output)
+			c.Assert(os.IsNotExist(err), check.Equals, true)
+		}
+		os.Remove(cfg.Ctx.Output)
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithStrictSize(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		path           string
+		strict         bool
+		acceptEncoding bool
+		expected       string
+	}{
+		{"/file", true, false, ""},
+		{"/range", true, false, ""},
+		{"/truncated", false, false, ""},
+		{"/truncated", true, false, "size mismatch, expected:10 real:9"},
+		{"/encoding", true, true, ""},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Output = s.target("strict.test")
+		cfg.Ctx.StrictSize = v.strict
+		cfg.Ctx.AcceptEncoding = v.acceptEncoding
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+
+		if v.expected == "" {
+			c.Assert(err, check.IsNil, check.Commentf("%v", v))
+			content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+			c.Assert(string(content), check.Equals, testContent)
+		} else {
+			c.Assert(err, check.ErrorMatches, v.expected, check.Commentf("%v", v))
+			_, err = os.Stat(cfg.Ctx.Output)
+			c.Assert(os.IsNotExist(err), check.Equals, true)
+		}
+		os.Remove(cfg.Ctx.Output)
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithCache(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.CacheDir, _ = ioutil.TempDir(s.workHome, "cache")
+	cfg.Ctx.Output = s.target("cache.test")
+	cfg.Ctx.Md5 = testContentMd5
+	defer os.Remove(cfg.Ctx.Output)
+	var cases = []struct {
+		path   string
+		force  bool
+		cached bool
+	}{
+		{"/etag", false, false},
+		{"/etag", false, true},
+		{"/etag", true, false},
+		{"/etag", false, true},
+		{"/file", false, false},
+		{"/file", false, false},
+	}
+
+	for _, v := range cases {
+		os.Remove(cfg.Ctx.Output)
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Force = v.force
+		var logs bytes.Buffer
+		cfg.Ctx.ClientLogger.Out = &logs
+		dd := NewDirectDownloader(cfg.Ctx)
+		c.Assert(dd.Run(context.Background()), check.IsNil, check.Commentf("%v", v))
+		content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+		c.Assert(string(content), check.Equals, testContent)
+		c.Assert(strings.Contains(logs.String(), "source is not modified"), check.Equals, v.cached,
+			check.Commentf("%v", v))
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithFileMode(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL + "/file"
+	cfg.Ctx.Output = s.target("mode.test")
+	defer os.Remove(cfg.Ctx.Output)
+	for _, mode := range []os.FileMode{0755, 0600} {
+		cfg.Ctx.FileMode = mode
+		dd := NewDirectDownloader(cfg.Ctx)
+		c.Assert(dd.Run(context.Background()), check.IsNil)
+		info, err := os.Stat(cfg.Ctx.Output)
+		c.Assert(err, check.IsNil)
+		c.Assert(info.Mode().Perm(), check.Equals, mode)
+	}
+
+	// the default permission is kept if FileMode is 0
+	os.Remove(cfg.Ctx.Output)
+	cfg.Ctx.FileMode = 0
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	info, err := os.Stat(cfg.Ctx.Output)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm()&^0644, check.Equals, os.FileMode(0))
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithCallbacks(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var (
+		progress    [][2]int64
+		completed   string
+		completeErr error
+	)
+	cfg.Ctx.OnProgress = func(done, total int64) {
+		progress = append(progress, [2]int64{done, total})
+	}
+	cfg.Ctx.OnComplete = func(path string, err error) {
+		completed, completeErr = path, err
+	}
+
+	cfg.Ctx.URL = server.URL + "/file"
+	cfg.Ctx.Output = s.target("callback.test")
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	c.Assert(len(progress) > 0, check.Equals, true)
+	c.Assert(progress[len(progress)-1], check.Equals,
+		[2]int64{int64(len(testContent)), int64(len(testContent))})
+	c.Assert(completed, check.Equals, cfg.Ctx.Output)
+	c.Assert(completeErr, check.IsNil)
+
+	// resume from the existing part
+	ioutil.WriteFile(cfg.Ctx.Output+cfg.TempFileSuffix, []byte(testContent[:4]), 0644)
+	cfg.Ctx.URL = server.URL + "/range"
+	cfg.Ctx.Resume = true
+	progress = nil
+	dd = NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	c.Assert(progress[0][0] > 4, check.Equals, true)
+	c.Assert(progress[len(progress)-1][1], check.Equals, int64(len(testContent)))
+
+	cfg.Ctx.URL = server.URL + "/notexist"
+	dd = NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.NotNil)
+	c.Assert(completeErr, check.ErrorMatches, ".*response code:404")
+}
+
+// testMetrics records the metrics of downloading for testing.
+type testMetrics struct {
+	bytes     int64
+	durations []error
+}
+
+func (m *testMetrics) RecordBytes(n int64) { m.bytes += n }
+func (m *testMetrics) RecordDuration(d time.Duration, err error) {
+	m.durations = append(m.durations, err)
+}
+func (m *testMetrics) RecordBackSource(reason int) {}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithMetrics(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	metrics := &testMetrics{}
+	cfg.Ctx.Metrics = metrics
+	cfg.Ctx.CacheDir, _ = ioutil.TempDir(s.workHome, "metrics")
+	cfg.Ctx.URL = server.URL + "/etag"
+	cfg.Ctx.Output = s.target("metrics.test")
+	defer os.Remove(cfg.Ctx.Output)
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	c.Assert(metrics.bytes, check.Equals, int64(len(testContent)))
+
+	// the bytes read from the cache aren't counted
+	dd = NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	c.Assert(metrics.bytes, check.Equals, int64(len(testContent)))
+
+	cfg.Ctx.URL = server.URL + "/notexist"
+	dd = NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.NotNil)
+	c.Assert(len(metrics.durations), check.Equals, 3)
+	c.Assert(metrics.durations[:2], check.DeepEquals, []error{nil, nil})
+	c.Assert(metrics.durations[2], check.NotNil)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunNoSpace(c *check.C) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		c.Skip("/dev/full is not available")
+	}
+	server := newTestServer()
+	defer server.Close()
+
+	// the writes to /dev/full fail with ENOSPC
+	cfg.Ctx.URL = server.URL + "/file"
+	cfg.Ctx.Output = s.target("full.test")
+	cfg.Ctx.Atomic = false
+	cfg.Ctx.Resume = true
+	os.Symlink("/dev/full", cfg.Ctx.Output)
+	defer os.Remove(cfg.Ctx.Output)
+	dd := NewDirectDownloader(cfg.Ctx)
+	err := dd.Run(context.Background())
+	noSpace, ok := err.(*errors.NoSpaceError)
+	c.Assert(ok, check.Equals, true, check.Commentf("%v", err))
+	c.Assert(noSpace.Path, check.Equals, cfg.Ctx.Output)
+	c.Assert(noSpace.Free >= 0, check.Equals, true)
+	c.Assert(err, check.ErrorMatches, "insufficient disk space for .*no space left on device")
+
+	// the partial target is removed even if resuming
+	dd.Cleanup()
+	_, err = os.Lstat(cfg.Ctx.Output)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunNoFollowSymlinks(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	victim := s.target("victim.test")
+	ioutil.WriteFile(victim, []byte("victim"), 0644)
+	defer os.Remove(victim)
+	cfg.Ctx.URL = server.URL + "/file"
+	cfg.Ctx.Output = s.target("nofollow.test")
+	cfg.Ctx.NoFollowSymlinks = true
+	defer os.Remove(cfg.Ctx.Output)
+
+	var cases = []struct {
+		atomic bool
+		link   string
+	}{
+		{false, cfg.Ctx.Output},
+		{true, cfg.Ctx.Output + cfg.TempFileSuffix},
+		// the target is replaced with a symlink while downloading
+		{true, cfg.Ctx.Output},
+	}
+	for _, v := range cases {
+		cfg.Ctx.Atomic = v.atomic
+		dd := NewDirectDownloader(cfg.Ctx)
+		os.Symlink(victim, v.link)
+		c.Assert(dd.Run(context.Background()), check.ErrorMatches,
+			`refuse to write through symlink\[`+v.link+`\]`, check.Commentf("%v", v))
+		dd.Cleanup()
+		c.Assert(util.IsSymlink(v.link), check.Equals, true, check.Commentf("%v", v))
+		content, _ := ioutil.ReadFile(victim)
+		c.Assert(string(content), check.Equals, "victim", check.Commentf("%v", v))
+		os.Remove(v.link)
+	}
+
+	cfg.Ctx.NoFollowSymlinks = false
+	os.Symlink(victim, cfg.Ctx.Output)
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	c.Assert(util.IsSymlink(cfg.Ctx.Output), check.Equals, false)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithStrictSizeAndMaxConnsPerHost(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL + "/truncated"
+	cfg.Ctx.Output = s.target("strict.test")
+	cfg.Ctx.StrictSize = true
+	cfg.Ctx.MaxConnsPerHost = 1
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	dd := NewDirectDownloader(cfg.Ctx)
+	err := dd.Run(ctx)
+	dd.Cleanup()
+	// the length is requested by HEAD after the chunked response is closed
+	c.Assert(err, check.ErrorMatches, "size mismatch, expected:10 real:9")
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunCheckFreeSpace(c *check.C) {
+	defer func(f func(string) (int64, error)) { freeSpace = f }(freeSpace)
+	freeSpace = func(string) (int64, error) { return 4, nil }
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL + "/file"
+	cfg.Ctx.Output = s.target("free.test")
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	os.Remove(cfg.Ctx.Output)
+
+	cfg.Ctx.StrictSize = true
+	dd = NewDirectDownloader(cfg.Ctx)
+	err := dd.Run(context.Background())
+	c.Assert(err, check.DeepEquals, &errors.NoSpaceError{
+		Path:     cfg.Ctx.Output + cfg.TempFileSuffix,
+		Free:     4,
+		Required: int64(len(testContent)),
+	})
+	_, err = os.Stat(cfg.Ctx.Output + cfg.TempFileSuffix)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunTimeout(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL + "/slow"
+	cfg.Ctx.Output = s.target("timeout.test")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	dd := NewDirectDownloader(cfg.Ctx)
+	err := dd.Run(ctx)
+	dd.Cleanup()
+
+	c.Assert(err, check.NotNil)
+	c.Assert(ctx.Err(), check.Equals, context.DeadlineExceeded)
+	_, err = os.Stat(cfg.Ctx.Output)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunIdleTimeout(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL + "/slow"
+	cfg.Ctx.Output = s.target("idle.test")
+	cfg.Ctx.IdleTimeout = 100 * time.Millisecond
+	start := time.Now()
+	dd := NewDirectDownloader(cfg.Ctx)
+	err := dd.Run(context.Background())
+	dd.Cleanup()
+	c.Assert(err, check.ErrorMatches, "idle timeout.*")
+	c.Assert(time.Since(start) < time.Second, check.Equals, true)
+	c.Assert(dd.Total(), check.Equals, int64(1))
+
+	// the time throttled by the rate limit isn't idle
+	cfg.Ctx.URL = server.URL + "/file"
+	cfg.Ctx.LocalLimit = 30
+	dd = NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	os.Remove(cfg.Ctx.Output)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunToStdout(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		digest   string
+		expected string
+	}{
+		{"", ""},
+		{"md5:" + testContentMd5, ""},
+		{"sha256:" + testContentSha, ""},
+		{"sha256:" + strings.Repeat("0", 64), "sha256 not match"},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + "/file"
+		cfg.Ctx.Output = cfg.StdoutOutput
+		cfg.Ctx.Digest = v.digest
+		cfg.Ctx.Resume = true
+		var buf bytes.Buffer
+		dd := NewDirectDownloader(cfg.Ctx)
+		dd.stdout = &buf
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+
+		c.Assert(buf.String(), check.Equals, testContent)
+		c.Assert(dd.Resumed(), check.Equals, int64(0))
+		if v.expected == "" {
+			c.Assert(err, check.IsNil)
+		} else {
+			c.Assert(err, check.ErrorMatches, ".*"+v.expected+".*")
+		}
+	}
+	_, err := os.Stat(cfg.StdoutOutput)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunToUnixSocket(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+	socket := s.target("dfget.sock")
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, check.IsNil)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			data, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			received <- string(data)
+		}
+	}()
+
+	var cases = []struct {
+		digest string
+		valid  bool
+	}{
+		{"md5:" + testContentMd5, true},
+		{"sha256:" + strings.Repeat("0", 64), false},
+	}
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + "/file"
+		cfg.Ctx.Output = cfg.UnixSocketOutputPrefix + socket
+		cfg.Ctx.Digest = v.digest
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+
+		// the digest is computed over the bytes streamed to the socket
+		c.Assert(err == nil, check.Equals, v.valid, check.Commentf("%v %v", v, err))
+		c.Assert(<-received, check.Equals, testContent)
+		c.Assert(dd.Total(), check.Equals, int64(len(testContent)))
+	}
+	_, err = os.Stat(cfg.Ctx.Output + cfg.TempFileSuffix)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	cfg.Ctx.Output = cfg.UnixSocketOutputPrefix + s.target("notexist.sock")
+	err = NewDirectDownloader(cfg.Ctx).Run(context.Background())
+	c.Assert(err, check.ErrorMatches, "connect unix socket.*")
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_Verify(c *check.C) {
+	cfg.Ctx.Output = s.target("verify.test")
+	ioutil.WriteFile(cfg.Ctx.Output, []byte(testContent), 0644)
+	defer os.Remove(cfg.Ctx.Output)
+
+	var cases = []struct {
+		md5    string
+		digest string
+		err    string
+	}{
+		{testContentMd5, "", ""},
+		{"", "sha256:" + testContentSha, ""},
+		{strings.Repeat("0", 32), "", "md5 not match.*"},
+		{"", "", "no digest to verify.*"},
+	}
+	for _, v := range cases {
+		cfg.Ctx.Md5, cfg.Ctx.Digest = v.md5, v.digest
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Verify(context.Background())
+		if v.err == "" {
+			c.Assert(err, check.IsNil, check.Commentf("%v", v))
+			c.Assert(dd.Total(), check.Equals, int64(len(testContent)))
+		} else {
+			c.Assert(err, check.ErrorMatches, v.err, check.Commentf("%v", v))
+		}
+	}
+
+	cfg.Ctx.Output, cfg.Ctx.Md5 = s.target("notexist"), testContentMd5
+	c.Assert(NewDirectDownloader(cfg.Ctx).Verify(context.Background()), check.ErrorMatches, "open target file.*")
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunToFIFO(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+	fifo := s.target("dfget.fifo")
+	c.Assert(syscall.Mkfifo(fifo, 0644), check.IsNil)
+	defer os.Remove(fifo)
+
+	var cases = []struct {
+		md5   string
+		valid bool
+	}{
+		{testContentMd5, true},
+		{strings.Repeat("0", 32), false},
+	}
+	for _, v := range cases {
+		received := make(chan string, 1)
+		go func() {
+			data, _ := ioutil.ReadFile(fifo)
+			received <- string(data)
+		}()
+		cfg.Ctx.URL = server.URL + "/file"
+		cfg.Ctx.Output = fifo
+		cfg.Ctx.Md5 = v.md5
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+
+		// the md5 is computed over the bytes streamed to the fifo
+		c.Assert(err == nil, check.Equals, v.valid, check.Commentf("%v %v", v, err))
+		c.Assert(<-received, check.Equals, testContent)
+		c.Assert(util.IsFIFO(fifo), check.Equals, true)
+	}
+	_, err := os.Stat(fifo + cfg.TempFileSuffix)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithHeader(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL + "/header"
+	cfg.Ctx.Output = s.target("header.test")
+	cfg.Ctx.Header = []string{"Authorization: Basic xx:yy", "X-Tenant:a", "Host: a.b"}
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	dd.Cleanup()
+
+	content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+	c.Assert(string(content), check.Equals, "a.b|Basic xx:yy|a")
+	os.Remove(cfg.Ctx.Output)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithRange(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		path     string
+		start    int64
+		end      int64
+		digest   string
+		expected string
+		err      string
+	}{
+		{"/range", 2, 5, "", "agon", ""},
+		{"/file", 2, 5, "", "agon", ""},
+		{"/range", 2, 5, "md5:e07217d0fcb0d5594b59c37ff0a6f483", "agon", ""},
+		{"/file", 2, 5, "md5:" + testContentMd5, "agon", "md5 not match"},
+		{"/range", 4, 100, "", "onfly", ""},
+		{"/file", 4, 100, "", "onfly", ""},
+		{"/range", 20, 30, "", "", "not satisfiable by source"},
+		{"/file", 20, 30, "", "", "exceeds the length of source"},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Output = s.target("range.test")
+		cfg.Ctx.Md5, cfg.Ctx.Digest = testContentMd5, v.digest
+		cfg.Ctx.RangeStart, cfg.Ctx.RangeEnd = v.start, v.end
+		cfg.Ctx.StrictSize = true
+
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		if v.err == "" {
+			c.Assert(err, check.IsNil, check.Commentf("%v", v))
+			content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+			c.Assert(string(content), check.Equals, v.expected, check.Commentf("%v", v))
+			c.Assert(dd.Total(), check.Equals, int64(len(v.expected)))
+		} else {
+			c.Assert(err, check.NotNil, check.Commentf("%v", v))
+			c.Assert(strings.Contains(err.Error(), v.err), check.Equals, true, check.Commentf("%v", v))
+		}
+		dd.Cleanup()
+		os.Remove(cfg.Ctx.Output)
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunStreamingDigest(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		algo    string
+		partial string
+		resume  bool
+		valid   bool
+	}{
+		{cfg.DigestMD5, "", false, true},
+		{cfg.DigestSHA1, "", false, true},
+		{cfg.DigestSHA256, "", false, true},
+		{cfg.DigestMD5, "drag", true, true},
+		{cfg.DigestSHA256, "drag", true, true},
+		{cfg.DigestSHA256, "xxxx", true, false},
+	}
+
+	for _, v := range cases {
+		h := util.NewHash(v.algo)
+		h.Write([]byte(testContent))
+		expected := fmt.Sprintf("%x", h.Sum(nil))
+
+		cfg.Ctx.URL = server.URL + "/range"
+		cfg.Ctx.Output = s.target("digest.test")
+		cfg.Ctx.Digest = v.algo + ":" + expected
+		cfg.Ctx.Resume = v.resume
+		ioutil.WriteFile(cfg.Ctx.Output+cfg.TempFileSuffix, []byte(v.partial), 0644)
+
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		c.Assert(err == nil, check.Equals, v.valid, check.Commentf("%v %v", v, err))
+		// the digest streamed in is the same as the one of the whole target
+		c.Assert(util.Checksum(cfg.Ctx.Output, v.algo) == expected, check.Equals, v.valid,
+			check.Commentf("%v", v))
+		dd.Cleanup()
+		os.Remove(cfg.Ctx.Output)
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithResume(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		path     string
+		partial  string
+		resume   bool
+		atomic   bool
+		resumed  int64
+		expected string
+	}{
+		{"/range", "drag", true, false, 4, testContent},
+		{"/range", "drag", false, false, 0, testContent},
+		{"/range", testContent + "x", true, false, 0, testContent},
+		{"/file", "drag", true, false, 0, testContent},
+		{"/notexist", "drag", true, false, 0, "drag"},
+		{"/range", "drag", true, true, 4, testContent},
+		{"/notexist", "drag", true, true, 0, "drag"},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Output = s.target("resume.test")
+		cfg.Ctx.Md5 = ""
+		cfg.Ctx.Resume = v.resume
+		cfg.Ctx.Atomic = v.atomic
+		// the temporary file is the one resumed if it's atomic
+		partial := cfg.Ctx.Output
+		if v.atomic {
+			partial += cfg.TempFileSuffix
+		}
+		ioutil.WriteFile(partial, []byte(v.partial), 0644)
+
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		c.Assert(err == nil, check.Equals, v.path != "/notexist", check.Commentf("%v", v))
+		c.Assert(dd.Resumed(), check.Equals, v.resumed, check.Commentf("%v", v))
+		if err == nil {
+			c.Assert(dd.Total(), check.Equals, int64(len(testContent)))
+		}
+		dd.Cleanup()
+
+		if err != nil {
+			content, _ := ioutil.ReadFile(partial)
+			c.Assert(string(content), check.Equals, v.expected, check.Commentf("%v", v))
+		} else {
+			content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+			c.Assert(string(content), check.Equals, v.expected, check.Commentf("%v", v))
+		}
+		os.Remove(cfg.Ctx.Output)
+		os.Remove(partial)
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithChecksumSidecar(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		path     string
+		digest   string
+		atomic   bool
+		resume   bool
+		expected string
+	}{
+		{"/file", "", true, false, "sha256:" + testContentSha},
+		{"/file", "", false, false, "sha256:" + testContentSha},
+		{"/file", "md5:" + testContentMd5, true, false, "md5:" + testContentMd5},
+		{"/range", "", true, true, "sha256:" + testContentSha},
+		{"/file", "md5:d41d8cd98f00b204e9800998ecf8427e", true, false, ""},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Output = s.target("sidecar.test")
+		cfg.Ctx.Digest, cfg.Ctx.Atomic, cfg.Ctx.Resume = v.digest, v.atomic, v.resume
+		cfg.Ctx.WriteChecksumSidecar = true
+		if v.resume {
+			ioutil.WriteFile(cfg.Ctx.Output+cfg.TempFileSuffix, []byte(testContent[:4]), 0644)
+		}
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+
+		matches, _ := filepath.Glob(cfg.Ctx.Output + ".*")
+		if v.expected == "" {
+			c.Assert(err, check.NotNil, check.Commentf("%v", v))
+			c.Assert(matches, check.HasLen, 0, check.Commentf("%v", v))
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+		kv := strings.SplitN(v.expected, ":", 2)
+		c.Assert(matches, check.DeepEquals, []string{cfg.Ctx.Output + "." + kv[0]})
+		content, _ := ioutil.ReadFile(matches[0])
+		c.Assert(string(content), check.Equals, kv[1]+"  sidecar.test\n")
+		os.Remove(cfg.Ctx.Output)
+		os.Remove(matches[0])
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithFallbackURLs(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	var buf bytes.Buffer
+	cfg.Ctx.ClientLogger.Out = &buf
+	cfg.Ctx.CacheDir, _ = ioutil.TempDir(s.workHome, "cache")
+
+	var cases = []struct {
+		fallbacks []string
+		notbs     bool
+		expected  string
+	}{
+		{[]string{closed.URL + "/file", server.URL + "/etag"}, false, ""},
+		{[]string{server.URL + "/file", closed.URL + "/file"}, false, ""},
+		{[]string{closed.URL + "/file", server.URL + "/notexist"}, false, ".*response code:404"},
+		{nil, false, ".*response code:404"},
+		{[]string{server.URL + "/file"}, true, "back source disabled"},
+	}
+
+	for _, v := range cases {
+		buf.Reset()
+		cfg.Ctx.URL = server.URL + "/notexist"
+		cfg.Ctx.FallbackURLs, cfg.Ctx.Notbs = v.fallbacks, v.notbs
+		cfg.Ctx.Output = s.target("fallback.test")
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+		if v.expected != "" {
+			c.Assert(err, check.ErrorMatches, v.expected, check.Commentf("%v", v))
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+		content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+		c.Assert(string(content), check.Equals, testContent)
+		// the one succeeding is logged
+		c.Assert(strings.Contains(buf.String(), "from fallback url "+dd.sourceURL),
+			check.Equals, true, check.Commentf("%v", v))
+		os.Remove(cfg.Ctx.Output)
+	}
+	// the fallback is cached as the url
+	c.Assert(newSourceCache(cfg.Ctx.CacheDir).load(server.URL+"/notexist"), check.NotNil)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithCompressOutput(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+	cfg.Ctx.CacheDir, _ = ioutil.TempDir(s.workHome, "cache")
+
+	var cases = []struct {
+		path   string
+		md5    string
+		atomic bool
+		valid  bool
+	}{
+		{"/file", testContentMd5, true, true},
+		{"/etag", testContentMd5, false, true},
+		{"/file", "d41d8cd98f00b204e9800998ecf8427e", true, false},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Output = s.target("compress.test.gz")
+		cfg.Ctx.Md5, cfg.Ctx.Atomic, cfg.Ctx.CompressOutput = v.md5, v.atomic, true
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+		if !v.valid {
+			c.Assert(err, check.ErrorMatches, "md5 not match.*", check.Commentf("%v", v))
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+		c.Assert(dd.Total(), check.Equals, int64(len(testContent)))
+
+		f, _ := os.Open(cfg.Ctx.Output)
+		gr, err := gzip.NewReader(f)
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+		content, _ := ioutil.ReadAll(gr)
+		f.Close()
+		c.Assert(string(content), check.Equals, testContent)
+		// the compressed output is verified after decompressed
+		c.Assert(NewDirectDownloader(cfg.Ctx).Verify(context.Background()), check.IsNil)
+		os.Remove(cfg.Ctx.Output)
+	}
+	// the compressed one isn't cached as the content of the source
+	c.Assert(newSourceCache(cfg.Ctx.CacheDir).load(server.URL+"/etag"), check.IsNil)
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithOutputOwner(c *check.C) {
+	if os.Geteuid() != 0 {
+		c.Skip("changing the owner of output requires root")
+	}
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		uid     string
+		gid     string
+		sidecar bool
+		expUID  uint32
+		expGID  uint32
+	}{
+		{"", "", false, 0, 0},
+		{"65534", "", false, 65534, 0},
+		{"", "65534", true, 0, 65534},
+		{"65534", "65534", true, 65534, 65534},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + "/file"
+		cfg.Ctx.Output = s.target("owner.test")
+		cfg.Ctx.OutputUID, cfg.Ctx.OutputGID = v.uid, v.gid
+		cfg.Ctx.WriteChecksumSidecar = v.sidecar
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+
+		files := []string{cfg.Ctx.Output}
+		if v.sidecar {
+			files = append(files, cfg.Ctx.Output+".sha256")
+		}
+		for _, f := range files {
+			info, err := os.Stat(f)
+			c.Assert(err, check.IsNil)
+			st := info.Sys().(*syscall.Stat_t)
+			c.Assert([]uint32{st.Uid, st.Gid}, check.DeepEquals,
+				[]uint32{v.expUID, v.expGID}, check.Commentf("%v %s", v, f))
+			os.Remove(f)
+		}
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunAtomic(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		path   string
+		atomic bool
+		md5    string
+		valid  bool
+	}{
+		{"/file", true, "", true},
+		{"/file", false, "", true},
+		{"/file", true, "d41d8cd98f00b204e9800998ecf8427e", false},
+		{"/notexist", true, "", false},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL + v.path
+		cfg.Ctx.Output = s.target("atomic.test")
+		cfg.Ctx.Atomic = v.atomic
+		cfg.Ctx.Md5 = v.md5
+		var partial bool
+		// the partial file is never observed at the output if it's atomic
+		cfg.Ctx.OnProgress = func(done, total int64) {
+			_, err := os.Stat(cfg.Ctx.Output)
+			partial = partial || err == nil
+		}
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+		c.Assert(err == nil, check.Equals, v.valid, check.Commentf("%v %v", v, err))
+		c.Assert(partial, check.Equals, v.valid && !v.atomic, check.Commentf("%v", v))
+
+		content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+		if v.valid {
+			c.Assert(string(content), check.Equals, testContent)
+		} else {
+			c.Assert(content, check.IsNil)
+		}
+		// the temporary file is removed whether it succeeds or not
+		_, err = os.Stat(cfg.Ctx.Output + cfg.TempFileSuffix)
+		c.Assert(os.IsNotExist(err), check.Equals, true, check.Commentf("%v", v))
+		os.Remove(cfg.Ctx.Output)
+	}
+}
@@ -20,3 +20,16 @@
 // DirectDownloader downloads files from file source directly. It's
 // used when P2PDownloader download files failed.
 package downloader
+
+import (
+	"context"
+)
+
+// Downloader is the interface to download files.
+type Downloader interface {
+	// Run downloads the file to the target path, and it's aborted once
+	// ctx is done.
+	Run(ctx context.Context) error
+	// Cleanup removes all the temporary files created by Run.
+	Cleanup()
+}
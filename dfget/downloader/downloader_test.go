@@ -15,3 +15,47 @@
  */
 
 package downloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type DownloaderSuite struct {
+	workHome string
+}
+
+func init() {
+	check.Suite(&DownloaderSuite{})
+}
+
+func (s *DownloaderSuite) SetUpSuite(c *check.C) {
+	s.workHome, _ = ioutil.TempDir("/tmp", "dfget-DownloaderSuite-")
+}
+
+func (s *DownloaderSuite) TearDownSuite(c *check.C) {
+	if s.workHome != "" {
+		os.RemoveAll(s.workHome)
+	}
+}
+
+func (s *DownloaderSuite) SetUpTest(c *check.C) {
+	cfg.Reset()
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.ServerLogger = cfg.Ctx.ClientLogger
+}
+
+func (s *DownloaderSuite) target(name string) string {
+	return filepath.Join(s.workHome, name)
+}
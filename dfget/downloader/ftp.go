@@ -0,0 +1,301 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+)
+
+const (
+	ftpDefaultPort  = "21"
+	ftpsDefaultPort = "990"
+	ftpDialTimeout  = 5 * time.Second
+
+	ftpAnonymousUser     = "anonymous"
+	ftpAnonymousPassword = "anonymous@"
+)
+
+// ftpReader reads a file from the ftp server through the data connection,
+// and the control connection is closed along with it.
+type ftpReader struct {
+	data net.Conn
+	ctrl *textproto.Conn
+	done bool
+}
+
+// Read reads data from the data connection. The transfer result replied by
+// the server is checked when the data connection reaches EOF.
+func (r *ftpReader) Read(p []byte) (n int, err error) {
+	n, err = r.data.Read(p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.done = true
+		if _, _, e := r.ctrl.ReadResponse(2); e != nil {
+			return n, fmt.Errorf("ftp transfer error: %v", e)
+		}
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// Close closes both the data connection and the control connection.
+func (r *ftpReader) Close() error {
+	r.data.Close()
+	if !r.done {
+		r.ctrl.ReadResponse(0)
+	}
+	r.ctrl.Cmd("QUIT")
+	return r.ctrl.Close()
+}
+
+// openFTP logs in the ftp server with the user info of the url, anonymous
+// if not specified, and starts retrieving the file in passive mode from
+// offset, and start is where the reader starts from, which is 0 if the
+// server doesn't support REST. The ftps scheme uses implicit TLS for both
+// control and data connections, which is configured by sourceTLS if it's
+// not nil.
+func openFTP(ctx context.Context, u *url.URL, offset int64, sourceTLS *tls.Config) (
+	reader io.ReadCloser, start int64, err error) {
+	ctrl, tlsConfig, err := loginFTP(ctx, u, sourceTLS)
+	if err != nil {
+		return nil, 0, err
+	}
+	r, start, err := retrieveFTP(ctx, ctrl, u, offset, tlsConfig)
+	if err != nil {
+		ctrl.Close()
+		return nil, 0, fmt.Errorf("retrieve %s from ftp server[%s] error: %v",
+			u.Path, u.Host, err)
+	}
+	return r, start, nil
+}
+
+// sizeFTP returns the size of the file on the ftp server.
+func sizeFTP(ctx context.Context, u *url.URL, sourceTLS *tls.Config) (int64, error) {
+	ctrl, _, err := loginFTP(ctx, u, sourceTLS)
+	if err != nil {
+		return 0, err
+	}
+	defer ctrl.Close()
+	defer ctrl.Cmd("QUIT")
+
+	_, msg, err := ftpCmd(ctrl, 213, "SIZE %s", strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		return 0, fmt.Errorf("get size of %s from ftp server[%s] error: %v",
+			u.Path, u.Host, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+// loginFTP connects to the ftp server and logs in, and the transfer type
+// is set to binary.
+func loginFTP(ctx context.Context, u *url.URL, sourceTLS *tls.Config) (*textproto.Conn, *tls.Config, error) {
+	var tlsConfig *tls.Config
+	port := ftpDefaultPort
+	if strings.EqualFold(u.Scheme, cfg.SchemaFTPS) {
+		port = ftpsDefaultPort
+		tlsConfig = ftpsConfig(u, sourceTLS)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	conn, err := dialFTP(ctx, net.JoinHostPort(u.Hostname(), port), tlsConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to ftp server[%s] error: %v", u.Host, err)
+	}
+	ctrl := textproto.NewConn(conn)
+	if err := initFTP(ctrl, u, tlsConfig); err != nil {
+		ctrl.Close()
+		return nil, nil, fmt.Errorf("login ftp server[%s] error: %v", u.Host, err)
+	}
+	return ctrl, tlsConfig, nil
+}
+
+// ftpsConfig returns the tls config of the ftps server of u, which is a copy
+// of sourceTLS if it's not nil, so that the client certificate, the CA bundle
+// and Insecure apply as they do to https. The session is cached for the data
+// connection to resume the one of the control connection.
+func ftpsConfig(u *url.URL, sourceTLS *tls.Config) *tls.Config {
+	config := &tls.Config{}
+	if sourceTLS != nil {
+		config = sourceTLS.Clone()
+	}
+	config.ServerName = u.Hostname()
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	return config
+}
+
+func initFTP(ctrl *textproto.Conn, u *url.URL, tlsConfig *tls.Config) error {
+	if _, _, err := ctrl.ReadResponse(2); err != nil {
+		return err
+	}
+
+	user, password := ftpAnonymousUser, ftpAnonymousPassword
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+	code, msg, err := ftpCmd(ctrl, 0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, _, err = ftpCmd(ctrl, 2, "PASS %s", password); err != nil {
+			return err
+		}
+	} else if code/100 != 2 {
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+
+	if tlsConfig != nil {
+		if _, _, err = ftpCmd(ctrl, 2, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, _, err = ftpCmd(ctrl, 2, "PROT P"); err != nil {
+			return err
+		}
+	}
+	_, _, err = ftpCmd(ctrl, 2, "TYPE I")
+	return err
+}
+
+func retrieveFTP(ctx context.Context, ctrl *textproto.Conn, u *url.URL, offset int64, tlsConfig *tls.Config) (
+	*ftpReader, int64, error) {
+	_, msg, err := ftpCmd(ctrl, 227, "PASV")
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := parsePasvPort(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the address replied by PASV is ignored and the host of control
+	// connection is used, because the former may be unreachable behind NAT
+	data, err := dialFTP(ctx, net.JoinHostPort(u.Hostname(), port), tlsConfig)
+	if err != nil {
+		return nil, 0, err
+	}
+	// REST is sent right before RETR, and the file is retrieved from the
+	// beginning if the server rejects it
+	var start int64
+	if offset > 0 {
+		_, _, err = ftpCmd(ctrl, 350, "REST %d", offset)
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			data.Close()
+			return nil, 0, err
+		}
+		if err == nil {
+			start = offset
+		}
+	}
+	if _, _, err = ftpCmd(ctrl, 1, "RETR %s", strings.TrimPrefix(u.Path, "/")); err != nil {
+		data.Close()
+		return nil, 0, err
+	}
+	return &ftpReader{data: data, ctrl: ctrl}, start, nil
+}
+
+// dialFTP connects to the addr, and the deadline of ctx is applied to all
+// the reads and writes on the connection. The connection is closed once ctx
+// is done, so that the blocked reads and writes are aborted on cancellation.
+func dialFTP(ctx context.Context, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: ftpDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if ctx.Done() != nil {
+		conn = closeOnDone(ctx, conn)
+	}
+	if tlsConfig == nil {
+		return conn, nil
+	}
+	return tls.Client(conn, tlsConfig), nil
+}
+
+// ctxConn is the connection closed once its context is done.
+type ctxConn struct {
+	net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// closeOnDone closes conn once ctx is done, and the goroutine watching ctx
+// exits once the returned connection is closed.
+func closeOnDone(ctx context.Context, conn net.Conn) net.Conn {
+	c := &ctxConn{Conn: conn, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.closed:
+		}
+	}()
+	return c
+}
+
+func (c *ctxConn) Close() error {
+	err := fmt.Errorf("close of closed connection")
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func ftpCmd(ctrl *textproto.Conn, expectCode int, format string, args ...interface{}) (
+	int, string, error) {
+	if _, err := ctrl.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return ctrl.ReadResponse(expectCode)
+}
+
+// parsePasvPort parses the port from the reply of PASV command,
+// such as: 227 Entering Passive Mode (127,0,0,1,195,80).
+func parsePasvPort(msg string) (string, error) {
+	start, end := strings.IndexByte(msg, '('), strings.LastIndexByte(msg, ')')
+	if start < 0 || end < start {
+		return "", fmt.Errorf("invalid pasv reply: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return "", fmt.Errorf("invalid pasv reply: %s", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("invalid pasv reply: %s", msg)
+	}
+	return strconv.Itoa(p1<<8 + p2), nil
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+// startFTPServer starts a fake ftp server serving only one file
+// and returns its address.
+func startFTPServer(c *check.C, file, content string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var (
+			dataLn net.Listener
+			offset int
+		)
+		r := bufio.NewReader(conn)
+		reply := func(msg string) { fmt.Fprintf(conn, "%s\r\n", msg) }
+		reply("220 welcome")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			switch fields[0] {
+			case "USER":
+				reply("331 password required")
+			case "PASS":
+				reply("230 logged in")
+			case "TYPE":
+				reply("200 type set")
+			case "PASV":
+				dataLn, _ = net.Listen("tcp", "127.0.0.1:0")
+				port := dataLn.Addr().(*net.TCPAddr).Port
+				reply(fmt.Sprintf("227 Entering Passive Mode (10,0,0,1,%d,%d).",
+					port>>8, port&0xff))
+			case "REST":
+				if offset, err = strconv.Atoi(fields[1]); err != nil || offset > len(content) {
+					offset = 0
+					reply("501 invalid offset")
+					continue
+				}
+				reply("350 restarting")
+			case "RETR":
+				data, err := dataLn.Accept()
+				dataLn.Close()
+				if err != nil {
+					return
+				}
+				if len(fields) < 2 || fields[1] != file {
+					data.Close()
+					reply("550 file not found")
+					continue
+				}
+				reply("150 opening data connection")
+				fmt.Fprint(data, content[offset:])
+				offset = 0
+				data.Close()
+				reply("226 transfer complete")
+			case "SIZE":
+				if len(fields) < 2 || fields[1] != file {
+					reply("550 file not found")
+					continue
+				}
+				reply(fmt.Sprintf("213 %d", len(content)))
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunFTP(c *check.C) {
+	addr := startFTPServer(c, "pub/file", testContent)
+	cfg.Ctx.URL = fmt.Sprintf("ftp://user:pass@%s/pub/file", addr)
+	cfg.Ctx.Output = s.target("ftp.test")
+	cfg.Ctx.Md5 = testContentMd5
+
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	dd.Cleanup()
+	content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+	c.Assert(string(content), check.Equals, testContent)
+
+	addr = startFTPServer(c, "pub/file", testContent)
+	cfg.Ctx.URL = fmt.Sprintf("ftp://%s/pub/notexist", addr)
+	dd = NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.ErrorMatches, ".*550.*file not found.*")
+	dd.Cleanup()
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunFTPResume(c *check.C) {
+	cfg.Ctx.Output = s.target("ftp.test")
+	cfg.Ctx.Md5 = testContentMd5
+	cfg.Ctx.Resume = true
+	for _, existing := range []string{testContent[:4], "x" + testContent} {
+		c.Assert(ioutil.WriteFile(cfg.Ctx.Output+cfg.TempFileSuffix, []byte(existing), 0644), check.IsNil)
+		addr := startFTPServer(c, "pub/file", testContent)
+		cfg.Ctx.URL = fmt.Sprintf("ftp://%s/pub/file", addr)
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		dd.Cleanup()
+		c.Assert(err, check.IsNil, check.Commentf("%s", existing))
+		content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+		c.Assert(string(content), check.Equals, testContent)
+		// the server rejects the offset beyond the file, which is retrieved
+		// from the beginning then
+		resumed := int64(len(existing))
+		if resumed > int64(len(testContent)) {
+			resumed = 0
+		}
+		c.Assert(dd.Resumed(), check.Equals, resumed)
+		os.Remove(cfg.Ctx.Output)
+	}
+}
+
+func (s *DownloaderSuite) TestStatSource_FTP(c *check.C) {
+	addr := startFTPServer(c, "pub/file", testContent)
+	cfg.Ctx.URL = fmt.Sprintf("ftp://%s/pub/file", addr)
+	length, err := StatSource(context.Background(), cfg.Ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(length, check.Equals, int64(len(testContent)))
+
+	addr = startFTPServer(c, "pub/file", testContent)
+	cfg.Ctx.URL = fmt.Sprintf("ftp://%s/pub/notexist", addr)
+	_, err = StatSource(context.Background(), cfg.Ctx)
+	c.Assert(err, check.ErrorMatches, ".*550.*file not found.*")
+}
+
+func (s *DownloaderSuite) TestDialFTP_Cancel(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	go func() {
+		// the connection is accepted but nothing is replied
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			ioutil.ReadAll(conn)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := dialFTP(ctx, ln.Addr().String(), nil)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+	done := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+	cancel()
+	select {
+	case err = <-done:
+		c.Assert(err, check.NotNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("the read isn't aborted on cancellation")
+	}
+}
+
+func (s *DownloaderSuite) TestFTPSConfig(c *check.C) {
+	u, _ := url.Parse("ftps://a.b:2121/c")
+	config := ftpsConfig(u, nil)
+	c.Assert(config.ServerName, check.Equals, "a.b")
+	c.Assert(config.InsecureSkipVerify, check.Equals, false)
+	c.Assert(config.ClientSessionCache, check.NotNil)
+
+	// the tls options of the source apply to ftps as well
+	cfg.Ctx.Insecure = true
+	sc := newSourceClient(cfg.Ctx)
+	c.Assert(sc.tlsConfig, check.NotNil)
+	config = ftpsConfig(u, sc.tlsConfig)
+	c.Assert(config.InsecureSkipVerify, check.Equals, true)
+	c.Assert(config.ServerName, check.Equals, "a.b")
+	// the config of the source isn't changed
+	c.Assert(sc.tlsConfig.ServerName, check.Equals, "")
+}
+
+func (s *DownloaderSuite) TestParsePasvPort(c *check.C) {
+	var cases = map[string]string{
+		"Entering Passive Mode (127,0,0,1,195,80).": "50000",
+		"Entering Passive Mode (127,0,0,1,0,21)":    "21",
+		"Entering Passive Mode":                     "",
+		"Entering Passive Mode (127,0,0,1,195)":     "",
+		"Entering Passive Mode (127,0,0,1,a,80)":    "",
+	}
+
+	for k, v := range cases {
+		port, err := parsePasvPort(k)
+		c.Assert(port, check.Equals, v)
+		c.Assert(err == nil, check.Equals, v != "")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build go1.13
+// +build go1.13
+
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import "net/http"
+
+// forceHTTP2Supported reports whether the transport can attempt HTTP/2 with
+// the custom tls config and dialer, which requires go1.13.
+const forceHTTP2Supported = true
+
+// forceHTTP2 makes t attempt HTTP/2 in spite of the custom tls config and
+// dialer.
+func forceHTTP2(t *http.Transport) {
+	t.ForceAttemptHTTP2 = true
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+)
+
+// progressInterval is the minimum interval between the json progress events
+// except the final one.
+const progressInterval = 500 * time.Millisecond
+
+const (
+	progressSuccess = "success"
+	progressFailed  = "failed"
+)
+
+// progressEvent is the json progress event, the total is -1 if it's unknown
+// and the rate is in bytes per second. Status and Error are carried only by
+// the final event.
+type progressEvent struct {
+	URL    string `json:"url"`
+	Done   int64  `json:"done"`
+	Total  int64  `json:"total"`
+	Rate   int64  `json:"rate"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// jsonProgress writes the progress events of a download as newline-delimited
+// json, each of which is written by a single call to out.
+type jsonProgress struct {
+	out io.Writer
+	url string
+	now func() time.Time
+
+	start   time.Time
+	last    time.Time
+	resumed int64
+	done    int64
+	total   int64
+}
+
+func newJSONProgress(out io.Writer, url string) *jsonProgress {
+	return &jsonProgress{out: out, url: url, now: cfg.DefaultClock.Now, total: -1}
+}
+
+// begin starts the progress of the source opened, and the resumed bytes are
+// not counted in the rate.
+func (p *jsonProgress) begin(resumed, total int64) {
+	p.start, p.last = p.now(), p.now()
+	p.resumed, p.done, p.total = resumed, resumed, total
+}
+
+// update writes an event if progressInterval passed since the last one.
+func (p *jsonProgress) update(done, total int64) {
+	p.done, p.total = done, total
+	if now := p.now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.write(&progressEvent{})
+	}
+}
+
+// finish writes the final event with the result of the download.
+func (p *jsonProgress) finish(err error) {
+	e := &progressEvent{Status: progressSuccess}
+	if err != nil {
+		e.Status, e.Error = progressFailed, err.Error()
+	}
+	p.write(e)
+}
+
+func (p *jsonProgress) write(e *progressEvent) {
+	e.URL, e.Done, e.Total = p.url, p.done, p.total
+	if !p.start.IsZero() {
+		if elapsed := p.now().Sub(p.start).Seconds(); elapsed > 0 {
+			e.Rate = int64(float64(p.done-p.resumed) / elapsed)
+		}
+	}
+	data, _ := json.Marshal(e)
+	p.out.Write(append(data, '\n'))
+}
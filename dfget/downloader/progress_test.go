@@ -0,0 +1,103 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+// decodeProgress decodes the newline-delimited json progress events.
+func decodeProgress(c *check.C, out string) []progressEvent {
+	var events []progressEvent
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		var e progressEvent
+		c.Assert(json.Unmarshal([]byte(line), &e), check.IsNil, check.Commentf("%s", line))
+		events = append(events, e)
+	}
+	return events
+}
+
+func (s *DownloaderSuite) TestJSONProgress(c *check.C) {
+	var (
+		out bytes.Buffer
+		now = time.Unix(0, 0)
+	)
+	p := newJSONProgress(&out, "http://a.b/c")
+	p.now = func() time.Time { return now }
+	p.begin(100, 1100)
+
+	now = now.Add(progressInterval / 2)
+	p.update(200, 1100)
+	c.Assert(out.Len(), check.Equals, 0)
+	now = now.Add(progressInterval / 2)
+	p.update(600, 1100)
+	now = now.Add(progressInterval / 2)
+	p.update(1000, 1100)
+	now = now.Add(progressInterval / 2)
+	p.update(1100, 1100)
+	p.finish(nil)
+	p.finish(fmt.Errorf("invalid md5"))
+
+	c.Assert(decodeProgress(c, out.String()), check.DeepEquals, []progressEvent{
+		{URL: "http://a.b/c", Done: 600, Total: 1100, Rate: 1000},
+		{URL: "http://a.b/c", Done: 1100, Total: 1100, Rate: 1000},
+		{URL: "http://a.b/c", Done: 1100, Total: 1100, Rate: 1000, Status: progressSuccess},
+		{URL: "http://a.b/c", Done: 1100, Total: 1100, Rate: 1000, Status: progressFailed,
+			Error: "invalid md5"},
+	})
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithProgressJSON(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		url    string
+		status string
+		done   int64
+	}{
+		{server.URL + "/file", progressSuccess, int64(len(testContent))},
+		{server.URL + "/notexist", progressFailed, 0},
+	}
+
+	for _, v := range cases {
+		var out bytes.Buffer
+		called := 0
+		cfg.Ctx.URL = v.url
+		cfg.Ctx.Output = s.target("progressjson.test")
+		cfg.Ctx.ProgressJSON = true
+		cfg.Ctx.OnProgress = func(done, total int64) { called++ }
+		dd := NewDirectDownloader(cfg.Ctx)
+		dd.progress.out = &out
+		dd.Run(context.Background())
+
+		events := decodeProgress(c, out.String())
+		last := events[len(events)-1]
+		c.Assert(last.Status, check.Equals, v.status, check.Commentf("%v", v))
+		c.Assert(last.Done, check.Equals, v.done, check.Commentf("%v", v))
+		c.Assert(last.URL, check.Equals, v.url)
+		c.Assert(called > 0, check.Equals, v.done > 0, check.Commentf("%v", v))
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// proxyFunc returns the proxy of the requests to source. They're sent
+// through the proxy if it's not empty, otherwise through the ones of the
+// environment variables HTTP_PROXY and HTTPS_PROXY. The hosts matching
+// NO_PROXY are always requested directly.
+func proxyFunc(proxy string) func(*http.Request) (*url.URL, error) {
+	if util.IsEmptyStr(proxy) {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, err := url.Parse(proxy)
+	noProxy := getEnvAny("NO_PROXY", "no_proxy")
+	return func(req *http.Request) (*url.URL, error) {
+		if err != nil || !useProxy(req.URL, noProxy) {
+			return nil, err
+		}
+		return proxyURL, nil
+	}
+}
+
+// useProxy reports whether the url should be requested through proxy with
+// the comma-separated NO_PROXY. The entries of NO_PROXY are '*', ip, cidr,
+// or domain which matches itself and its subdomains, and they can be
+// followed by a port.
+func useProxy(u *url.URL, noProxy string) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if util.IsEmptyStr(port) {
+		port = defaultPort(u.Scheme)
+	}
+	ip := net.ParseIP(host)
+	for _, p := range strings.Split(strings.ToLower(noProxy), ",") {
+		p = strings.TrimSpace(p)
+		if util.IsEmptyStr(p) {
+			continue
+		}
+		if p == "*" {
+			return false
+		}
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if ip != nil && n.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		if h, pp, err := net.SplitHostPort(p); err == nil {
+			if pp != port {
+				continue
+			}
+			p = h
+		}
+		p = strings.TrimPrefix(strings.Trim(p, "[]"), ".")
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return false
+		}
+	}
+	return true
+}
+
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); !util.IsEmptyStr(v) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+func (s *DownloaderSuite) TestUseProxy(c *check.C) {
+	var cases = []struct {
+		url      string
+		noProxy  string
+		expected bool
+	}{
+		{"http://a.b/c", "", true},
+		{"http://a.b/c", "*", false},
+		{"http://a.b/c", "x.y, a.b", false},
+		{"http://A.B/c", "a.b", false},
+		{"http://c.a.b/c", "a.b", false},
+		{"http://c.a.b/c", ".a.b", false},
+		{"http://ca.b/c", "a.b", true},
+		{"http://a.b:8080/c", "a.b:8080", false},
+		{"http://a.b/c", "a.b:8080", true},
+		{"http://a.b/c", "a.b:80", false},
+		{"https://a.b/c", "a.b:443", false},
+		{"http://10.1.2.3/c", "10.0.0.0/8", false},
+		{"http://11.1.2.3/c", "10.0.0.0/8", true},
+		{"http://10.1.2.3/c", "10.1.2.3", false},
+		{"http://[::1]:8080/c", "[::1]:8080", false},
+		{"http://[::1]/c", "::1", false},
+	}
+
+	for _, v := range cases {
+		u, _ := url.Parse(v.url)
+		c.Assert(useProxy(u, v.noProxy), check.Equals, v.expected, check.Commentf("%v", v))
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_Proxy(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "proxied %s", r.URL)
+	}))
+	defer proxy.Close()
+
+	defer os.Setenv("NO_PROXY", os.Getenv("NO_PROXY"))
+	var cases = []struct {
+		proxy    string
+		noProxy  string
+		expected string
+	}{
+		{"", "", testContent},
+		{proxy.URL, "", "proxied " + server.URL + "/file"},
+		{proxy.URL, "127.0.0.1", testContent},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.Proxy = v.proxy
+		os.Setenv("NO_PROXY", v.noProxy)
+		reader, err := newSourceClient(cfg.Ctx).open(context.Background(), server.URL+"/file", 0)
+		c.Assert(err, check.IsNil)
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		c.Assert(string(content), check.Equals, v.expected, check.Commentf("%v", v))
+	}
+}
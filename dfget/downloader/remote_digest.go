@@ -0,0 +1,123 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// maxRemoteDigestSize is the most bytes read from the remote digest, which
+// is enough for the hex followed by the file name like sha256sum.
+const maxRemoteDigestSize = 4 * 1024
+
+// remoteDigestURL returns the url of the digest published beside rawURL,
+// which is the path of rawURL suffixed with '.<algo>', e.g.
+// 'http://a.b/c.tar.gz.md5', and the query is kept as is.
+func remoteDigestURL(rawURL, algo string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("parse url[%s] error: %v", rawURL, err)
+	}
+	u.Path += "." + algo
+	if u.RawPath != "" {
+		u.RawPath += "." + algo
+	}
+	return u.String(), nil
+}
+
+// fetchRemoteDigest requests the digest published beside URL if
+// FetchRemoteDigest is set, and Digest is set to it so that the content is
+// verified against it. The algo is the one of Digest, or md5 if it's empty,
+// and the remote digest must match Digest if it's specified. The digest is
+// the first field of the response, so both the plain hex and the output of
+// md5sum are accepted. If the source replies 404, Digest is kept as is
+// unless RequireRemoteDigest is set. The digest beside each of FallbackURLs
+// is requested in order once the previous one fails, as openSource does.
+func (dd *DirectDownloader) fetchRemoteDigest(ctx context.Context) error {
+	if !dd.ctx.FetchRemoteDigest {
+		return nil
+	}
+	algo, expected := cfg.DigestMD5, ""
+	if !util.IsEmptyStr(dd.Digest) {
+		var err error
+		if algo, expected, err = cfg.ParseDigest(dd.Digest); err != nil {
+			return err
+		}
+	}
+	hex, err := dd.fetchDigest(ctx, dd.URL, algo)
+	for _, u := range dd.ctx.FallbackURLs {
+		if err == nil || ctx.Err() != nil || err == errors.ErrBackSourceDisabled || dd.source.err != nil {
+			break
+		}
+		dd.ctx.ClientLogger.Warnf("%v, fall back to the remote digest of %s", err, cfg.RedactURL(u))
+		hex, err = dd.fetchDigest(ctx, u, algo)
+	}
+	if err != nil || util.IsEmptyStr(hex) {
+		return err
+	}
+	if !util.IsEmptyStr(expected) && hex != expected {
+		return fmt.Errorf("remote digest[%s:%s] conflicts with digest[%s]", algo, hex, dd.Digest)
+	}
+	dd.Digest = algo + ":" + hex
+	dd.ctx.ClientLogger.Infof("verify %s with remote digest[%s]", cfg.RedactURL(dd.URL), dd.Digest)
+	return nil
+}
+
+// fetchDigest returns the hex of the digest of algo published beside rawURL,
+// and it's empty if the source replies 404 unless RequireRemoteDigest is set.
+func (dd *DirectDownloader) fetchDigest(ctx context.Context, rawURL, algo string) (string, error) {
+	digestURL, err := remoteDigestURL(rawURL, algo)
+	if err != nil {
+		return "", err
+	}
+	src, err := dd.source.open(ctx, digestURL, 0)
+	if e, ok := err.(*errors.SourceStatusError); ok && e.Code == http.StatusNotFound && !dd.ctx.RequireRemoteDigest {
+		dd.ctx.ClientLogger.Warnf("remote digest %s not found, verify with digest[%s] only",
+			cfg.RedactURL(digestURL), dd.Digest)
+		return "", nil
+	}
+	if err == errors.ErrBackSourceDisabled {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("fetch remote digest %s error: %v", cfg.RedactURL(digestURL), err)
+	}
+	defer src.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(src, maxRemoteDigestSize))
+	if err != nil {
+		return "", fmt.Errorf("read remote digest %s error: %v", cfg.RedactURL(digestURL), err)
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("remote digest %s is empty", cfg.RedactURL(digestURL))
+	}
+	_, hex, err := cfg.ParseDigest(algo + ":" + fields[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid remote digest %s: %v", cfg.RedactURL(digestURL), err)
+	}
+	return hex, nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+func (s *DownloaderSuite) TestRemoteDigestURL(c *check.C) {
+	var cases = map[string]string{
+		"http://a.b/c.tar.gz":     "http://a.b/c.tar.gz.md5",
+		"http://a.b/c?x=1":        "http://a.b/c.md5?x=1",
+		"https://a.b/c%2Fd?x=1#y": "https://a.b/c%2Fd.md5?x=1#y",
+	}
+	for k, v := range cases {
+		u, err := remoteDigestURL(k, cfg.DigestMD5)
+		c.Assert(err, check.IsNil)
+		c.Assert(u, check.Equals, v)
+	}
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithRemoteDigest(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file", "/nodigest", "/wrong":
+			fmt.Fprint(w, testContent)
+		case "/file.md5":
+			fmt.Fprintf(w, "%s  file\n", testContentMd5)
+		case "/file.sha256":
+			fmt.Fprint(w, strings.ToUpper(testContentSha))
+		case "/wrong.md5":
+			fmt.Fprint(w, strings.Repeat("0", 32))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	cfg.Ctx.Output = s.target("remote_digest.test")
+	cfg.Ctx.FetchRemoteDigest = true
+	var cases = []struct {
+		path     string
+		digest   string
+		require  bool
+		err      string
+		expected string
+	}{
+		{"/file", "", false, "", "md5:" + testContentMd5},
+		{"/file", "sha256:" + testContentSha, false, "", "sha256:" + testContentSha},
+		{"/file", "md5:" + strings.Repeat("1", 32), false, "remote digest.*conflicts with digest.*", ""},
+		{"/nodigest", "", false, "", ""},
+		{"/nodigest", "", true, "fetch remote digest.*response code:404", ""},
+		{"/wrong", "", false, "md5 not match.*", ""},
+	}
+	for _, v := range cases {
+		cfg.Ctx.URL, cfg.Ctx.Digest, cfg.Ctx.RequireRemoteDigest = server.URL+v.path, v.digest, v.require
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		if v.err != "" {
+			c.Assert(err, check.ErrorMatches, v.err, check.Commentf("%v", v))
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+		c.Assert(dd.Digest, check.Equals, v.expected, check.Commentf("%v", v))
+	}
+
+	// the existing output is verified with the remote digest as well
+	cfg.Ctx.URL, cfg.Ctx.Digest, cfg.Ctx.RequireRemoteDigest = server.URL+"/file", "", true
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	cfg.Ctx.URL = server.URL + "/wrong"
+	dd = NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Verify(context.Background()), check.ErrorMatches, "md5 not match.*")
+}
+
+func (s *DownloaderSuite) TestDirectDownloader_RunWithRemoteDigestFallback(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			fmt.Fprint(w, testContent)
+		case "/file.md5":
+			fmt.Fprint(w, testContentMd5)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// the digest is fetched from the fallback once the primary is dead
+	cfg.Ctx.URL = "http://127.0.0.1:1/file"
+	cfg.Ctx.FallbackURLs = []string{server.URL + "/file"}
+	cfg.Ctx.Output = s.target("remote_digest.test")
+	cfg.Ctx.FetchRemoteDigest = true
+	cfg.Ctx.RequireRemoteDigest = true
+	dd := NewDirectDownloader(cfg.Ctx)
+	c.Assert(dd.Run(context.Background()), check.IsNil)
+	c.Assert(dd.Digest, check.Equals, "md5:"+testContentMd5)
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+)
+
+const (
+	s3AccessKeyEnv    = "AWS_ACCESS_KEY_ID"
+	s3SecretKeyEnv    = "AWS_SECRET_ACCESS_KEY"
+	s3SessionTokenEnv = "AWS_SESSION_TOKEN"
+
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3Service    = "s3"
+	s3TimeFormat = "20060102T150405Z"
+	// s3EmptyPayloadHash is the sha256 of the empty body of GET and HEAD.
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3ObjectURL returns the path-style url of the object of the s3 url in the
+// format of 's3://bucket/key' on the endpoint.
+func s3ObjectURL(endpoint, rawURL string) (*url.URL, error) {
+	bucket, key, err := cfg.ParseS3URL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse s3 endpoint error: %v", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	return u, nil
+}
+
+// s3Credentials is the credential read from the environment variables.
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// s3CredentialsFromEnv returns nil if the access key or the secret key is not
+// set, and the requests are anonymous.
+func s3CredentialsFromEnv() *s3Credentials {
+	c := &s3Credentials{
+		accessKey:    os.Getenv(s3AccessKeyEnv),
+		secretKey:    os.Getenv(s3SecretKeyEnv),
+		sessionToken: os.Getenv(s3SessionTokenEnv),
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil
+	}
+	return c
+}
+
+// s3Transport signs the requests to the host of the S3-compatible endpoint
+// with signature v4, and the requests to the other hosts, e.g. the ones
+// redirected to, are sent as they are.
+type s3Transport struct {
+	base   http.RoundTripper
+	host   string
+	region string
+	// now returns the signing time, it's replaceable for tests.
+	now func() time.Time
+}
+
+func newS3Transport(base http.RoundTripper, endpoint, region string) (*s3Transport, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse s3 endpoint error: %v", err)
+	}
+	if region == "" {
+		region = cfg.DefaultS3Region
+	}
+	return &s3Transport{base: base, host: u.Host, region: region, now: cfg.DefaultClock.Now}, nil
+}
+
+// RoundTrip signs a copy of the request, since the original one mustn't be
+// modified by a RoundTripper.
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds := s3CredentialsFromEnv()
+	if creds == nil || !strings.EqualFold(req.URL.Host, t.host) {
+		return t.base.RoundTrip(req)
+	}
+	signed := new(http.Request)
+	*signed = *req
+	signed.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		signed.Header[k] = append([]string(nil), v...)
+	}
+	signS3Request(signed, creds, t.region, t.now())
+	return t.base.RoundTrip(signed)
+}
+
+// signS3Request sets the Authorization of the request with signature v4, the
+// signed headers are host, range and the x-amz-* ones.
+func signS3Request(req *http.Request, creds *s3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3EmptyPayloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, region, s3Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	for _, s := range []string{region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, creds.accessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalQuery returns the query sorted by the names, and the names and
+// values are escaped by s3Escape.
+func s3CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for k, vs := range query {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape escapes everything except the unreserved characters of RFC 3986,
+// and the slashes are kept unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
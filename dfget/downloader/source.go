@@ -0,0 +1,574 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// requestIDHeader carries the RequestID of the runtime context to source if
+// TraceRequests is set.
+const requestIDHeader = "X-Request-Id"
+
+// sourceExpectContinueTimeout is how long the request to source with Expect100
+// waits for 100 Continue before sending its body.
+const sourceExpectContinueTimeout = 1 * time.Second
+
+// source is the reader of the opened file source.
+type source struct {
+	io.ReadCloser
+	// start is the position in the file where the reader starts from.
+	start int64
+	// length is the length of the whole file, or of the file up to the end
+	// of the requested range, -1 if it's unknown.
+	length int64
+	// etag and lastModified are the validators of the http source.
+	etag         string
+	lastModified string
+	// notModified is set if the source is not modified since the cache
+	// entry it's requested with, and nothing is read from it.
+	notModified bool
+	// cached is set if it's read from the cache instead of the source.
+	cached bool
+	// url is the one the http source is read from after the redirects.
+	url string
+}
+
+// sourceClient requests the file source with the options of the runtime
+// context, the options such as headers, netrc and proxy only apply to http(s),
+// and tls applies to both https and ftps. The s3 urls are requested from the
+// S3-compatible endpoint through http(s). It never requests the source if
+// Notbs is set.
+type sourceClient struct {
+	ctx    *cfg.Context
+	client *http.Client
+	// err is the error of creating the client, and it's returned by all the
+	// requests.
+	err error
+	// tlsConfig is the one of ctx.SourceTLSConfig, which applies to ftps as
+	// well. It's nil if none of the tls options is set.
+	tlsConfig *tls.Config
+
+	// authOnce parses netrc and the docker config for the first request
+	// needing them, and they're nil if they're not found or invalid.
+	authOnce     sync.Once
+	netrc        *util.Netrc
+	dockerConfig *util.DockerConfig
+}
+
+func newSourceClient(ctx *cfg.Context) *sourceClient {
+	if ctx.Insecure {
+		ctx.ClientLogger.Warnf("the certificate of source is not verified, it's insecure")
+	}
+	tlsConfig, err := ctx.SourceTLSConfig()
+	if err == nil && ctx.ForceHTTP2 && !forceHTTP2Supported {
+		err = fmt.Errorf("forcehttp2 requires go1.13, but dfget is built with %s", runtime.Version())
+	}
+	var transport http.RoundTripper = sourceTransport(ctx, tlsConfig)
+	if err == nil && !util.IsEmptyStr(ctx.S3Endpoint) {
+		transport, err = newS3Transport(transport, ctx.S3Endpoint, ctx.S3Region)
+	}
+	sc := &sourceClient{ctx: ctx, err: err, tlsConfig: tlsConfig}
+	sc.client = &http.Client{Transport: transport, CheckRedirect: sc.checkRedirect}
+	return sc
+}
+
+// checkRedirect follows at most MaxRedirects redirects of each request, and
+// each hop is logged. The redirect itself is returned if MaxRedirects is 0, so
+// that it fails as the status code not allowed.
+func (sc *sourceClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	if sc.ctx.MaxRedirects == 0 {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > sc.ctx.MaxRedirects {
+		return fmt.Errorf("too many redirects(%d)", sc.ctx.MaxRedirects)
+	}
+	sc.ctx.ClientLogger.Debugf("redirect %s to %s",
+		cfg.RedactURL(via[len(via)-1].URL.String()), cfg.RedactURL(req.URL.String()))
+	return nil
+}
+
+var (
+	// sharedTransports are the transports to source keyed by
+	// sourceTransportKey, so that the idle connections are reused by all the
+	// downloads of the process rather than each of them.
+	sharedTransports   = make(map[string]*http.Transport)
+	sharedTransportsMu sync.Mutex
+
+	// hostSlots are the requests in flight to each host keyed by the host
+	// and MaxConnsPerHost, which are shared by all the downloads of the
+	// process like sharedTransports.
+	hostSlots   = make(map[string]chan struct{})
+	hostSlotsMu sync.Mutex
+)
+
+// acquireHost waits until the requests in flight to the host are fewer than
+// MaxConnsPerHost, and the slot taken is freed by release. It fails once ctx
+// is done, and release does nothing if MaxConnsPerHost is not set.
+func (sc *sourceClient) acquireHost(ctx context.Context, host string) (release func(), err error) {
+	limit := sc.ctx.MaxConnsPerHost
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	key := host + "|" + strconv.Itoa(limit)
+	hostSlotsMu.Lock()
+	slots, ok := hostSlots[key]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		hostSlots[key] = slots
+	}
+	hostSlotsMu.Unlock()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// releasingBody frees the slot of the host once the body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// sourceTransport returns the transport of the requests to source, and it's
+// shared by the contexts with the same options.
+func sourceTransport(ctx *cfg.Context, tlsConfig *tls.Config) *http.Transport {
+	key := sourceTransportKey(ctx)
+	sharedTransportsMu.Lock()
+	defer sharedTransportsMu.Unlock()
+	if t, ok := sharedTransports[key]; ok {
+		return t
+	}
+	t := newSourceTransport(ctx, tlsConfig)
+	sharedTransports[key] = t
+	return t
+}
+
+// sourceTransportKey returns the options of the transport to source, and the
+// tls files are keyed by their paths. NO_PROXY is a part of it since it's read
+// once the transport is created.
+func sourceTransportKey(ctx *cfg.Context) string {
+	return strings.Join([]string{ctx.Proxy, getEnvAny("NO_PROXY", "no_proxy"), ctx.ClientCert, ctx.ClientKey, ctx.CACert,
+		strconv.FormatBool(ctx.Insecure), strconv.FormatBool(ctx.ForceHTTP2), ctx.IdleConnTimeout.String(), strconv.Itoa(ctx.Concurrency)}, "|")
+}
+
+// newSourceTransport creates the transport of the requests to source, which
+// is the same as http.DefaultTransport except the proxy, tls config and the
+// keep-alive options of ctx, and the connections per host are limited by
+// acquireHost instead. HTTP/2 is attempted only if ForceHTTP2 is set, because
+// the custom tls config and dialer disable it otherwise. The idle connections
+// kept for each host are enough for the Concurrency downloads to reuse.
+func newSourceTransport(ctx *cfg.Context, tlsConfig *tls.Config) *http.Transport {
+	maxIdleConnsPerHost := http.DefaultMaxIdleConnsPerHost
+	if ctx.Concurrency > maxIdleConnsPerHost {
+		maxIdleConnsPerHost = ctx.Concurrency
+	}
+	t := &http.Transport{
+		Proxy:           proxyFunc(ctx.Proxy),
+		TLSClientConfig: tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       ctx.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: sourceExpectContinueTimeout,
+	}
+	if ctx.ForceHTTP2 {
+		forceHTTP2(t)
+	}
+	return t
+}
+
+// open opens a reader of the file source according to the scheme of the url.
+// The reader starts from the offset if the source supports range requests,
+// otherwise from the beginning.
+// Reading from the source is aborted once ctx is done.
+func (sc *sourceClient) open(ctx context.Context, rawURL string, offset int64) (*source, error) {
+	return sc.openIfModified(ctx, rawURL, offset, -1, nil)
+}
+
+// openSlice opens the bytes from start to end, both inclusive, of the source.
+// They're cut out of the whole content if the source doesn't support range,
+// so the reader always starts from start.
+func (sc *sourceClient) openSlice(ctx context.Context, rawURL string, start, end int64) (*source, error) {
+	src, err := sc.openIfModified(ctx, rawURL, start, end, nil)
+	if err != nil {
+		return nil, err
+	}
+	if src.start < start {
+		sc.ctx.ClientLogger.Warnf("source doesn't support range, skip %d bytes", start-src.start)
+		if _, err := io.CopyN(ioutil.Discard, src, start-src.start); err != nil {
+			src.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("range start[%d] exceeds the length of source", start)
+			}
+			return nil, fmt.Errorf("skip to range start[%d] error: %v", start, err)
+		}
+	}
+	length := int64(-1)
+	if src.length >= 0 {
+		if length = src.length; length > end+1 {
+			length = end + 1
+		}
+		if length -= start; length < 0 {
+			length = 0
+		}
+	}
+	reader := struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(src, end-start+1), src}
+	return &source{ReadCloser: reader, length: length, etag: src.etag, lastModified: src.lastModified, url: src.url}, nil
+}
+
+// openIfModified opens the source like open, but the http source is
+// requested conditionally with the validators of the entry if it's not nil.
+// The range requested ends at end if it's not negative.
+func (sc *sourceClient) openIfModified(ctx context.Context, rawURL string, offset, end int64,
+	entry *cacheEntry) (*source, error) {
+	if sc.ctx.Notbs {
+		return nil, errors.ErrBackSourceDisabled
+	}
+	if sc.err != nil {
+		return nil, sc.err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse url[%s] error: %v", rawURL, err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case cfg.SchemaFTP, cfg.SchemaFTPS:
+		reader, start, err := openFTP(ctx, u, offset, sc.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &source{ReadCloser: reader, start: start, length: -1}, nil
+	default:
+		return sc.openHTTP(ctx, rawURL, offset, end, entry)
+	}
+}
+
+// StatSource checks whether the source of ctx.URL is reachable and returns
+// the content length of it, -1 means the length is unknown.
+func StatSource(ctx context.Context, runtime *cfg.Context) (int64, error) {
+	return newSourceClient(runtime).stat(ctx, runtime.URL)
+}
+
+func (sc *sourceClient) stat(ctx context.Context, rawURL string) (int64, error) {
+	if sc.ctx.Notbs {
+		return 0, errors.ErrBackSourceDisabled
+	}
+	if sc.err != nil {
+		return 0, sc.err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, fmt.Errorf("parse url[%s] error: %v", rawURL, err)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case cfg.SchemaFTP, cfg.SchemaFTPS:
+		return sizeFTP(ctx, u, sc.tlsConfig)
+	default:
+		return sc.statHTTP(ctx, rawURL)
+	}
+}
+
+func (sc *sourceClient) statHTTP(ctx context.Context, rawURL string) (int64, error) {
+	req, err := sc.newRequest(ctx, http.MethodHead, rawURL)
+	if err != nil {
+		return 0, err
+	}
+	release, err := sc.acquireHost(ctx, req.URL.Host)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if !sc.ctx.BackSourceStatusAllowed(resp.StatusCode) {
+		return 0, &errors.SourceStatusError{Op: "stat source", Code: resp.StatusCode}
+	}
+	return resp.ContentLength, nil
+}
+
+// openHTTP requests the source with identity encoding, unless AcceptEncoding
+// is set that gzip and deflate are accepted and the content is decompressed
+// transparently. The range is not requested for the encoded content because
+// the offset is of the decompressed one.
+// The response 304 of the conditional request is returned as a source that's
+// notModified. The response 416 to the range ending at end fails with
+// errors.RangeNotSatisfiableError, while the one to the offset of resuming is
+// requested again from the beginning. The other responses are downloaded only
+// if their status codes are allowed by BackSourceStatusAllow, otherwise
+// errors.SourceStatusError is returned.
+func (sc *sourceClient) openHTTP(ctx context.Context, rawURL string, offset, end int64,
+	entry *cacheEntry) (*source, error) {
+	req, err := sc.newRequest(ctx, http.MethodGet, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		if sc.ctx.AcceptEncoding {
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+		} else {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+	}
+	ranged := (offset > 0 || end >= 0) && !sc.ctx.AcceptEncoding
+	if ranged {
+		r := fmt.Sprintf("bytes=%d-", offset)
+		if end >= 0 {
+			r += strconv.FormatInt(end, 10)
+		}
+		req.Header.Set("Range", r)
+	}
+	if entry != nil {
+		if !util.IsEmptyStr(entry.ETag) {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if !util.IsEmptyStr(entry.LastModified) {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	release, err := sc.acquireHost(ctx, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	start := cfg.DefaultClock.Now()
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		release()
+		sc.ctx.ClientLogger.Debugf("request source range:%s cost:%.3fs error:%v",
+			req.Header.Get("Range"), cfg.Since(start).Seconds(), err)
+		return nil, err
+	}
+	// the slot is taken until the body is closed
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	sc.ctx.ClientLogger.Debugf("request source range:%s cost:%.3fs code:%d length:%d encoding:%s",
+		req.Header.Get("Range"), cfg.Since(start).Seconds(), resp.StatusCode,
+		resp.ContentLength, resp.Header.Get("Content-Encoding"))
+
+	var src *source
+	allowed := sc.ctx.BackSourceStatusAllowed(resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		if !ranged || !allowed {
+			break
+		}
+		length := int64(-1)
+		if resp.ContentLength >= 0 {
+			length = offset + resp.ContentLength
+		}
+		src = &source{ReadCloser: resp.Body, start: offset, length: length}
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		src = &source{ReadCloser: resp.Body, length: -1, notModified: true}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && ranged:
+		resp.Body.Close()
+		if end >= 0 {
+			return nil, &errors.RangeNotSatisfiableError{Start: offset, End: end}
+		}
+		// the existing part may be larger than the file, so download it again
+		sc.ctx.ClientLogger.Debugf("range from %d is not satisfiable, retry from the beginning", offset)
+		return sc.openHTTP(ctx, rawURL, 0, -1, entry)
+	case allowed:
+		if sc.ctx.AcceptEncoding {
+			if src, err = decodeBody(resp); err != nil {
+				return nil, err
+			}
+		} else {
+			src = &source{ReadCloser: resp.Body, length: resp.ContentLength}
+		}
+	}
+	if src != nil {
+		src.etag, src.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+		src.url = resp.Request.URL.String()
+		return src, nil
+	}
+	resp.Body.Close()
+	return nil, &errors.SourceStatusError{Op: "download from source", Code: resp.StatusCode}
+}
+
+// decodeBody decompresses the body according to the Content-Encoding of the
+// response, and the length of the decompressed content is unknown.
+func decodeBody(resp *http.Response) (*source, error) {
+	var (
+		reader io.Reader
+		err    error
+	)
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+		return &source{ReadCloser: resp.Body, length: resp.ContentLength}, nil
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		reader, err = zlib.NewReader(resp.Body)
+	default:
+		err = fmt.Errorf("unsupported content encoding:%s", encoding)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("decompress the response error: %v", err)
+	}
+	return &source{ReadCloser: &decodedReader{Reader: reader, body: resp.Body}, length: -1}, nil
+}
+
+// decodedReader reads the decompressed content and closes the body.
+type decodedReader struct {
+	io.Reader
+	body io.Closer
+}
+
+func (r *decodedReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return r.body.Close()
+}
+
+// newRequest creates a request to the source with the headers of ctx that
+// in the format of 'key:value', and the UserAgent of ctx is sent unless the
+// headers carry one. The credential in netrc, or else the one in the docker
+// config, is used if neither the url nor the headers carry one, and neither
+// is used for the s3 url which is mapped to the object url on the
+// S3-compatible endpoint, and both files are parsed only once for sc.
+// 'Expect: 100-continue' is sent if Expect100 is set.
+func (sc *sourceClient) newRequest(ctx context.Context, method, rawURL string) (*http.Request, error) {
+	s3 := cfg.IsS3URL(rawURL)
+	if s3 {
+		u, err := s3ObjectURL(sc.ctx.S3Endpoint, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		rawURL = u.String()
+	}
+	req, err := newSourceRequest(method, rawURL, sc.ctx.Header)
+	if err != nil {
+		return nil, err
+	}
+	if !util.IsEmptyStr(sc.ctx.UserAgent) && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", sc.ctx.UserAgent)
+	}
+	if sc.ctx.TraceRequests && !util.IsEmptyStr(sc.ctx.RequestID) {
+		req.Header.Set(requestIDHeader, sc.ctx.RequestID)
+	}
+	if sc.ctx.Expect100 && req.Header.Get("Expect") == "" {
+		req.Header.Set("Expect", "100-continue")
+	}
+	if !s3 && req.URL.User == nil && req.Header.Get("Authorization") == "" {
+		sc.authOnce.Do(sc.parseAuth)
+		if sc.netrc != nil {
+			sc.setNetrcAuth(req)
+		}
+		if req.Header.Get("Authorization") == "" && sc.dockerConfig != nil {
+			sc.setDockerAuth(req)
+		}
+	}
+	return req.WithContext(ctx), nil
+}
+
+// parseAuth parses the netrc file if Netrc is set and the docker config if
+// DockerAuthConfig is set, and the errors are only logged.
+func (sc *sourceClient) parseAuth() {
+	var err error
+	if sc.ctx.Netrc {
+		if sc.netrc, err = util.ParseNetrc(sc.ctx.NetrcFile); err != nil {
+			sc.ctx.ClientLogger.Warnf("parse netrc error: %v", err)
+		}
+	}
+	if !util.IsEmptyStr(sc.ctx.DockerAuthConfig) {
+		if sc.dockerConfig, err = util.ParseDockerConfig(sc.ctx.DockerAuthConfig); err != nil && !os.IsNotExist(err) {
+			sc.ctx.ClientLogger.Warnf("parse docker config error: %v", err)
+		}
+	}
+}
+
+// setNetrcAuth sets the basic auth of the request with the machine matching
+// its host in the netrc file, and it does nothing if the machine is not found.
+func (sc *sourceClient) setNetrcAuth(req *http.Request) {
+	if m := sc.netrc.Lookup(req.URL.Hostname()); m != nil {
+		sc.ctx.ClientLogger.Debugf("use the credential in netrc for host:%s", req.URL.Hostname())
+		req.SetBasicAuth(m.Login, m.Password)
+	}
+}
+
+// setDockerAuth sets the basic auth of the request with the registry matching
+// its host in the docker config, and it does nothing if the registry is not
+// found.
+func (sc *sourceClient) setDockerAuth(req *http.Request) {
+	if auth := sc.dockerConfig.Lookup(req.URL.Host); auth != nil {
+		sc.ctx.ClientLogger.Debugf("use the credential in docker config for host:%s", req.URL.Host)
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+}
+
+// newSourceRequest creates a request to the source with the headers that
+// in the format of 'key:value'.
+func newSourceRequest(method, rawURL string, headers []string) (*http.Request, error) {
+	req, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		kv := strings.SplitN(header, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Add(key, value)
+	}
+	return req, nil
+}
@@ -0,0 +1,596 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/go-check/check"
+)
+
+func (s *DownloaderSuite) TestStatSource(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL + "/file"
+	length, err := StatSource(context.Background(), cfg.Ctx)
+	c.Assert(err, check.IsNil)
+	c.Assert(length, check.Equals, int64(len(testContent)))
+
+	cfg.Ctx.URL = server.URL + "/notexist"
+	_, err = StatSource(context.Background(), cfg.Ctx)
+	c.Assert(err, check.ErrorMatches, ".*response code:404")
+}
+
+func (s *DownloaderSuite) TestSourceClient_HTTP2(c *check.C) {
+	var proto int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+		fmt.Fprint(w, testContent)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	cfg.Ctx.Insecure = true
+	cfg.Ctx.URL = server.URL + "/file"
+	for _, force := range []bool{false, true} {
+		cfg.Ctx.ForceHTTP2 = force
+		_, err := StatSource(context.Background(), cfg.Ctx)
+		if force && !forceHTTP2Supported {
+			c.Assert(err, check.ErrorMatches, "forcehttp2 requires go1.13.*")
+			continue
+		}
+		c.Assert(err, check.IsNil)
+		expected := int32(1)
+		if force {
+			expected = 2
+		}
+		c.Assert(atomic.LoadInt32(&proto), check.Equals, expected, check.Commentf("force:%t", force))
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_KeepAlive(c *check.C) {
+	cfg.Ctx.IdleConnTimeout = time.Minute
+	cfg.Ctx.Concurrency = 8
+	t := newSourceClient(cfg.Ctx).client.Transport.(*http.Transport)
+	c.Assert(t.IdleConnTimeout, check.Equals, time.Minute)
+	c.Assert(t.MaxIdleConnsPerHost, check.Equals, 8)
+
+	cfg.Ctx.Concurrency = 1
+	t = newSourceClient(cfg.Ctx).client.Transport.(*http.Transport)
+	c.Assert(t.MaxIdleConnsPerHost, check.Equals, http.DefaultMaxIdleConnsPerHost)
+}
+
+func (s *DownloaderSuite) TestSourceClient_MaxConnsPerHost(c *check.C) {
+	var active, peak int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	for _, maxConnsPerHost := range []int{0, 1} {
+		atomic.StoreInt32(&peak, 0)
+		cfg.Ctx.MaxConnsPerHost = maxConnsPerHost
+		// the transport is shared whether the connections are limited or not
+		c.Assert(newSourceClient(cfg.Ctx).client.Transport == newSourceClient(cfg.Ctx.Clone()).client.Transport,
+			check.Equals, true, check.Commentf("%d", maxConnsPerHost))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			runtime := cfg.Ctx.Clone()
+			runtime.URL = server.URL + "/" + strconv.Itoa(i)
+			runtime.Output = s.target(fmt.Sprintf("conns.%d.test", i))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.Check(NewDirectDownloader(runtime).Run(context.Background()), check.IsNil)
+			}()
+		}
+		wg.Wait()
+		if maxConnsPerHost > 0 {
+			c.Assert(atomic.LoadInt32(&peak), check.Equals, int32(maxConnsPerHost))
+		} else {
+			c.Assert(atomic.LoadInt32(&peak) > 1, check.Equals, true)
+		}
+	}
+
+	// waiting for the slot of the host is canceled with the context
+	sc := newSourceClient(cfg.Ctx)
+	release, err := sc.acquireHost(context.Background(), "a.b")
+	c.Assert(err, check.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = sc.acquireHost(ctx, "a.b")
+	c.Assert(err, check.Equals, context.Canceled)
+	release()
+	release()
+	release, err = sc.acquireHost(context.Background(), "a.b")
+	c.Assert(err, check.IsNil)
+	release()
+}
+
+func (s *DownloaderSuite) TestSourceClient_BackSourceStatusAllow(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if code == http.StatusPartialContent {
+			http.ServeContent(w, r, "range", time.Time{}, strings.NewReader(testContent))
+			return
+		}
+		w.WriteHeader(code)
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	var cases = []struct {
+		allow []int
+		code  int
+		valid bool
+	}{
+		{nil, http.StatusOK, true},
+		{nil, http.StatusNonAuthoritativeInfo, false},
+		{nil, http.StatusTooManyRequests, false},
+		{nil, http.StatusServiceUnavailable, false},
+		{[]int{200, 203}, http.StatusNonAuthoritativeInfo, true},
+		{[]int{203}, http.StatusOK, false},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.BackSourceStatusAllow = v.allow
+		sc := newSourceClient(cfg.Ctx)
+		reader, err := sc.open(context.Background(), server.URL+"/"+strconv.Itoa(v.code), 0)
+		c.Assert(err == nil, check.Equals, v.valid, check.Commentf("%v %v", v, err))
+		if err != nil {
+			e, ok := err.(*errors.SourceStatusError)
+			c.Assert(ok, check.Equals, true, check.Commentf("%v %v", v, err))
+			c.Assert(e.Code, check.Equals, v.code)
+			continue
+		}
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		c.Assert(string(content), check.Equals, testContent, check.Commentf("%v", v))
+	}
+
+	// 206 is accepted only for the range requested
+	var ranges = []struct {
+		allow []int
+		valid bool
+	}{
+		{nil, true},
+		{[]int{200}, false},
+	}
+	for _, v := range ranges {
+		cfg.Ctx.BackSourceStatusAllow = v.allow
+		_, err := newSourceClient(cfg.Ctx).openSlice(context.Background(), server.URL+"/206", 1, 2)
+		c.Assert(err == nil, check.Equals, v.valid, check.Commentf("%v %v", v, err))
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_RangeNotSatisfiable(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	// the range asked for fails rather than downloading the whole file
+	_, err := newSourceClient(cfg.Ctx).openSlice(context.Background(), server.URL, 100, 199)
+	c.Assert(err, check.DeepEquals, &errors.RangeNotSatisfiableError{Start: 100, End: 199})
+
+	// the offset of resuming is downloaded again from the beginning
+	reader, err := newSourceClient(cfg.Ctx).open(context.Background(), server.URL, 100)
+	c.Assert(err, check.IsNil)
+	content, _ := ioutil.ReadAll(reader)
+	reader.Close()
+	c.Assert(string(content), check.Equals, testContent)
+}
+
+func (s *DownloaderSuite) TestSourceClient_Verbose(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	for _, level := range []logrus.Level{logrus.InfoLevel, logrus.DebugLevel} {
+		var buf bytes.Buffer
+		cfg.Ctx.ClientLogger.Out, cfg.Ctx.ClientLogger.Level = &buf, level
+		reader, err := newSourceClient(cfg.Ctx).open(context.Background(), server.URL+"/range", 3)
+		c.Assert(err, check.IsNil)
+		reader.Close()
+		matched, _ := regexp.MatchString("request source range:bytes=3- cost:.* code:206", buf.String())
+		c.Assert(matched, check.Equals, level == logrus.DebugLevel, check.Commentf("level:%v", level))
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_Notbs(c *check.C) {
+	var requested bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer server.Close()
+
+	cfg.Ctx.Notbs = true
+	sc := newSourceClient(cfg.Ctx)
+	_, err := sc.open(context.Background(), server.URL+"/file", 0)
+	c.Assert(err, check.Equals, errors.ErrBackSourceDisabled)
+	_, err = sc.stat(context.Background(), server.URL+"/file")
+	c.Assert(err, check.Equals, errors.ErrBackSourceDisabled)
+	_, err = sc.open(context.Background(), "ftp://127.0.0.1:1/file", 0)
+	c.Assert(err, check.Equals, errors.ErrBackSourceDisabled)
+	c.Assert(requested, check.Equals, false)
+}
+
+func (s *DownloaderSuite) TestSourceClient_Netrc(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	cfg.Ctx.NetrcFile = filepath.Join(s.workHome, "netrc")
+	ioutil.WriteFile(cfg.Ctx.NetrcFile, []byte("machine 127.0.0.1 login alice password secret"), 0600)
+	basic := func(userPass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))
+	}
+	var cases = []struct {
+		netrc     bool
+		netrcFile string
+		url       string
+		header    []string
+		expected  string
+	}{
+		{false, cfg.Ctx.NetrcFile, server.URL, nil, ""},
+		{true, cfg.Ctx.NetrcFile, server.URL, nil, basic("alice:secret")},
+		{true, cfg.Ctx.NetrcFile, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), nil, ""},
+		{true, cfg.Ctx.NetrcFile, strings.Replace(server.URL, "://", "://bob:pass@", 1), nil, basic("bob:pass")},
+		{true, cfg.Ctx.NetrcFile, server.URL, []string{"Authorization: Bearer x"}, "Bearer x"},
+		{true, cfg.Ctx.NetrcFile + ".notexist", server.URL, nil, ""},
+	}
+
+	for _, cc := range cases {
+		cfg.Ctx.Netrc, cfg.Ctx.NetrcFile, cfg.Ctx.Header = cc.netrc, cc.netrcFile, cc.header
+		sc := newSourceClient(cfg.Ctx)
+		reader, err := sc.open(context.Background(), cc.url+"/header", 0)
+		c.Assert(err, check.IsNil)
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		c.Assert(strings.Split(string(content), "|")[1], check.Equals, cc.expected,
+			check.Commentf("%v", cc))
+	}
+	c.Assert(strings.Contains(cfg.Ctx.String(), "secret"), check.Equals, false)
+
+	// the netrc file is parsed only once for the client
+	cfg.Ctx.Netrc, cfg.Ctx.NetrcFile, cfg.Ctx.Header = true, filepath.Join(s.workHome, "once.netrc"), nil
+	ioutil.WriteFile(cfg.Ctx.NetrcFile, []byte("machine 127.0.0.1 login alice password secret"), 0600)
+	sc := newSourceClient(cfg.Ctx)
+	for i := 0; i < 2; i++ {
+		req, err := sc.newRequest(context.Background(), http.MethodGet, server.URL)
+		c.Assert(err, check.IsNil)
+		c.Assert(req.Header.Get("Authorization"), check.Equals, basic("alice:secret"))
+		os.Remove(cfg.Ctx.NetrcFile)
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_DockerAuth(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	dockerConfig := filepath.Join(s.workHome, "docker.json")
+	ioutil.WriteFile(dockerConfig, []byte(`{"auths": {"`+host+`": {"auth": "`+
+		base64.StdEncoding.EncodeToString([]byte("alice:token"))+`"}}}`), 0600)
+	cfg.Ctx.NetrcFile = filepath.Join(s.workHome, "docker.netrc")
+	ioutil.WriteFile(cfg.Ctx.NetrcFile, []byte("machine 127.0.0.1 login bob password pass"), 0600)
+	basic := func(userPass string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))
+	}
+	var cases = []struct {
+		dockerConfig string
+		netrc        bool
+		url          string
+		header       []string
+		expected     string
+	}{
+		{dockerConfig, false, server.URL, nil, basic("alice:token")},
+		{dockerConfig, true, server.URL, nil, basic("bob:pass")},
+		{dockerConfig, false, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), nil, ""},
+		{dockerConfig, false, server.URL, []string{"Authorization: Bearer x"}, "Bearer x"},
+		{dockerConfig + ".notexist", false, server.URL, nil, ""},
+		{"", false, server.URL, nil, ""},
+	}
+
+	for _, v := range cases {
+		var logs bytes.Buffer
+		cfg.Ctx.ClientLogger.Out = &logs
+		cfg.Ctx.DockerAuthConfig, cfg.Ctx.Netrc, cfg.Ctx.Header = v.dockerConfig, v.netrc, v.header
+		sc := newSourceClient(cfg.Ctx)
+		reader, err := sc.open(context.Background(), v.url+"/header", 0)
+		c.Assert(err, check.IsNil)
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		c.Assert(strings.Split(string(content), "|")[1], check.Equals, v.expected, check.Commentf("%v", v))
+		c.Assert(strings.Contains(logs.String(), "token"), check.Equals, false)
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_AcceptEncoding(c *check.C) {
+	server := newTestServer()
+	defer server.Close()
+
+	var cases = []struct {
+		acceptEncoding bool
+		header         []string
+	}{
+		{false, nil},
+		{true, nil},
+		{true, []string{"Accept-Encoding: deflate"}},
+		{false, []string{"Accept-Encoding: identity"}},
+	}
+
+	for _, cc := range cases {
+		cfg.Ctx.URL = server.URL + "/encoding"
+		cfg.Ctx.Output = s.target("encoding.test")
+		cfg.Ctx.Md5 = testContentMd5
+		cfg.Ctx.AcceptEncoding, cfg.Ctx.Header = cc.acceptEncoding, cc.header
+		dd := NewDirectDownloader(cfg.Ctx)
+		c.Assert(dd.Run(context.Background()), check.IsNil, check.Commentf("%v", cc))
+		content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+		c.Assert(string(content), check.Equals, testContent, check.Commentf("%v", cc))
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_UserAgent(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.UserAgent())
+	}))
+	defer server.Close()
+
+	var cases = []struct {
+		userAgent string
+		header    []string
+		expected  string
+	}{
+		{cfg.NewContext().UserAgent, nil, cfg.NewContext().UserAgent},
+		{"custom/1.0", nil, "custom/1.0"},
+		{"custom/1.0", []string{"User-Agent: header/1.0"}, "header/1.0"},
+		{"", nil, "Go-http-client/1.1"},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.URL = server.URL
+		cfg.Ctx.Output = s.target("useragent.test")
+		cfg.Ctx.UserAgent, cfg.Ctx.Header = v.userAgent, v.header
+		dd := NewDirectDownloader(cfg.Ctx)
+		c.Assert(dd.Run(context.Background()), check.IsNil, check.Commentf("%v", v))
+		content, _ := ioutil.ReadFile(cfg.Ctx.Output)
+		c.Assert(string(content), check.Equals, v.expected, check.Commentf("%v", v))
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_TraceRequests(c *check.C) {
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get(requestIDHeader))
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL
+	cfg.Ctx.Output = s.target("trace.test")
+	cfg.Ctx.RequestID = "123-1500000000.000-2"
+	cfg.Ctx.StrictSize = true
+	for _, trace := range []bool{false, true} {
+		ids = nil
+		cfg.Ctx.TraceRequests = trace
+		dd := NewDirectDownloader(cfg.Ctx)
+		c.Assert(dd.Run(context.Background()), check.IsNil)
+		expected := ""
+		if trace {
+			expected = cfg.Ctx.RequestID
+		}
+		c.Assert(len(ids) > 0, check.Equals, true)
+		for _, id := range ids {
+			c.Assert(id, check.Equals, expected, check.Commentf("trace:%t", trace))
+		}
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_Expect100(c *check.C) {
+	var expects []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expects = append(expects, r.Header.Get("Expect"))
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	cfg.Ctx.URL = server.URL
+	cfg.Ctx.Output = s.target("expect.test")
+	var cases = []struct {
+		expect100 bool
+		header    []string
+		expected  string
+	}{
+		{false, nil, ""},
+		{true, nil, "100-continue"},
+		{true, []string{"Expect:100-continue"}, "100-continue"},
+	}
+	for _, v := range cases {
+		expects = nil
+		cfg.Ctx.Expect100, cfg.Ctx.Header = v.expect100, v.header
+		dd := NewDirectDownloader(cfg.Ctx)
+		c.Assert(dd.Run(context.Background()), check.IsNil, check.Commentf("%v", v))
+		c.Assert(expects, check.DeepEquals, []string{v.expected}, check.Commentf("%v", v))
+	}
+	t := newSourceTransport(cfg.Ctx, nil)
+	c.Assert(t.ExpectContinueTimeout, check.Equals, sourceExpectContinueTimeout)
+}
+
+func (s *DownloaderSuite) TestSourceClient_MaxRedirects(c *check.C) {
+	// /redirect/<n> is redirected n times before the content is served.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	cfg.Ctx.Output = s.target("redirect.test")
+	var cases = []struct {
+		redirects    int
+		maxRedirects int
+		err          string
+	}{
+		{0, 0, ""},
+		{1, 0, ".*response code:302"},
+		{3, 3, ""},
+		{4, 3, ".*too many redirects.*"},
+		{cfg.DefaultMaxRedirects, cfg.DefaultMaxRedirects, ""},
+	}
+	for _, v := range cases {
+		cfg.Ctx.URL = fmt.Sprintf("%s/redirect/%d", server.URL, v.redirects)
+		cfg.Ctx.MaxRedirects = v.maxRedirects
+		dd := NewDirectDownloader(cfg.Ctx)
+		err := dd.Run(context.Background())
+		if v.err != "" {
+			c.Assert(err, check.ErrorMatches, v.err, check.Commentf("%v", v))
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+		c.Assert(dd.ResolvedURL(), check.Equals, server.URL+"/redirect/0")
+		c.Assert(dd.Total(), check.Equals, int64(len(testContent)))
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_TLS(c *check.C) {
+	clientCert, clientKey, cert := writeTestCert(c, s.workHome)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testContent)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caCert := filepath.Join(s.workHome, "ca.crt")
+	ioutil.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: server.Certificate().Raw}), 0644)
+
+	var cases = []struct {
+		cert     string
+		key      string
+		ca       string
+		expected string
+	}{
+		{"", "", "", ".*certificate.*"},
+		{"", "", caCert, ".*"},
+		{clientCert, clientKey, "", ".*certificate.*"},
+		{clientCert, clientKey + ".notexist", caCert, "load client cert.*"},
+		{clientCert, clientKey, caCert, ""},
+	}
+
+	for _, v := range cases {
+		cfg.Ctx.ClientCert, cfg.Ctx.ClientKey, cfg.Ctx.CACert = v.cert, v.key, v.ca
+		reader, err := newSourceClient(cfg.Ctx).open(context.Background(), server.URL+"/file", 0)
+		if v.expected != "" {
+			c.Assert(err, check.ErrorMatches, v.expected, check.Commentf("%v", v))
+			continue
+		}
+		c.Assert(err, check.IsNil, check.Commentf("%v", v))
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		c.Assert(string(content), check.Equals, testContent)
+	}
+}
+
+func (s *DownloaderSuite) TestSourceClient_Insecure(c *check.C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	for _, insecure := range []bool{false, true} {
+		var logs bytes.Buffer
+		cfg.Ctx.ClientLogger.Out = &logs
+		cfg.Ctx.Insecure = insecure
+		reader, err := newSourceClient(cfg.Ctx).open(context.Background(), server.URL+"/file", 0)
+		c.Assert(err == nil, check.Equals, insecure, check.Commentf("insecure:%t", insecure))
+		if err == nil {
+			reader.Close()
+		}
+		c.Assert(strings.Contains(logs.String(), "insecure"), check.Equals, insecure)
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key in PEM into
+// the dir.
+func writeTestCert(c *check.C, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dfget"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	cert, _ = x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, cert
+}
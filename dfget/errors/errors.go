@@ -16,3 +16,74 @@
 
 // Package errors defines all exceptions happened in dfget's runtime.
 package errors
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrBackSourceDisabled is returned when the file can't be supplied by p2p
+// and downloading it from source is disabled by 'notbs'.
+var ErrBackSourceDisabled = errors.New("back source disabled")
+
+// SourceStatusError is returned when the source responds with the status code
+// not allowed by the runtime context, e.g. 429 or 503, and it fails the
+// download immediately.
+type SourceStatusError struct {
+	// Op is what's requested, e.g. 'download from source'.
+	Op   string
+	Code int
+}
+
+func (e *SourceStatusError) Error() string {
+	return fmt.Sprintf("failed to %s, response code:%d", e.Op, e.Code)
+}
+
+// RangeNotSatisfiableError is returned when the source responds 416 to the
+// range asked for explicitly, e.g. it starts beyond the end of the file.
+type RangeNotSatisfiableError struct {
+	Start int64
+	End   int64
+}
+
+func (e *RangeNotSatisfiableError) Error() string {
+	return fmt.Sprintf("range[%d-%d] is not satisfiable by source", e.Start, e.End)
+}
+
+// OutputLockedError is returned when the output is being downloaded by
+// another dfget holding its lock.
+type OutputLockedError struct {
+	Path string
+	// Pid is the one of the dfget holding the lock, 0 if it's unknown.
+	Pid int
+}
+
+func (e *OutputLockedError) Error() string {
+	if e.Pid > 0 {
+		return fmt.Sprintf("output[%s] locked by another dfget, pid:%d", e.Path, e.Pid)
+	}
+	return fmt.Sprintf("output[%s] locked by another dfget", e.Path)
+}
+
+// NoSpaceError is returned when the file system of the target has no space
+// for the downloaded content.
+type NoSpaceError struct {
+	Path string
+	// Free is the number of bytes available when it's detected, -1 if it's
+	// unknown.
+	Free int64
+	// Required is the number of bytes to write, -1 if it's unknown.
+	Required int64
+	Err      error
+}
+
+func (e *NoSpaceError) Error() string {
+	msg := fmt.Sprintf("insufficient disk space for %s, free:%d", e.Path, e.Free)
+	if e.Required >= 0 {
+		msg += fmt.Sprintf(" required:%d", e.Required)
+	}
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
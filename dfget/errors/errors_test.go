@@ -15,3 +15,53 @@
  */
 
 package errors_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alibaba/Dragonfly/dfget/errors"
+	"github.com/go-check/check"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type ErrorsSuite struct{}
+
+func init() {
+	check.Suite(&ErrorsSuite{})
+}
+
+func (s *ErrorsSuite) TestSourceStatusError(c *check.C) {
+	err := &errors.SourceStatusError{Op: "download from source", Code: 503}
+	c.Assert(err.Error(), check.Equals, "failed to download from source, response code:503")
+}
+
+func (s *ErrorsSuite) TestRangeNotSatisfiableError(c *check.C) {
+	err := &errors.RangeNotSatisfiableError{Start: 100, End: 199}
+	c.Assert(err.Error(), check.Equals, "range[100-199] is not satisfiable by source")
+}
+
+func (s *ErrorsSuite) TestOutputLockedError(c *check.C) {
+	err := &errors.OutputLockedError{Path: "/a"}
+	c.Assert(err.Error(), check.Equals, "output[/a] locked by another dfget")
+	err.Pid = 10
+	c.Assert(err.Error(), check.Equals, "output[/a] locked by another dfget, pid:10")
+}
+
+func (s *ErrorsSuite) TestNoSpaceError(c *check.C) {
+	var cases = []struct {
+		err      *errors.NoSpaceError
+		expected string
+	}{
+		{&errors.NoSpaceError{Path: "/a", Free: 10, Required: 20},
+			"insufficient disk space for /a, free:10 required:20"},
+		{&errors.NoSpaceError{Path: "/a", Free: -1, Required: -1, Err: fmt.Errorf("write /a: no space left on device")},
+			"insufficient disk space for /a, free:-1: write /a: no space left on device"},
+	}
+	for _, v := range cases {
+		c.Assert(v.err.Error(), check.Equals, v.expected)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package metrics implements the cfg.MetricsRecorder which exports the
+// metrics of downloading in the text format of Prometheus, so that dfget
+// doesn't depend on the client library of Prometheus.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DurationBuckets are the upper bounds in seconds of the buckets of the
+// download duration histogram.
+var DurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusRecorder records the metrics of downloading in memory, and it
+// serves them in the text format of Prometheus for scraping.
+type PrometheusRecorder struct {
+	mu          sync.Mutex
+	bytes       int64
+	backSources map[int]int64
+	// durations is the histogram of each result, "success" or "fail".
+	durations map[string]*histogram
+}
+
+// histogram counts the observations not greater than each of the
+// DurationBuckets.
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// NewPrometheusRecorder creates a PrometheusRecorder with no metrics.
+func NewPrometheusRecorder() *PrometheusRecorder {
+	return &PrometheusRecorder{
+		backSources: make(map[int]int64),
+		durations:   make(map[string]*histogram),
+	}
+}
+
+// RecordBytes implements cfg.MetricsRecorder.
+func (pr *PrometheusRecorder) RecordBytes(n int64) {
+	pr.mu.Lock()
+	pr.bytes += n
+	pr.mu.Unlock()
+}
+
+// RecordDuration implements cfg.MetricsRecorder.
+func (pr *PrometheusRecorder) RecordDuration(d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "fail"
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	h, ok := pr.durations[result]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(DurationBuckets))}
+		pr.durations[result] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range DurationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// RecordBackSource implements cfg.MetricsRecorder.
+func (pr *PrometheusRecorder) RecordBackSource(reason int) {
+	pr.mu.Lock()
+	pr.backSources[reason]++
+	pr.mu.Unlock()
+}
+
+// WriteTo writes all the metrics to w in the text format of Prometheus.
+func (pr *PrometheusRecorder) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	pr.mu.Lock()
+	writeHeader(&buf, "dfget_download_bytes_total", "counter",
+		"The bytes received from source or peers.")
+	fmt.Fprintf(&buf, "dfget_download_bytes_total %d\n", pr.bytes)
+
+	writeHeader(&buf, "dfget_download_duration_seconds", "histogram",
+		"The cost of the downloads by result.")
+	for _, result := range []string{"success", "fail"} {
+		h, ok := pr.durations[result]
+		if !ok {
+			continue
+		}
+		for i, bound := range DurationBuckets {
+			fmt.Fprintf(&buf, "dfget_download_duration_seconds_bucket{result=%q,le=%q} %d\n",
+				result, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(&buf, "dfget_download_duration_seconds_bucket{result=%q,le=\"+Inf\"} %d\n",
+			result, h.count)
+		fmt.Fprintf(&buf, "dfget_download_duration_seconds_sum{result=%q} %s\n",
+			result, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&buf, "dfget_download_duration_seconds_count{result=%q} %d\n",
+			result, h.count)
+	}
+
+	writeHeader(&buf, "dfget_back_source_total", "counter",
+		"The downloads going back to source by reason.")
+	reasons := make([]int, 0, len(pr.backSources))
+	for reason := range pr.backSources {
+		reasons = append(reasons, reason)
+	}
+	sort.Ints(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&buf, "dfget_back_source_total{reason=\"%d\"} %d\n",
+			reason, pr.backSources[reason])
+	}
+	pr.mu.Unlock()
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics, so that the recorder can be registered as
+// the handler of '/metrics'.
+func (pr *PrometheusRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	pr.WriteTo(w)
+}
+
+func writeHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type MetricsSuite struct{}
+
+func init() {
+	check.Suite(&MetricsSuite{})
+}
+
+var _ cfg.MetricsRecorder = (*PrometheusRecorder)(nil)
+
+func (s *MetricsSuite) TestPrometheusRecorder(c *check.C) {
+	pr := NewPrometheusRecorder()
+	pr.RecordBytes(10)
+	pr.RecordBytes(5)
+	pr.RecordDuration(300*time.Millisecond, nil)
+	pr.RecordDuration(2*time.Second, nil)
+	pr.RecordDuration(time.Hour, fmt.Errorf("fail"))
+	pr.RecordBackSource(cfg.BackSourceReasonInitError)
+	pr.RecordBackSource(cfg.BackSourceReasonInitError)
+
+	server := httptest.NewServer(pr)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	c.Assert(err, check.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.Header.Get("Content-Type"), check.Equals, contentType)
+	body, _ := ioutil.ReadAll(resp.Body)
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(string(body), "\n") {
+		lines[line] = true
+	}
+
+	for _, line := range []string{
+		"# TYPE dfget_download_bytes_total counter",
+		"dfget_download_bytes_total 15",
+		"# TYPE dfget_download_duration_seconds histogram",
+		`dfget_download_duration_seconds_bucket{result="success",le="0.1"} 0`,
+		`dfget_download_duration_seconds_bucket{result="success",le="0.5"} 1`,
+		`dfget_download_duration_seconds_bucket{result="success",le="5"} 2`,
+		`dfget_download_duration_seconds_bucket{result="success",le="+Inf"} 2`,
+		`dfget_download_duration_seconds_sum{result="success"} 2.3`,
+		`dfget_download_duration_seconds_count{result="success"} 2`,
+		`dfget_download_duration_seconds_bucket{result="fail",le="1800"} 0`,
+		`dfget_download_duration_seconds_bucket{result="fail",le="+Inf"} 1`,
+		fmt.Sprintf(`dfget_back_source_total{reason="%d"} 2`, cfg.BackSourceReasonInitError),
+	} {
+		c.Assert(lines[line], check.Equals, true, check.Commentf("%s not in:\n%s", line, body))
+	}
+}
+
+func (s *MetricsSuite) TestPrometheusRecorder_Empty(c *check.C) {
+	var buf bytes.Buffer
+	_, err := NewPrometheusRecorder().WriteTo(&buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(buf.String(), "dfget_download_bytes_total 0\n"), check.Equals, true)
+	c.Assert(strings.Contains(buf.String(), "_bucket"), check.Equals, false)
+}
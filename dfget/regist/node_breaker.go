@@ -0,0 +1,94 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package regist
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+)
+
+// NodeBreaker opens the circuit of a supernode after threshold consecutive
+// failures against it, so that the node is skipped for cooldown instead of
+// wasting time on a flapping one. A node is tried again after the cooldown,
+// and it's opened again after another threshold consecutive failures. The
+// breaker never opens if threshold isn't positive.
+type NodeBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	failures  map[string]int
+	openUntil map[string]time.Time
+	mu        sync.Mutex
+}
+
+// NewNodeBreaker creates a NodeBreaker with all the circuits closed.
+func NewNodeBreaker(threshold int, cooldown time.Duration) *NodeBreaker {
+	return &NodeBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		failures:  make(map[string]int),
+		openUntil: make(map[string]time.Time),
+	}
+}
+
+// Allow reports whether the node can be tried, which is false until the
+// cooldown of its open circuit elapses.
+func (nb *NodeBreaker) Allow(node string) bool {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	until, ok := nb.openUntil[node]
+	return !ok || !cfg.DefaultClock.Now().Before(until)
+}
+
+// Success resets the consecutive failures of the node.
+func (nb *NodeBreaker) Success(node string) {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	delete(nb.failures, node)
+}
+
+// Failure records a failure against the node, and reports whether it opens
+// the circuit of the node.
+func (nb *NodeBreaker) Failure(node string) bool {
+	if nb.threshold <= 0 {
+		return false
+	}
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	nb.failures[node]++
+	if nb.failures[node] < nb.threshold {
+		return false
+	}
+	delete(nb.failures, node)
+	nb.openUntil[node] = cfg.DefaultClock.Now().Add(nb.cooldown)
+	return true
+}
+
+// Tripped returns the sorted nodes whose circuits have ever been opened.
+func (nb *NodeBreaker) Tripped() []string {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	nodes := make([]string, 0, len(nb.openUntil))
+	for node := range nb.openUntil {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package regist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/go-check/check"
+)
+
+// nowClock is frozen at now unless it's advanced by sleeping.
+type nowClock struct {
+	cfg.SystemClock
+	now time.Time
+}
+
+func (n *nowClock) Now() time.Time { return n.now }
+
+func (n *nowClock) Sleep(d time.Duration) { n.now = n.now.Add(d) }
+
+func (s *RegistSuite) TestNodeBreaker(c *check.C) {
+	clock := &nowClock{now: time.Unix(1500000000, 0)}
+	defer func(old cfg.Clock) { cfg.DefaultClock = old }(cfg.DefaultClock)
+	cfg.DefaultClock = clock
+
+	nb := NewNodeBreaker(2, time.Minute)
+	c.Assert(nb.Failure("a"), check.Equals, false)
+	nb.Success("a")
+	c.Assert(nb.Failure("a"), check.Equals, false)
+	c.Assert(nb.Allow("a"), check.Equals, true)
+	c.Assert(nb.Failure("a"), check.Equals, true)
+	c.Assert(nb.Allow("a"), check.Equals, false)
+	c.Assert(nb.Allow("b"), check.Equals, true)
+	c.Assert(nb.Tripped(), check.DeepEquals, []string{"a"})
+
+	clock.Sleep(time.Minute - time.Second)
+	c.Assert(nb.Allow("a"), check.Equals, false)
+	clock.Sleep(time.Second)
+	c.Assert(nb.Allow("a"), check.Equals, true)
+	// it takes another threshold consecutive failures to open it again
+	c.Assert(nb.Failure("a"), check.Equals, false)
+	c.Assert(nb.Allow("a"), check.Equals, true)
+	c.Assert(nb.Failure("a"), check.Equals, true)
+	c.Assert(nb.Allow("a"), check.Equals, false)
+
+	nb = NewNodeBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		c.Assert(nb.Failure("a"), check.Equals, false)
+	}
+	c.Assert(nb.Allow("a"), check.Equals, true)
+	c.Assert(nb.Tripped(), check.HasLen, 0)
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterBreaker(c *check.C) {
+	server := newSupernode(cfg.HTTPSuccess, nil)
+	defer server.Close()
+	another := newSupernode(cfg.HTTPSuccess, nil)
+	defer another.Close()
+	node := strings.TrimPrefix(server.URL, "http://")
+	anotherNode := strings.TrimPrefix(another.URL, "http://")
+
+	cfg.Ctx.Node = []string{node, anotherNode}
+	cfg.Ctx.NodeFailureThreshold = 2
+	cfg.Ctx.NodeCooldown = time.Hour
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	sr.ReportFailure(node)
+	sr.ReportSuccess(node)
+	sr.ReportFailure(node)
+	c.Assert(sr.breaker.Allow(node), check.Equals, true)
+	sr.ReportFailure(node)
+	c.Assert(sr.breaker.Allow(node), check.Equals, false)
+
+	for i := 0; i < 10; i++ {
+		result, err := sr.Register(0)
+		c.Assert(err, check.IsNil)
+		c.Assert(result.Node, check.Equals, anotherNode)
+	}
+
+	sr.ReportFailure(anotherNode)
+	sr.ReportFailure(anotherNode)
+	_, err := sr.Register(0)
+	c.Assert(err, check.ErrorMatches, "all nodes.* are tripped by breaker")
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterTripped(c *check.C) {
+	var count int
+	fail := newSupernode(cfg.ResultFail, nil)
+	defer fail.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		fail.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// the node failing the registration is skipped by the retries once it's
+	// tripped
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.NodeFailureThreshold = 2
+	cfg.Ctx.NodeCooldown = time.Hour
+	cfg.Ctx.MaxRetries = 5
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.ErrorMatches, "all nodes.* are tripped by breaker")
+	c.Assert(count, check.Equals, 2)
+	c.Assert(sr.breaker.Tripped(), check.DeepEquals, cfg.Ctx.Node)
+}
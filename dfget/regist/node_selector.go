@@ -0,0 +1,81 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package regist
+
+import (
+	"math/rand"
+	"sync"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+)
+
+// NodeSelector orders the supernodes randomly and proportionally to their
+// weights, so that a node with a higher weight is more likely to be tried
+// first.
+type NodeSelector struct {
+	nodes   []string
+	weights []int
+
+	rand *rand.Rand
+	mu   sync.Mutex
+}
+
+// NewNodeSelector creates a NodeSelector with the nodes in the format of
+// 'host[:port][=weight]'.
+func NewNodeSelector(nodes []string) (*NodeSelector, error) {
+	ns := &NodeSelector{
+		rand: rand.New(rand.NewSource(cfg.DefaultClock.Now().UnixNano())),
+	}
+	for _, node := range nodes {
+		addr, weight, err := cfg.ParseNode(node)
+		if err != nil {
+			return nil, err
+		}
+		ns.nodes = append(ns.nodes, addr)
+		ns.weights = append(ns.weights, weight)
+	}
+	return ns, nil
+}
+
+// Order returns all the nodes in a weighted random order. The caller should
+// try them one by one and skip the failed ones. Every call starts over with
+// all the nodes, so the failed nodes will be retried by the next request.
+func (ns *NodeSelector) Order() []string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	var (
+		nodes   = append([]string(nil), ns.nodes...)
+		weights = append([]int(nil), ns.weights...)
+		total   = 0
+		result  = make([]string, 0, len(nodes))
+	)
+	for _, w := range weights {
+		total += w
+	}
+	for len(nodes) > 0 {
+		i, r := 0, ns.rand.Intn(total)
+		for ; r >= weights[i]; i++ {
+			r -= weights[i]
+		}
+		result = append(result, nodes[i])
+		total -= weights[i]
+		nodes = append(nodes[:i], nodes[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return result
+}
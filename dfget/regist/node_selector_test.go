@@ -0,0 +1,53 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package regist
+
+import (
+	"sort"
+
+	"github.com/go-check/check"
+)
+
+func (s *RegistSuite) TestNewNodeSelector(c *check.C) {
+	ns, err := NewNodeSelector([]string{"127.0.0.1", "127.0.0.2:8080=3"})
+	c.Assert(err, check.IsNil)
+	c.Assert(ns.nodes, check.DeepEquals, []string{"127.0.0.1:8002", "127.0.0.2:8080"})
+	c.Assert(ns.weights, check.DeepEquals, []int{1, 3})
+
+	_, err = NewNodeSelector([]string{"127.0.0.1=x"})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *RegistSuite) TestNodeSelector_Order(c *check.C) {
+	ns, _ := NewNodeSelector([]string{"a=9", "b=1", "c=90"})
+
+	var (
+		count = 1000
+		first = make(map[string]int)
+	)
+	for i := 0; i < count; i++ {
+		nodes := ns.Order()
+		first[nodes[0]]++
+		sort.Strings(nodes)
+		c.Assert(nodes, check.DeepEquals, []string{"a:8002", "b:8002", "c:8002"})
+	}
+	c.Assert(first["c:8002"] > first["a:8002"], check.Equals, true, check.Commentf("%v", first))
+	c.Assert(first["a:8002"] > first["b:8002"], check.Equals, true, check.Commentf("%v", first))
+
+	ns, _ = NewNodeSelector(nil)
+	c.Assert(ns.Order(), check.HasLen, 0)
+}
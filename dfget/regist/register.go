@@ -0,0 +1,432 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package regist implements the registration of the downloading task to
+// supernodes.
+package regist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/types"
+	"github.com/alibaba/Dragonfly/dfget/util"
+	"github.com/alibaba/Dragonfly/version"
+)
+
+const (
+	connectTimeout  = 2 * time.Second
+	registerTimeout = 5 * time.Second
+	waitAuthPeriod  = 2500 * time.Millisecond
+
+	// retryBaseInterval is the interval before the first retry, and it's
+	// doubled for each of the following ones.
+	retryBaseInterval = 500 * time.Millisecond
+
+	// taskIdentifierKey is the query key of the identifier in task url.
+	taskIdentifierKey = "dfIdentifier"
+)
+
+// RegisterResult is the result of registering to supernode.
+type RegisterResult struct {
+	Node       string
+	TaskID     string
+	FileLength int64
+	PieceSize  int32
+}
+
+// SupernodeRegister registers the downloading task to supernodes.
+type SupernodeRegister struct {
+	ctx      *cfg.Context
+	selector *NodeSelector
+	breaker  *NodeBreaker
+	client   *http.Client
+	// rand picks the jittered retry intervals, and it's seeded with the time
+	// xor the pid so that the clients started at the same time don't retry
+	// in lockstep.
+	rand *rand.Rand
+}
+
+var (
+	// sharedBreakers are the breakers of supernodes keyed by the threshold
+	// and the cooldown, so that a flapping node tripped by one download is
+	// skipped by all the other ones of the process.
+	sharedBreakers   = make(map[string]*NodeBreaker)
+	sharedBreakersMu sync.Mutex
+)
+
+// sharedBreaker returns the NodeBreaker of the process with the threshold
+// and the cooldown of ctx.
+func sharedBreaker(ctx *cfg.Context) *NodeBreaker {
+	key := strconv.Itoa(ctx.NodeFailureThreshold) + "|" + ctx.NodeCooldown.String()
+	sharedBreakersMu.Lock()
+	defer sharedBreakersMu.Unlock()
+	if nb, ok := sharedBreakers[key]; ok {
+		return nb
+	}
+	nb := NewNodeBreaker(ctx.NodeFailureThreshold, ctx.NodeCooldown)
+	sharedBreakers[key] = nb
+	return nb
+}
+
+// NewSupernodeRegister creates a SupernodeRegister with the nodes of ctx, and
+// the breaker of the nodes is shared by all the ones of the process.
+func NewSupernodeRegister(ctx *cfg.Context) (*SupernodeRegister, error) {
+	selector, err := NewNodeSelector(ctx.Node)
+	if err != nil {
+		return nil, err
+	}
+	return &SupernodeRegister{
+		ctx:      ctx,
+		selector: selector,
+		breaker:  sharedBreaker(ctx),
+		client:   &http.Client{Timeout: registerTimeout},
+		rand:     newRand(),
+	}, nil
+}
+
+// ForContext returns a SupernodeRegister registering the task of ctx, which
+// shares the nodes, the breaker and the connections to supernodes with sr,
+// so that the tasks of a batch are registered in one session. It can be used
+// concurrently with sr.
+func (sr *SupernodeRegister) ForContext(ctx *cfg.Context) *SupernodeRegister {
+	return &SupernodeRegister{
+		ctx:      ctx,
+		selector: sr.selector,
+		breaker:  sr.breaker,
+		client:   sr.client,
+		rand:     newRand(),
+	}
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(cfg.DefaultClock.Now().UnixNano() ^ int64(os.Getpid())))
+}
+
+// Register registers the task to the supernodes in the order picked by the
+// NodeSelector, and the unreachable ones and the ones tripped by the breaker
+// are skipped. Each failure against a node is reported to the breaker, so a
+// node failing consecutively is skipped by the following retries.
+// The port is where the local peer server listens on, 0 if it's not launched,
+// and it's always 0 if ctx.NoServe is set.
+// The nodes are resolved by ctx.NodeResolver before each attempt if it's set.
+// If all the nodes fail, it retries at most ctx.MaxRetries times with
+// exponential backoff capped at ctx.RetryInterval, and the interval is a
+// random one not exceeding the backoff if ctx.RetryJitter is set.
+func (sr *SupernodeRegister) Register(port int) (*RegisterResult, error) {
+	return sr.RegisterContext(context.Background(), port)
+}
+
+// RegisterContext is like Register, but the requests to supernodes and the
+// intervals between retries are canceled once goctx is done, and goctx.Err()
+// is returned then.
+func (sr *SupernodeRegister) RegisterContext(goctx context.Context, port int) (*RegisterResult, error) {
+	for i := 0; ; i++ {
+		sr.resolveNodes()
+		result, retryable, err := sr.registerNodes(goctx, port)
+		if goctx.Err() != nil {
+			return nil, goctx.Err()
+		}
+		if err == nil || !retryable || i >= sr.ctx.MaxRetries {
+			return result, err
+		}
+		interval := sr.retryInterval(i)
+		sr.ctx.ClientLogger.Warnf("%v, retry %d after %v", err, i+1, interval)
+		if err := sleep(goctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep pauses for d by cfg.DefaultClock, and it returns goctx.Err() once
+// goctx is done before that.
+func sleep(goctx context.Context, d time.Duration) error {
+	select {
+	case <-cfg.DefaultClock.After(d):
+		return nil
+	case <-goctx.Done():
+		return goctx.Err()
+	}
+}
+
+// resolveNodes replaces the nodes of selector with the ones returned by
+// ctx.NodeResolver, and the previous ones are kept if they're invalid.
+func (sr *SupernodeRegister) resolveNodes() {
+	if sr.ctx.NodeResolver == nil {
+		return
+	}
+	nodes := sr.ctx.NodeResolver()
+	selector, err := NewNodeSelector(nodes)
+	if err != nil {
+		sr.ctx.ClientLogger.Warnf("ignore resolved nodes%v error:%v", nodes, err)
+		return
+	}
+	sr.selector = selector
+}
+
+// ReportFailure records a failure of the requests to the node, such as the
+// registration. The node is skipped by Register for ctx.NodeCooldown after
+// ctx.NodeFailureThreshold consecutive ones, so that the task can be
+// registered to the next node or back-source.
+func (sr *SupernodeRegister) ReportFailure(node string) {
+	if sr.breaker.Failure(node) {
+		sr.ctx.ClientLogger.Debugf("node:%s is tripped by %d consecutive failures for %v, tripped nodes%v",
+			node, sr.ctx.NodeFailureThreshold, sr.ctx.NodeCooldown, sr.breaker.Tripped())
+	}
+}
+
+// ReportSuccess resets the consecutive failures of the node.
+func (sr *SupernodeRegister) ReportSuccess(node string) {
+	sr.breaker.Success(node)
+}
+
+// registerNodes tries each node once, and reports whether it's worth
+// retrying if all of them fail. It isn't if all of them are tripped.
+func (sr *SupernodeRegister) registerNodes(goctx context.Context, port int) (*RegisterResult, bool, error) {
+	var tripped int
+	nodes := sr.selector.Order()
+	for _, node := range nodes {
+		if goctx.Err() != nil {
+			return nil, false, goctx.Err()
+		}
+		if !sr.breaker.Allow(node) {
+			sr.ctx.ClientLogger.Debugf("skip node:%s tripped by breaker", node)
+			tripped++
+			continue
+		}
+		ip, err := localIP(goctx, node)
+		if err != nil {
+			sr.ctx.ClientLogger.Warnf("skip unreachable node:%s error:%v", node, err)
+			sr.ReportFailure(node)
+			continue
+		}
+
+		start := cfg.DefaultClock.Now()
+		resp, err := sr.register(goctx, node, sr.newRegisterRequest(ip, port))
+		sr.ctx.ClientLogger.Debugf("register to node:%s cost:%.3fs", node, cfg.Since(start).Seconds())
+		if err != nil {
+			sr.ctx.ClientLogger.Errorf("register to node:%s error:%v", node, err)
+			sr.ReportFailure(node)
+			continue
+		}
+		if resp.Code == cfg.TaskCodeNeedAuth {
+			return nil, false, fmt.Errorf("register to node:%s need auth", node)
+		}
+		if resp.Code != cfg.HTTPSuccess || resp.Data == nil {
+			sr.ctx.ClientLogger.Errorf("register to node:%s fail, code:%d msg:%s",
+				node, resp.Code, resp.Msg)
+			sr.ReportFailure(node)
+			continue
+		}
+		sr.ReportSuccess(node)
+
+		sr.ctx.ClientLogger.Infof("register to node:%s success, taskID:%s",
+			node, resp.Data.TaskID)
+		if sr.ctx.PieceSize > 0 && int(resp.Data.PieceSize) != sr.ctx.PieceSize {
+			sr.ctx.ClientLogger.Infof("piece size:%d is clamped to %d by node:%s",
+				sr.ctx.PieceSize, resp.Data.PieceSize, node)
+		}
+		return &RegisterResult{
+			Node:       node,
+			TaskID:     resp.Data.TaskID,
+			FileLength: resp.Data.FileLength,
+			PieceSize:  resp.Data.PieceSize,
+		}, false, nil
+	}
+	if len(nodes) > 0 && tripped == len(nodes) {
+		return nil, false, fmt.Errorf("all nodes%v are tripped by breaker", sr.selector.nodes)
+	}
+	return nil, true, fmt.Errorf("register to all nodes%v fail", sr.selector.nodes)
+}
+
+func (sr *SupernodeRegister) newRegisterRequest(ip string, port int) *types.RegisterRequest {
+	hostName, _ := os.Hostname()
+	// the identifier isn't needed to derive the task id if it's supplied
+	identifier := sr.ctx.Identifier
+	if !util.IsEmptyStr(sr.ctx.TaskID) {
+		identifier = ""
+	}
+	req := &types.RegisterRequest{
+		RawURL:       sr.ctx.URL,
+		TaskURL:      taskURL(util.FilterURLParam(sr.ctx.URL, sr.ctx.Filter), identifier),
+		Version:      version.DFGetVersion,
+		Port:         port,
+		Path:         cfg.PeerHTTPPathPrefix + filepath.Base(sr.ctx.Output) + "-" + sr.ctx.Sign,
+		CallSystem:   sr.ctx.CallSystem,
+		Cid:          ip + "-" + sr.ctx.Sign,
+		IP:           ip,
+		HostName:     hostName,
+		Headers:      sr.ctx.Header,
+		Md5:          sr.ctx.Md5,
+		Identifier:   sr.ctx.Identifier,
+		TaskID:       sr.ctx.TaskID,
+		Dfdaemon:     sr.ctx.DFDaemon,
+		Pattern:      sr.ctx.Pattern,
+		PieceSize:    int32(sr.ctx.PieceSize),
+		Force:        sr.ctx.Force,
+		DownloadOnly: sr.ctx.NoServe,
+	}
+	// the peer server is never launched to serve the pieces
+	if sr.ctx.NoServe {
+		req.Port = 0
+	}
+	return req
+}
+
+// taskURL returns the url identifying the task on supernode. The identifier
+// is appended to its query so that the tasks of different identifiers never
+// share pieces even if they have the same url and md5, and the url is kept
+// as is if the identifier is empty.
+func taskURL(rawURL, identifier string) string {
+	if util.IsEmptyStr(identifier) {
+		return rawURL
+	}
+	u, fragment := rawURL, ""
+	if idx := strings.IndexByte(rawURL, '#'); idx >= 0 {
+		u, fragment = rawURL[:idx], rawURL[idx:]
+	}
+	sep := "&"
+	if !strings.Contains(u, "?") {
+		sep = "?"
+	} else if strings.HasSuffix(u, "?") || strings.HasSuffix(u, "&") {
+		sep = ""
+	}
+	return u + sep + taskIdentifierKey + "=" + url.QueryEscape(identifier) + fragment
+}
+
+// register posts the request to the node, and waits until the auth of the
+// task is finished.
+func (sr *SupernodeRegister) register(goctx context.Context, node string, req *types.RegisterRequest) (
+	*types.RegisterResponse, error) {
+	form := encodeRegisterRequest(req)
+	form.Set("superNodeIp", node)
+	for {
+		httpReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/peer/registry",
+			cfg.SchemaHTTP, node), strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := sr.client.Do(httpReq.WithContext(goctx))
+		if err != nil {
+			return nil, err
+		}
+		result := new(types.RegisterResponse)
+		err = json.NewDecoder(resp.Body).Decode(result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode response error: %v", err)
+		}
+		if result.BaseResponse == nil {
+			return nil, fmt.Errorf("invalid response")
+		}
+		if result.Code != cfg.TaskCodeWaitAuth {
+			return result, nil
+		}
+		sr.ctx.ClientLogger.Infof("wait auth...")
+		if err := sleep(goctx, waitAuthPeriod); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func encodeRegisterRequest(req *types.RegisterRequest) url.Values {
+	form := url.Values{}
+	form.Set("rawUrl", req.RawURL)
+	form.Set("taskUrl", req.TaskURL)
+	if !util.IsEmptyStr(req.Md5) {
+		form.Set("md5", req.Md5)
+	}
+	if !util.IsEmptyStr(req.Identifier) {
+		form.Set("identifier", req.Identifier)
+	}
+	// the supernode uses the task id as is instead of deriving it
+	if !util.IsEmptyStr(req.TaskID) {
+		form.Set("taskId", req.TaskID)
+	}
+	form.Set("version", req.Version)
+	form.Set("port", strconv.Itoa(req.Port))
+	form.Set("path", req.Path)
+	form.Set("callSystem", req.CallSystem)
+	form.Set("cid", req.Cid)
+	form.Set("ip", req.IP)
+	form.Set("hostName", req.HostName)
+	for _, header := range req.Headers {
+		form.Add("headers", header)
+	}
+	form.Set("dfdaemon", strconv.FormatBool(req.Dfdaemon))
+	// the supernode serves the pieces from its cdn if the pattern is 'cdn'
+	if !util.IsEmptyStr(req.Pattern) {
+		form.Set("pattern", req.Pattern)
+	}
+	// the supernode decides the piece size if it's not asked for
+	if req.PieceSize > 0 {
+		form.Set("pieceSize", strconv.Itoa(int(req.PieceSize)))
+	}
+	// the supernode fetches the file from source again instead of reusing
+	// its cached task
+	if req.Force {
+		form.Set("force", "true")
+	}
+	// the supernode never schedules the pieces of this peer to the others
+	if req.DownloadOnly {
+		form.Set("downloadOnly", "true")
+	}
+	return form
+}
+
+// localIP connects to the node and returns the local ip of the connection.
+func localIP(goctx context.Context, node string) (string, error) {
+	conn, err := (&net.Dialer{Timeout: connectTimeout}).DialContext(goctx, "tcp", node)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	return host, err
+}
+
+// retryInterval returns the interval before the i-th retry, which is the
+// backoff with full jitter if ctx.RetryJitter is set.
+func (sr *SupernodeRegister) retryInterval(i int) time.Duration {
+	interval := backoff(i, sr.ctx.RetryInterval)
+	if !sr.ctx.RetryJitter || interval <= 0 {
+		return interval
+	}
+	return time.Duration(sr.rand.Int63n(int64(interval) + 1))
+}
+
+// backoff returns the interval before the i-th retry which starts from
+// retryBaseInterval and doubles each time, but never exceeds max.
+func backoff(i int, max time.Duration) time.Duration {
+	interval := retryBaseInterval << uint(i)
+	if interval <= 0 || interval > max {
+		return max
+	}
+	return interval
+}
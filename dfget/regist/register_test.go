@@ -0,0 +1,446 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package regist
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/types"
+	"github.com/go-check/check"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type RegistSuite struct{}
+
+func init() {
+	check.Suite(&RegistSuite{})
+}
+
+func (s *RegistSuite) SetUpTest(c *check.C) {
+	cfg.Reset()
+	cfg.Ctx.ClientLogger = logrus.New()
+	cfg.Ctx.ClientLogger.Out = ioutil.Discard
+	cfg.Ctx.ServerLogger = cfg.Ctx.ClientLogger
+	cfg.Ctx.URL = "http://a.b/c"
+	cfg.Ctx.Output = "/tmp/c"
+	cfg.Ctx.RetryInterval = time.Millisecond
+	sharedBreakers = make(map[string]*NodeBreaker)
+}
+
+// newSupernode starts a fake supernode which saves the register request
+// into the form and replies with the code.
+func newSupernode(code int, form *url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/peer/registry" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r.ParseForm()
+		if form != nil {
+			*form = r.PostForm
+		}
+		resp := &types.RegisterResponse{BaseResponse: types.NewBaseResponse(code, "")}
+		if code == cfg.HTTPSuccess {
+			resp.Data = &types.RegisterResponseData{
+				TaskID:     "task",
+				FileLength: 100,
+				PieceSize:  4194304,
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func (s *RegistSuite) TestSupernodeRegister_Register(c *check.C) {
+	var form url.Values
+	server := newSupernode(cfg.HTTPSuccess, &form)
+	defer server.Close()
+	failed := newSupernode(cfg.ResultFail, nil)
+	defer failed.Close()
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	cfg.Ctx.Node = []string{
+		"127.0.0.1:1=100",
+		strings.TrimPrefix(failed.URL, "http://") + "=100",
+		addr,
+	}
+	cfg.Ctx.Md5 = "d41d8cd98f00b204e9800998ecf8427e"
+	cfg.Ctx.Identifier = "id"
+	cfg.Ctx.CallSystem = "unit-test"
+	cfg.Ctx.Header = []string{"a:0", "b:1"}
+	cfg.Ctx.Pattern = cfg.PatternCDN
+
+	sr, err := NewSupernodeRegister(cfg.Ctx)
+	c.Assert(err, check.IsNil)
+	result, err := sr.Register(15001)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, &RegisterResult{
+		Node:       addr,
+		TaskID:     "task",
+		FileLength: 100,
+		PieceSize:  4194304,
+	})
+
+	c.Assert(form.Get("rawUrl"), check.Equals, cfg.Ctx.URL)
+	c.Assert(form.Get("taskUrl"), check.Equals, cfg.Ctx.URL+"?dfIdentifier=id")
+	c.Assert(form.Get("md5"), check.Equals, cfg.Ctx.Md5)
+	c.Assert(form.Get("identifier"), check.Equals, "id")
+	c.Assert(form.Get("callSystem"), check.Equals, cfg.Ctx.CallSystem)
+	c.Assert(form.Get("port"), check.Equals, "15001")
+	c.Assert(form.Get("path"), check.Equals, "/peer/file/c-"+cfg.Ctx.Sign)
+	c.Assert(form.Get("cid"), check.Equals, "127.0.0.1-"+cfg.Ctx.Sign)
+	c.Assert(form.Get("superNodeIp"), check.Equals, addr)
+	c.Assert(form["headers"], check.DeepEquals, cfg.Ctx.Header)
+	c.Assert(form.Get("dfdaemon"), check.Equals, "false")
+	c.Assert(form.Get("pattern"), check.Equals, cfg.PatternCDN)
+	c.Assert(form["pieceSize"], check.IsNil)
+	c.Assert(form["force"], check.IsNil)
+	c.Assert(form["downloadOnly"], check.IsNil)
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterNoServe(c *check.C) {
+	var form url.Values
+	server := newSupernode(cfg.HTTPSuccess, &form)
+	defer server.Close()
+
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.NoServe = true
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(15001)
+	c.Assert(err, check.IsNil)
+	c.Assert(form.Get("downloadOnly"), check.Equals, "true")
+	c.Assert(form.Get("port"), check.Equals, "0")
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterForce(c *check.C) {
+	var form url.Values
+	server := newSupernode(cfg.HTTPSuccess, &form)
+	defer server.Close()
+
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.Force = true
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(form.Get("force"), check.Equals, "true")
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterPieceSize(c *check.C) {
+	var form url.Values
+	server := newSupernode(cfg.HTTPSuccess, &form)
+	defer server.Close()
+
+	var logs bytes.Buffer
+	cfg.Ctx.ClientLogger.Out = &logs
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.PieceSize = 16 * 1024 * 1024
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	result, err := sr.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(form.Get("pieceSize"), check.Equals, "16777216")
+	// the piece size clamped by supernode is used
+	c.Assert(result.PieceSize, check.Equals, int32(4194304))
+	c.Assert(logs.String(), check.Matches, "(?s).*piece size:16777216 is clamped to 4194304.*")
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterTaskID(c *check.C) {
+	var form url.Values
+	server := newSupernode(cfg.HTTPSuccess, &form)
+	defer server.Close()
+
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.Identifier = "id"
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(form.Get("taskUrl"), check.Equals, cfg.Ctx.URL+"?dfIdentifier=id")
+	c.Assert(form["taskId"], check.IsNil)
+
+	cfg.Ctx.TaskID = "0123456789abcdef"
+	_, err = sr.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(form.Get("taskUrl"), check.Equals, cfg.Ctx.URL)
+	c.Assert(form.Get("identifier"), check.Equals, "id")
+	c.Assert(form.Get("taskId"), check.Equals, cfg.Ctx.TaskID)
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterFilter(c *check.C) {
+	var form url.Values
+	server := newSupernode(cfg.HTTPSuccess, &form)
+	defer server.Close()
+
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.URL = "http://a.b/c?x=1&expires=100&sign=abc"
+	cfg.Ctx.Filter = []string{"expires", "sign"}
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(form.Get("rawUrl"), check.Equals, cfg.Ctx.URL)
+	c.Assert(form.Get("taskUrl"), check.Equals, "http://a.b/c?x=1")
+}
+
+func (s *RegistSuite) TestTaskURL(c *check.C) {
+	var cases = []struct {
+		url        string
+		identifier string
+		expected   string
+	}{
+		{"http://a.b/c", "", "http://a.b/c"},
+		{"http://a.b/c?x=1#f", "", "http://a.b/c?x=1#f"},
+		{"http://a.b/c", "id", "http://a.b/c?dfIdentifier=id"},
+		{"http://a.b/c?", "id", "http://a.b/c?dfIdentifier=id"},
+		{"http://a.b/c?x=1", "id", "http://a.b/c?x=1&dfIdentifier=id"},
+		{"http://a.b/c?x=1&", "id", "http://a.b/c?x=1&dfIdentifier=id"},
+		{"http://a.b/c#f", "id", "http://a.b/c?dfIdentifier=id#f"},
+		{"http://a.b/c", "tenant a&b", "http://a.b/c?dfIdentifier=tenant+a%26b"},
+	}
+
+	for _, v := range cases {
+		c.Assert(taskURL(v.url, v.identifier), check.Equals, v.expected, check.Commentf("%v", v))
+	}
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterFail(c *check.C) {
+	server := newSupernode(cfg.TaskCodeNeedAuth, nil)
+	defer server.Close()
+
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.ErrorMatches, ".*need auth")
+
+	cfg.Ctx.Node = []string{"127.0.0.1:1"}
+	sr, _ = NewSupernodeRegister(cfg.Ctx)
+	_, err = sr.Register(0)
+	c.Assert(err, check.ErrorMatches, "register to all nodes.* fail")
+}
+
+func (s *RegistSuite) TestSupernodeRegister_ForContext(c *check.C) {
+	var form url.Values
+	server := newSupernode(cfg.HTTPSuccess, &form)
+	defer server.Close()
+
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	sr, err := NewSupernodeRegister(cfg.Ctx)
+	c.Assert(err, check.IsNil)
+	runtime := cfg.Ctx.Clone()
+	runtime.URL = "http://a.b/d"
+	session := sr.ForContext(runtime)
+	c.Assert(session.selector, check.Equals, sr.selector)
+	c.Assert(session.breaker, check.Equals, sr.breaker)
+	c.Assert(session.client, check.Equals, sr.client)
+
+	_, err = session.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(form.Get("rawUrl"), check.Equals, runtime.URL)
+}
+
+func (s *RegistSuite) TestSupernodeRegister_SharedBreaker(c *check.C) {
+	cfg.Ctx.Node = []string{"127.0.0.1:1"}
+	cfg.Ctx.MaxRetries = 0
+	cfg.Ctx.NodeFailureThreshold = 1
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.ErrorMatches, "register to all nodes.* fail")
+
+	// the node tripped by the previous download is skipped by the next one
+	runtime := cfg.Ctx.Clone()
+	runtime.URL = "http://a.b/d"
+	sr, _ = NewSupernodeRegister(runtime)
+	_, err = sr.Register(0)
+	c.Assert(err, check.ErrorMatches, "all nodes.* are tripped by breaker")
+
+	runtime.NodeFailureThreshold = 2
+	sr, _ = NewSupernodeRegister(runtime)
+	c.Assert(sr.breaker.Allow("127.0.0.1:1"), check.Equals, true)
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterRetry(c *check.C) {
+	var count int
+	success := newSupernode(cfg.HTTPSuccess, nil)
+	defer success.Close()
+	fail := newSupernode(cfg.ResultFail, nil)
+	defer fail.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count <= 2 {
+			fail.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		success.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.NodeFailureThreshold = 0
+
+	cfg.Ctx.MaxRetries = 1
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.ErrorMatches, "register to all nodes.* fail")
+	c.Assert(count, check.Equals, 2)
+
+	count = 0
+	cfg.Ctx.MaxRetries = 2
+	result, err := sr.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.TaskID, check.Equals, "task")
+	c.Assert(count, check.Equals, 3)
+}
+
+// sleepClock records the durations slept instead of sleeping.
+type sleepClock struct {
+	cfg.SystemClock
+	slept []time.Duration
+}
+
+func (s *sleepClock) Sleep(d time.Duration) { s.slept = append(s.slept, d) }
+
+func (s *sleepClock) After(d time.Duration) <-chan time.Time {
+	s.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- s.Now()
+	return ch
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterRetryBackoff(c *check.C) {
+	clock := new(sleepClock)
+	defer func(old cfg.Clock) { cfg.DefaultClock = old }(cfg.DefaultClock)
+	cfg.DefaultClock = clock
+
+	cfg.Ctx.Node = []string{"127.0.0.1:1"}
+	cfg.Ctx.MaxRetries = 4
+	cfg.Ctx.RetryInterval = 10 * retryBaseInterval
+	cfg.Ctx.RetryJitter = false
+	cfg.Ctx.NodeFailureThreshold = 0
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	_, err := sr.Register(0)
+	c.Assert(err, check.NotNil)
+	c.Assert(clock.slept, check.DeepEquals, []time.Duration{retryBaseInterval, 2 * retryBaseInterval,
+		4 * retryBaseInterval, 8 * retryBaseInterval})
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterContext(c *check.C) {
+	server := newSupernode(cfg.TaskCodeWaitAuth, nil)
+	defer server.Close()
+
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	// the wait for auth is canceled
+	goctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := sr.RegisterContext(goctx, 0)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < waitAuthPeriod, check.Equals, true)
+
+	// so is the interval between retries
+	cfg.Ctx.Node = []string{"127.0.0.1:1"}
+	cfg.Ctx.MaxRetries = 3
+	cfg.Ctx.RetryInterval = time.Hour
+	cfg.Ctx.RetryJitter = false
+	sr, _ = NewSupernodeRegister(cfg.Ctx)
+	goctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = sr.RegisterContext(goctx, 0)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+
+	goctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = sr.RegisterContext(goctx, 0)
+	c.Assert(err, check.Equals, context.Canceled)
+}
+
+func (s *RegistSuite) TestSupernodeRegister_RegisterNodeResolver(c *check.C) {
+	server := newSupernode(cfg.HTTPSuccess, nil)
+	defer server.Close()
+
+	var resolved [][]string
+	cfg.Ctx.Node = []string{strings.TrimPrefix(server.URL, "http://")}
+	cfg.Ctx.MaxRetries = 2
+	cfg.Ctx.RetryInterval = 0
+	cfg.Ctx.NodeResolver = func() []string {
+		nodes := [][]string{{"127.0.0.1:1"}, {"=1"}, cfg.Ctx.Node}[len(resolved)]
+		resolved = append(resolved, nodes)
+		return nodes
+	}
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+	result, err := sr.Register(0)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Node, check.Equals, cfg.Ctx.Node[0])
+	c.Assert(len(resolved), check.Equals, 3)
+
+	resolved = nil
+	cfg.Ctx.MaxRetries = 0
+	_, err = sr.Register(0)
+	c.Assert(err, check.ErrorMatches, `register to all nodes\[127.0.0.1:1\] fail`)
+}
+
+func (s *RegistSuite) TestSupernodeRegister_retryInterval(c *check.C) {
+	cfg.Ctx.Node = []string{"127.0.0.1:1"}
+	cfg.Ctx.RetryInterval = time.Second
+	sr, _ := NewSupernodeRegister(cfg.Ctx)
+
+	cfg.Ctx.RetryJitter = false
+	c.Assert(sr.retryInterval(1), check.Equals, 2*retryBaseInterval)
+
+	cfg.Ctx.RetryJitter = true
+	intervals := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		interval := sr.retryInterval(1)
+		c.Assert(interval >= 0 && interval <= 2*retryBaseInterval, check.Equals, true,
+			check.Commentf("interval:%v", interval))
+		intervals[interval] = true
+	}
+	c.Assert(len(intervals) > 1, check.Equals, true)
+
+	cfg.Ctx.RetryInterval = 0
+	c.Assert(sr.retryInterval(1), check.Equals, time.Duration(0))
+}
+
+func (s *RegistSuite) TestBackoff(c *check.C) {
+	var cases = []struct {
+		i        int
+		max      time.Duration
+		expected time.Duration
+	}{
+		{0, time.Minute, retryBaseInterval},
+		{1, time.Minute, 2 * retryBaseInterval},
+		{3, time.Minute, 8 * retryBaseInterval},
+		{3, time.Second, time.Second},
+		{100, time.Second, time.Second},
+		{0, 0, 0},
+	}
+
+	for _, cc := range cases {
+		c.Assert(backoff(cc.i, cc.max), check.Equals, cc.expected,
+			check.Commentf("i:%d max:%v", cc.i, cc.max))
+	}
+}
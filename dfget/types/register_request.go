@@ -19,17 +19,22 @@ package types
 // RegisterRequest contains all the parameters that need to be passed to the
 // supernode when registering a downloading task.
 type RegisterRequest struct {
-	RawURL     string `json:"rawUrl"`
-	TaskURL    string `json:"taskUrl"`
-	Md5        string `json:"md5"`
-	Identifier string `json:"identifier"`
-	Version    string `json:"version"`
-	Port       int    `json:"port"`
-	Path       string `json:"path"`
-	CallSystem string `json:"callSystem"`
-	Cid        string `json:"cid"`
-	IP         string `json:"ip"`
-	HostName   string `json:"hostName"`
-	Headers    string `json:"headers"`
-	Dfdaemon   bool   `json:"dfdaemon"`
+	RawURL       string   `json:"rawUrl"`
+	TaskURL      string   `json:"taskUrl"`
+	Md5          string   `json:"md5"`
+	Identifier   string   `json:"identifier"`
+	TaskID       string   `json:"taskId"`
+	Version      string   `json:"version"`
+	Port         int      `json:"port"`
+	Path         string   `json:"path"`
+	CallSystem   string   `json:"callSystem"`
+	Cid          string   `json:"cid"`
+	IP           string   `json:"ip"`
+	HostName     string   `json:"hostName"`
+	Headers      []string `json:"headers"`
+	Dfdaemon     bool     `json:"dfdaemon"`
+	Pattern      string   `json:"pattern"`
+	PieceSize    int32    `json:"pieceSize"`
+	Force        bool     `json:"force"`
+	DownloadOnly bool     `json:"downloadOnly"`
 }
@@ -18,3 +18,16 @@
 // - peer - in P2P pattern that will wait for other P2PDownloader to download
 // its downloaded files.
 package uploader
+
+import (
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/util"
+)
+
+// NewUploadLimiter creates the rate limiter shared by all the pieces served to
+// other peers, which is limited by ctx.UploadLimit. It's independent of the
+// one of LocalLimit, so that uploading never starves downloading and vice
+// versa.
+func NewUploadLimiter(ctx *cfg.Context) *util.RateLimiter {
+	return util.NewLimitRateLimiter(ctx.UploadLimit)
+}
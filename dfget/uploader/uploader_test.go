@@ -15,3 +15,50 @@
  */
 
 package uploader
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cfg "github.com/alibaba/Dragonfly/dfget/config"
+	"github.com/alibaba/Dragonfly/dfget/util"
+	"github.com/go-check/check"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+type UploaderSuite struct{}
+
+func init() {
+	check.Suite(&UploaderSuite{})
+}
+
+func (s *UploaderSuite) TestNewUploadLimiter(c *check.C) {
+	ctx := cfg.NewContext()
+	ctx.LocalLimit, ctx.UploadLimit = 2000, 2000
+	var (
+		upload = util.NewLimitReaderWithLimiter(strings.NewReader(strings.Repeat("x", 2000)), NewUploadLimiter(ctx))
+		down   = util.NewLimitReader(strings.NewReader(strings.Repeat("x", 2000)), ctx.LocalLimit)
+		wg     sync.WaitGroup
+		start  = time.Now()
+	)
+	for _, r := range []io.Reader{upload, down} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			ioutil.ReadAll(r)
+		}(r)
+	}
+	wg.Wait()
+
+	// each of them is limited by 2000 bytes per second, but they don't share
+	// the tokens
+	cost := int64(time.Since(start) / time.Millisecond)
+	c.Assert(cost >= 1000 && cost < 2000, check.Equals, true, check.Commentf("cost:%d", cost))
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minThroughputGain is the least ratio by which the throughput must
+	// improve for one more worker to be worth it.
+	minThroughputGain = 0.1
+	// limitHitRatio is the ratio of the limit above which the throughput is
+	// regarded as having hit the limit.
+	limitHitRatio = 0.9
+)
+
+// ConcurrencyTuner tunes the number of workers by the throughput they
+// achieve. It starts at one worker and adds one more each window while the
+// throughput keeps improving, and it settles once the throughput plateaus,
+// backing off the worker which didn't help, or once it hits the limit.
+type ConcurrencyTuner struct {
+	max   int
+	limit float64
+
+	// bytes are transferred since the last window, and it's accessed
+	// atomically.
+	bytes   int64
+	current int
+	best    float64
+	settled bool
+	last    time.Time
+
+	mu sync.Mutex
+}
+
+// NewConcurrencyTuner creates a ConcurrencyTuner whose first window starts
+// at now, and the workers never exceed max.
+// limit: bytes per second of all the workers, 0 represents no limit.
+func NewConcurrencyTuner(max, limit int, now time.Time) *ConcurrencyTuner {
+	if max < 1 {
+		max = 1
+	}
+	return &ConcurrencyTuner{
+		max:     max,
+		limit:   float64(limit),
+		current: 1,
+		last:    now,
+	}
+}
+
+// Add records n bytes transferred by the workers.
+func (t *ConcurrencyTuner) Add(n int64) {
+	atomic.AddInt64(&t.bytes, n)
+}
+
+// Concurrency returns the number of workers to run.
+func (t *ConcurrencyTuner) Concurrency() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// Settled reports whether the concurrency is no longer tuned.
+func (t *ConcurrencyTuner) Settled() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.settled
+}
+
+// Tune ends the window at now and tunes the concurrency by the throughput
+// of it, and it returns the concurrency. The window without any bytes
+// transferred is skipped rather than regarded as a plateau.
+func (t *ConcurrencyTuner) Tune(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := now.Sub(t.last)
+	if t.settled || elapsed <= 0 {
+		return t.current
+	}
+	n := atomic.SwapInt64(&t.bytes, 0)
+	t.last = now
+	if n <= 0 {
+		return t.current
+	}
+	rate := float64(n) / elapsed.Seconds()
+	switch {
+	case t.limit > 0 && rate >= t.limit*limitHitRatio:
+		t.settled = true
+	case rate > t.best*(1+minThroughputGain):
+		t.best = rate
+		if t.current < t.max {
+			t.current++
+		} else {
+			t.settled = true
+		}
+	default:
+		if t.current > 1 {
+			t.current--
+		}
+		t.settled = true
+	}
+	return t.current
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"time"
+
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestConcurrencyTuner(c *check.C) {
+	now := time.Unix(1500000000, 0)
+	var cases = []struct {
+		max      int
+		limit    int
+		rates    []int64
+		expected []int
+	}{
+		// ramps up while the throughput improves, and backs off on plateau
+		{6, 0, []int64{100, 200, 300, 310, 1000}, []int{2, 3, 4, 3, 3}},
+		// capped by max
+		{2, 0, []int64{100, 200, 300}, []int{2, 2, 2}},
+		// stops once the limit is hit
+		{6, 400, []int64{100, 200, 380, 1000}, []int{2, 3, 3, 3}},
+		// the idle window is skipped
+		{6, 0, []int64{0, 100, 0, 50}, []int{1, 2, 2, 1}},
+		{0, 0, []int64{100}, []int{1}},
+	}
+
+	for _, v := range cases {
+		t := NewConcurrencyTuner(v.max, v.limit, now)
+		c.Assert(t.Concurrency(), check.Equals, 1)
+		at := now
+		for i, rate := range v.rates {
+			at = at.Add(time.Second)
+			t.Add(rate)
+			c.Assert(t.Tune(at), check.Equals, v.expected[i], check.Commentf("%v window:%d", v, i))
+		}
+		c.Assert(t.Concurrency(), check.Equals, v.expected[len(v.expected)-1])
+		c.Assert(t.Settled(), check.Equals, true, check.Commentf("%v", v))
+	}
+}
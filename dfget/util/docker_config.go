@@ -0,0 +1,110 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// dockerHubIndexHost is the host of the key of docker hub in docker config,
+// e.g. 'https://index.docker.io/v1/'.
+const dockerHubIndexHost = "index.docker.io"
+
+// DockerAuth is the credential of a registry in the docker config file.
+type DockerAuth struct {
+	Username string
+	Password string
+}
+
+// DockerConfig holds the auths parsed from a docker config file.
+type DockerConfig struct {
+	// auths are keyed by the lower case host of the registries.
+	auths map[string]*DockerAuth
+}
+
+// ParseDockerConfig parses the auths of the docker config file of the path,
+// and the entries without username, e.g. the ones of credential helpers or
+// identity tokens, are ignored.
+func ParseDockerConfig(path string) (*DockerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDockerConfig(data)
+}
+
+func parseDockerConfig(data []byte) (*DockerConfig, error) {
+	var raw struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	c := &DockerConfig{auths: make(map[string]*DockerAuth)}
+	for key, entry := range raw.Auths {
+		auth := &DockerAuth{Username: entry.Username, Password: entry.Password}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("decode auth of registry[%s] error: %v", key, err)
+			}
+			kv := strings.SplitN(string(decoded), ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("auth of registry[%s] is not in the format of 'username:password'", key)
+			}
+			auth.Username, auth.Password = kv[0], kv[1]
+		}
+		if auth.Username != "" {
+			c.auths[registryHost(key)] = auth
+		}
+	}
+	return c, nil
+}
+
+// registryHost returns the lower case host of the registry key, which may be
+// a url like 'https://index.docker.io/v1/'.
+func registryHost(key string) string {
+	if i := strings.Index(key, "://"); i >= 0 {
+		key = key[i+3:]
+	}
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		key = key[:i]
+	}
+	return strings.ToLower(key)
+}
+
+// Lookup returns the auth of the registry host which carries the port if it's
+// not the default one, and the hosts of docker hub match the entry of
+// index.docker.io. It returns nil if none matches.
+func (c *DockerConfig) Lookup(host string) *DockerAuth {
+	host = strings.ToLower(host)
+	if auth, ok := c.auths[host]; ok {
+		return auth
+	}
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		return c.auths[dockerHubIndexHost]
+	}
+	return nil
+}
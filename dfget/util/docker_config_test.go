@@ -0,0 +1,73 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"encoding/base64"
+
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestParseDockerConfig(c *check.C) {
+	auth := func(userPass string) string {
+		return base64.StdEncoding.EncodeToString([]byte(userPass))
+	}
+	config := `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "` + auth("alice:pass1") + `"},
+		"Registry.Example.com": {"auth": "` + auth("bob:pa:ss2") + `"},
+		"localhost:5000": {"username": "carol", "password": "pass3"},
+		"token.example.com": {"identitytoken": "token"}
+	},
+	"credsStore": "desktop"
+}`
+	n, err := parseDockerConfig([]byte(config))
+	c.Assert(err, check.IsNil)
+
+	var cases = []struct {
+		host     string
+		username string
+		password string
+	}{
+		{"index.docker.io", "alice", "pass1"},
+		{"registry-1.docker.io", "alice", "pass1"},
+		{"registry.example.com", "bob", "pa:ss2"},
+		{"localhost:5000", "carol", "pass3"},
+		{"localhost", "", ""},
+		{"token.example.com", "", ""},
+	}
+	for _, v := range cases {
+		a := n.Lookup(v.host)
+		if v.username == "" {
+			c.Assert(a, check.IsNil, check.Commentf("host:%s", v.host))
+			continue
+		}
+		c.Assert(a, check.DeepEquals, &DockerAuth{Username: v.username, Password: v.password},
+			check.Commentf("host:%s", v.host))
+	}
+
+	for _, invalid := range []string{
+		`{"auths": {"a.com": {"auth": "!"}}}`,
+		`{"auths": {"a.com": {"auth": "` + auth("alice") + `"}}}`,
+		`{"auths": `,
+	} {
+		_, err := parseDockerConfig([]byte(invalid))
+		c.Assert(err, check.NotNil, check.Commentf("%s", invalid))
+	}
+	_, err = ParseDockerConfig("/notexist/config.json")
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrFileLocked is returned by TryLockFile if the lock is held by another
+// process.
+var ErrFileLocked = errors.New("file locked")
+
+// FileLock is the exclusive advisory lock of flock on a file, and the file
+// holds the pid of the process holding it.
+type FileLock struct {
+	path string
+	file *os.File
+}
+
+// TryLockFile acquires the FileLock of the file at path without blocking, and
+// the file is created if it doesn't exist. ErrFileLocked is returned if the
+// lock is held by another process.
+func TryLockFile(path string) (*FileLock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, ErrFileLocked
+			}
+			return nil, fmt.Errorf("flock %s error: %v", path, err)
+		}
+		// the file may be removed by the previous holder after it's opened,
+		// and the lock of the removed one guards nothing
+		if isLockedFile(f, path) {
+			f.Truncate(0)
+			f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+			return &FileLock{path: path, file: f}, nil
+		}
+		f.Close()
+	}
+}
+
+func isLockedFile(f *os.File, path string) bool {
+	locked, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(locked, current)
+}
+
+// Unlock removes the file and releases the lock, and the file is removed
+// first so that nobody else locks it before it's removed.
+func (l *FileLock) Unlock() error {
+	err := os.Remove(l.path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// LockHolder returns the pid written in the lock file at path, and it's 0 if
+// it's unknown.
+func LockHolder(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestTryLockFile(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_lock")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "file.lock")
+	c.Assert(LockHolder(path), check.Equals, 0)
+
+	lock, err := TryLockFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(LockHolder(path), check.Equals, os.Getpid())
+	// flock conflicts between the open files even in one process
+	_, err = TryLockFile(path)
+	c.Assert(err, check.Equals, ErrFileLocked)
+
+	c.Assert(lock.Unlock(), check.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	lock, err = TryLockFile(path)
+	c.Assert(err, check.IsNil)
+	// the file removed by others is unlocked as well
+	os.Remove(path)
+	c.Assert(lock.Unlock(), check.IsNil)
+
+	_, err = TryLockFile(filepath.Join(tmpDir, "notexist", "file.lock"))
+	c.Assert(err, check.NotNil)
+	c.Assert(err, check.Not(check.Equals), ErrFileLocked)
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// NewHash returns a hash.Hash of the algorithm such as 'md5', 'sha1' and
+// 'sha256', or nil if the algorithm is not supported.
+func NewHash(algo string) hash.Hash {
+	if newHash, ok := hashes[strings.ToLower(algo)]; ok {
+		return newHash()
+	}
+	return nil
+}
+
+// EnsureWritableDir creates the directory if it doesn't exist, and verifies
+// that a file can be created in it.
+func EnsureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".writable")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// IsSymlink reports whether path is a symlink, which isn't followed.
+func IsSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// IsFIFO reports whether path is a named pipe, and the symlink is followed.
+func IsFIFO(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// FreeSpace returns the number of bytes available to the unprivileged users
+// on the file system of path.
+func FreeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// IsNoSpace reports whether err is caused by the file system running out of
+// space.
+func IsNoSpace(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+// MoveFile renames src to dst, and it's copied and removed instead if they're
+// on different file systems.
+func MoveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err
+	}
+	if err := copyFile(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies the content and permission of src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// the permission of the existing dst isn't changed by OpenFile
+	return os.Chmod(dst, info.Mode().Perm())
+}
+
+// Md5Sum generates md5 for a given file.
+func Md5Sum(name string) string {
+	return Checksum(name, "md5")
+}
+
+// Checksum generates the hex digest of the algorithm for a given file,
+// and it's empty if the algorithm is not supported or reading file fails.
+func Checksum(name, algo string) string {
+	h := NewHash(algo)
+	if h == nil {
+		return ""
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestEnsureWritableDir(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_test")
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+
+	c.Assert(EnsureWritableDir(tmpDir), check.IsNil)
+	c.Assert(EnsureWritableDir(filepath.Join(tmpDir, "a", "b")), check.IsNil)
+	info, err := os.Stat(filepath.Join(tmpDir, "a", "b"))
+	c.Assert(err, check.IsNil)
+	c.Assert(info.IsDir(), check.Equals, true)
+	c.Assert(EnsureWritableDir(file), check.NotNil)
+	c.Assert(EnsureWritableDir(filepath.Join(file, "a")), check.NotNil)
+
+	// nothing is left in the directory
+	names, _ := ioutil.ReadDir(tmpDir)
+	c.Assert(len(names), check.Equals, 2)
+}
+
+func (suite *DFGetUtilSuite) TestMoveFile(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_test")
+	defer os.RemoveAll(tmpDir)
+	src, dst := filepath.Join(tmpDir, "src"), filepath.Join(tmpDir, "dst")
+	ioutil.WriteFile(src, []byte("dragonfly"), 0644)
+	ioutil.WriteFile(dst, []byte("old"), 0644)
+
+	c.Assert(MoveFile(src, dst), check.IsNil)
+	content, _ := ioutil.ReadFile(dst)
+	c.Assert(string(content), check.Equals, "dragonfly")
+	_, err := os.Stat(src)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	c.Assert(MoveFile(src, dst), check.NotNil)
+}
+
+func (suite *DFGetUtilSuite) Test_copyFile(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_test")
+	defer os.RemoveAll(tmpDir)
+	src, dst := filepath.Join(tmpDir, "src"), filepath.Join(tmpDir, "dst")
+	ioutil.WriteFile(src, []byte("dragonfly"), 0600)
+	ioutil.WriteFile(dst, []byte("the old content"), 0644)
+
+	c.Assert(copyFile(src, dst), check.IsNil)
+	content, _ := ioutil.ReadFile(dst)
+	c.Assert(string(content), check.Equals, "dragonfly")
+	info, _ := os.Stat(dst)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0600))
+	c.Assert(copyFile(filepath.Join(tmpDir, "notexist"), dst), check.NotNil)
+}
+
+func (suite *DFGetUtilSuite) TestMd5Sum(c *check.C) {
+	f, err := ioutil.TempFile("/tmp", "dfget_test")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+
+	f.WriteString("dragonfly")
+	f.Close()
+
+	c.Assert(Md5Sum(f.Name()), check.Equals, "7fc8baba8e7696d6c3b286f738245592")
+	c.Assert(Md5Sum(f.Name()+".notexist"), check.Equals, "")
+}
+
+func (suite *DFGetUtilSuite) TestChecksum(c *check.C) {
+	f, err := ioutil.TempFile("/tmp", "dfget_test")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+
+	f.WriteString("dragonfly")
+	f.Close()
+
+	var cases = map[string]string{
+		"md5":    "7fc8baba8e7696d6c3b286f738245592",
+		"sha1":   "4a3db7484b5961ba575eabdd70111cbc36c98575",
+		"sha256": "e2ca6aec52558fcc04311983bad03e38ca5e799c239d202ae7a4f58aff8a6970",
+		"SHA256": "e2ca6aec52558fcc04311983bad03e38ca5e799c239d202ae7a4f58aff8a6970",
+		"crc32":  "",
+	}
+	for k, v := range cases {
+		c.Assert(Checksum(f.Name(), k), check.Equals, v, check.Commentf("algo:%s", k))
+	}
+	c.Assert(Checksum(f.Name()+".notexist", "sha256"), check.Equals, "")
+}
+
+func (suite *DFGetUtilSuite) TestIsSymlink(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_test")
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	os.Symlink(file, filepath.Join(tmpDir, "link"))
+	os.Symlink(filepath.Join(tmpDir, "notexist"), filepath.Join(tmpDir, "dangling"))
+
+	c.Assert(IsSymlink(file), check.Equals, false)
+	c.Assert(IsSymlink(tmpDir), check.Equals, false)
+	c.Assert(IsSymlink(filepath.Join(tmpDir, "notexist")), check.Equals, false)
+	c.Assert(IsSymlink(filepath.Join(tmpDir, "link")), check.Equals, true)
+	c.Assert(IsSymlink(filepath.Join(tmpDir, "dangling")), check.Equals, true)
+}
+
+func (suite *DFGetUtilSuite) TestIsFIFO(c *check.C) {
+	tmpDir, _ := ioutil.TempDir("/tmp", "dfget_test")
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	fifo := filepath.Join(tmpDir, "fifo")
+	c.Assert(syscall.Mkfifo(fifo, 0644), check.IsNil)
+	os.Symlink(fifo, filepath.Join(tmpDir, "link"))
+
+	c.Assert(IsFIFO(file), check.Equals, false)
+	c.Assert(IsFIFO(tmpDir), check.Equals, false)
+	c.Assert(IsFIFO(filepath.Join(tmpDir, "notexist")), check.Equals, false)
+	c.Assert(IsFIFO(fifo), check.Equals, true)
+	c.Assert(IsFIFO(filepath.Join(tmpDir, "link")), check.Equals, true)
+}
+
+func (suite *DFGetUtilSuite) TestFreeSpace(c *check.C) {
+	free, err := FreeSpace("/tmp")
+	c.Assert(err, check.IsNil)
+	c.Assert(free > 0, check.Equals, true)
+
+	_, err = FreeSpace("/tmp/dfget_notexist/a")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (suite *DFGetUtilSuite) TestIsNoSpace(c *check.C) {
+	var cases = []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{syscall.ENOSPC, true},
+		{&os.PathError{Op: "write", Path: "a", Err: syscall.ENOSPC}, true},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOSPC}, true},
+		{os.NewSyscallError("write", syscall.ENOSPC), true},
+		{&os.PathError{Op: "write", Path: "a", Err: syscall.EIO}, false},
+		{fmt.Errorf("%v", syscall.ENOSPC), false},
+	}
+	for _, v := range cases {
+		c.Assert(IsNoSpace(v.err), check.Equals, v.expected, check.Commentf("%v", v.err))
+	}
+
+	f, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		c.Skip("/dev/full is not available")
+	}
+	defer f.Close()
+	_, err = f.Write([]byte("dragonfly"))
+	c.Assert(IsNoSpace(err), check.Equals, true)
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+// scheduleInterval is how often the rate of the scheduled LimitReader is
+// updated.
+var scheduleInterval = time.Second
+
+// LimitReader reads from the underlying reader with a rate limiter.
+type LimitReader struct {
+	Src     io.Reader
+	Limiter *RateLimiter
+
+	// rateAt returns the rate in effect at the time returned by now, nil if
+	// the rate is not scheduled.
+	rateAt    func(time.Time) int
+	now       func() time.Time
+	scheduled time.Time
+}
+
+// NewLimitReader creates a LimitReader.
+// rate: bytes per second, 0 represents that don't limit the rate.
+func NewLimitReader(src io.Reader, rate int) *LimitReader {
+	return NewLimitReaderWithLimiter(src, NewLimitRateLimiter(rate))
+}
+
+// NewLimitReaderWithLimiter creates a LimitReader with the limiter, and the
+// readers sharing one limiter are limited by its rate in total.
+func NewLimitReaderWithLimiter(src io.Reader, limiter *RateLimiter) *LimitReader {
+	return &LimitReader{
+		Src:     src,
+		Limiter: limiter,
+	}
+}
+
+// NewScheduledLimitReader creates a LimitReader whose rate is updated to the
+// one returned by rateAt every second, so that the changes of the rate take
+// effect during reading rather than only at the start.
+// rateAt: bytes per second at the time, 0 represents that don't limit the rate.
+// now: the current time, e.g. the Now of the clock of dfget.
+func NewScheduledLimitReader(src io.Reader, rateAt func(time.Time) int, now func() time.Time) *LimitReader {
+	t := now()
+	lr := NewLimitReader(src, rateAt(t))
+	lr.rateAt, lr.now, lr.scheduled = rateAt, now, t
+	return lr
+}
+
+// NewLimitRateLimiter creates the RateLimiter used by LimitReader.
+// rate: bytes per second, 0 represents that don't limit the rate.
+func NewLimitRateLimiter(rate int) *RateLimiter {
+	return NewRateLimiter(limitRate(rate), 2)
+}
+
+func limitRate(rate int) int32 {
+	if rate > math.MaxInt32 {
+		rate = math.MaxInt32
+	}
+	return int32(rate)
+}
+
+// Read implements io.Reader, it blocks until the bytes read are allowed
+// by the rate limiter.
+func (lr *LimitReader) Read(p []byte) (n int, err error) {
+	if lr.rateAt != nil {
+		if now := lr.now(); now.Sub(lr.scheduled) >= scheduleInterval {
+			lr.scheduled = now
+			lr.Limiter.SetRate(limitRate(lr.rateAt(now)))
+		}
+	}
+	n, err = lr.Src.Read(p)
+	if n > 0 {
+		lr.Limiter.AcquireBlocking(int32(n))
+	}
+	return n, err
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestLimitReader_Read(c *check.C) {
+	var cases = []struct {
+		rate int
+		size int
+		e    int64
+	}{
+		{0, 1000, 0},
+		{1000, 1000, 1000},
+		{2000, 1000, 500},
+	}
+
+	for _, cc := range cases {
+		start := time.Now()
+		lr := NewLimitReader(strings.NewReader(strings.Repeat("x", cc.size)), cc.rate)
+		data, err := ioutil.ReadAll(lr)
+		cost := int64(time.Since(start) / time.Millisecond)
+		c.Assert(err, check.IsNil)
+		c.Assert(len(data), check.Equals, cc.size)
+		c.Assert(cost >= cc.e, check.Equals, true, check.Commentf("%v cost:%d", cc, cost))
+		c.Assert(cost < cc.e+50, check.Equals, true, check.Commentf("%v cost:%d", cc, cost))
+	}
+}
+
+func (suite *DFGetUtilSuite) TestLimitReader_Scheduled(c *check.C) {
+	defer func(interval time.Duration) { scheduleInterval = interval }(scheduleInterval)
+	scheduleInterval = 0
+
+	// the rate is limited to 1000 bytes per second after 500 bytes are read
+	var read int
+	at := time.Unix(1500000000, 0)
+	lr := NewScheduledLimitReader(strings.NewReader(strings.Repeat("x", 1000)), func(t time.Time) int {
+		c.Check(t, check.Equals, at)
+		if read < 500 {
+			return 0
+		}
+		return 1000
+	}, func() time.Time { return at })
+	start := time.Now()
+	buf := make([]byte, 100)
+	for {
+		n, err := lr.Read(buf)
+		read += n
+		if err != nil {
+			break
+		}
+	}
+	cost := int64(time.Since(start) / time.Millisecond)
+	c.Assert(read, check.Equals, 1000)
+	c.Assert(cost >= 400, check.Equals, true, check.Commentf("cost:%d", cost))
+	c.Assert(cost < 600, check.Equals, true, check.Commentf("cost:%d", cost))
+}
+
+func (suite *DFGetUtilSuite) TestLimitReader_SharedLimiter(c *check.C) {
+	var (
+		limiter = NewLimitRateLimiter(2000)
+		wg      sync.WaitGroup
+		start   = time.Now()
+	)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lr := NewLimitReaderWithLimiter(strings.NewReader(strings.Repeat("x", 1000)), limiter)
+			ioutil.ReadAll(lr)
+		}()
+	}
+	wg.Wait()
+
+	// the readers are limited by 2000 bytes per second in total
+	cost := int64(time.Since(start) / time.Millisecond)
+	c.Assert(cost >= 1000, check.Equals, true, check.Commentf("cost:%d", cost))
+}
@@ -22,6 +22,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -54,18 +55,64 @@ func CreateLogger(logPath string, logName string, logLevel string, sign string)
 	panic(err)
 }
 
-// AddConsoleLog will add a ConsoleLog into logger's hooks.
-// It will output logs to console when logger's outputting logs.
+// AddConsoleLog will add a ConsoleLog into logger's hooks, and the logs are
+// written to the same place as Printer.
+// It will output logs to console when logger's outputting logs, and they're
+// formatted by PlainFormatter if the console is a terminal.
 func AddConsoleLog(logger *log.Logger) {
+	formatter := logger.Formatter
+	if IsTerminal(Printer.out()) {
+		formatter = &PlainFormatter{}
+	}
 	consoleLog := &log.Logger{
-		Out:       os.Stdout,
-		Formatter: logger.Formatter,
+		Out:       Printer.out(),
+		Formatter: formatter,
 		Hooks:     make(log.LevelHooks),
 		Level:     logger.Level,
 	}
 	logger.Hooks.Add(&ConsoleHook{logger: consoleLog, levels: log.AllLevels})
 }
 
+// SetJSONFormatter makes the logger output logs in JSON format, and the
+// fields are attached on every log entry.
+func SetJSONFormatter(logger *log.Logger, fields log.Fields) {
+	logger.Formatter = &log.JSONFormatter{TimestampFormat: DefaultLogTimeFormat}
+	AddLogFields(logger, fields)
+}
+
+// AddLogFields attaches the fields on every log entry of the logger, and they
+// are output by the formatters supporting fields such as JSON and
+// DragonflyFormatter.
+func AddLogFields(logger *log.Logger, fields log.Fields) {
+	if len(fields) > 0 {
+		logger.Hooks.Add(&FieldsHook{fields: fields})
+	}
+}
+
+// FieldsHook attaches the default fields on every log entry, and the fields
+// of the entry take precedence over them.
+type FieldsHook struct {
+	fields log.Fields
+}
+
+// Fire implements Hook#Fire.
+func (fh *FieldsHook) Fire(entry *log.Entry) error {
+	data := make(log.Fields, len(fh.fields)+len(entry.Data))
+	for k, v := range fh.fields {
+		data[k] = v
+	}
+	for k, v := range entry.Data {
+		data[k] = v
+	}
+	entry.Data = data
+	return nil
+}
+
+// Levels implements Hook#Levels().
+func (fh *FieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
 // ConsoleHook shows logs on console.
 type ConsoleHook struct {
 	logger *log.Logger
@@ -99,6 +146,22 @@ func (ch *ConsoleHook) Levels() []log.Level {
 	return ch.levels
 }
 
+// PlainFormatter formats the logs for humans reading them on terminal. Only
+// the message is output, and it's prefixed with the level if the level is
+// warning or more severe.
+type PlainFormatter struct{}
+
+// Format implements Formatter#Format.
+func (f *PlainFormatter) Format(entry *log.Entry) ([]byte, error) {
+	b := &bytes.Buffer{}
+	if entry.Level <= log.WarnLevel {
+		fmt.Fprintf(b, "%s: ", strings.ToUpper(entry.Level.String()))
+	}
+	b.WriteString(entry.Message)
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
 // DragonflyFormatter customizes the dragonfly log format.
 type DragonflyFormatter struct {
 	// TimestampFormat sets the format used for marshaling timestamps.
@@ -119,6 +182,14 @@ func (f *DragonflyFormatter) Format(entry *log.Entry) ([]byte, error) {
 	if !IsEmptyStr(f.Sign) {
 		fmt.Fprintf(b, "sign:%s ", f.Sign)
 	}
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s:%v ", k, entry.Data[k])
+	}
 	b.WriteString(": ")
 	if entry.Message != "" {
 		f.appendValue(b, entry.Message, false)
@@ -19,6 +19,7 @@ package util
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -62,6 +63,13 @@ func (suite *DFGetUtilSuite) TestCreateLogger(c *check.C) {
 	logger.Warn("test")
 	checkLogs(logrus.WarnLevel, "test")
 
+	// the fields are written after the sign in the order of their keys
+	AddLogFields(logger, logrus.Fields{"callSystem": "unit-test"})
+	logger.WithField("a", 1).Info("test")
+	line, _, _ := r.ReadLine()
+	c.Assert(strings.HasSuffix(string(line), " INFO sign:x a:1 callSystem:unit-test : test"), check.Equals, true,
+		check.Commentf("%s", line))
+
 	testPanic()
 }
 
@@ -120,6 +128,51 @@ func (suite *DFGetUtilSuite) TestAddConsoleLog(c *check.C) {
 	})
 }
 
+func (suite *DFGetUtilSuite) TestPlainFormatter(c *check.C) {
+	var cases = []struct {
+		level    logrus.Level
+		expected string
+	}{
+		{logrus.DebugLevel, "dragonfly\n"},
+		{logrus.InfoLevel, "dragonfly\n"},
+		{logrus.WarnLevel, "WARNING: dragonfly\n"},
+		{logrus.ErrorLevel, "ERROR: dragonfly\n"},
+	}
+	f := &PlainFormatter{}
+	for _, v := range cases {
+		b, err := f.Format(&logrus.Entry{Level: v.level, Message: "dragonfly"})
+		c.Assert(err, check.IsNil)
+		c.Assert(string(b), check.Equals, v.expected)
+	}
+}
+
+func (suite *DFGetUtilSuite) TestSetJSONFormatter(c *check.C) {
+	logger, tmpFile, r, err := tempFileAndLogger("debug", "x")
+	defer cleanTempFile(tmpFile, err)
+
+	SetJSONFormatter(logger, logrus.Fields{"sign": "x", "url": "http://a.b"})
+	var checkLogs = func(expected map[string]interface{}) {
+		line, _, _ := r.ReadLine()
+		actual := make(map[string]interface{})
+		c.Assert(json.Unmarshal(line, &actual), check.IsNil)
+		for k, v := range expected {
+			c.Assert(actual[k], check.Equals, v, check.Commentf("key:%s", k))
+		}
+	}
+
+	logger.Info("test")
+	checkLogs(map[string]interface{}{
+		"level": "info", "msg": "test", "sign": "x", "url": "http://a.b"})
+	logger.WithField("url", "http://c.d").Warn("test")
+	checkLogs(map[string]interface{}{
+		"level": "warning", "msg": "test", "sign": "x", "url": "http://c.d"})
+
+	AddLogFields(logger, logrus.Fields{"callSystem": "unit-test"})
+	logger.Info("test")
+	checkLogs(map[string]interface{}{
+		"level": "info", "msg": "test", "sign": "x", "callSystem": "unit-test"})
+}
+
 func tempFileAndLogger(level string, sign string) (*logrus.Logger, *os.File, *bufio.Reader, error) {
 	tmpPath := "/tmp"
 	tmpFile, err := ioutil.TempFile(tmpPath, "dfget_test")
@@ -0,0 +1,112 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// NetrcMachine is the credential of a machine in the netrc file.
+type NetrcMachine struct {
+	Name     string
+	Login    string
+	Password string
+}
+
+// Netrc holds the machines parsed from a netrc file.
+type Netrc struct {
+	machines []*NetrcMachine
+	// def is the 'default' entry which matches any machine.
+	def *NetrcMachine
+}
+
+// ParseNetrc parses the netrc file of the path, the macro definitions and
+// the accounts are ignored.
+func ParseNetrc(path string) (*Netrc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNetrc(f)
+}
+
+func parseNetrc(r io.Reader) (*Netrc, error) {
+	n := new(Netrc)
+	var (
+		cur     *NetrcMachine
+		inMacro bool
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// a macro definition ends with an empty line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+			var value string
+			if i+1 < len(fields) {
+				value = fields[i+1]
+			}
+			switch fields[i] {
+			case "machine":
+				cur = &NetrcMachine{Name: value}
+				n.machines = append(n.machines, cur)
+				i++
+			case "default":
+				cur = &NetrcMachine{}
+				n.def = cur
+			case "login":
+				if cur != nil {
+					cur.Login = value
+				}
+				i++
+			case "password":
+				if cur != nil {
+					cur.Password = value
+				}
+				i++
+			case "account":
+				i++
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	return n, scanner.Err()
+}
+
+// Lookup returns the first machine matching the host, or the default entry
+// if none matches. It returns nil if neither exists.
+func (n *Netrc) Lookup(host string) *NetrcMachine {
+	for _, m := range n.machines {
+		if strings.EqualFold(m.Name, host) {
+			return m
+		}
+	}
+	return n.def
+}
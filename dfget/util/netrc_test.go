@@ -0,0 +1,81 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/go-check/check"
+)
+
+const testNetrc = `
+# comment
+machine a.com login alice password pass1
+machine b.com
+	login bob
+	password pass2 # inline comment
+macdef init
+	cd /pub
+	machine c.com login eve password evil
+
+machine D.com login dave account x password pass3
+default login anonymous password guest
+`
+
+func (suite *DFGetUtilSuite) TestParseNetrc(c *check.C) {
+	n, err := parseNetrc(strings.NewReader(testNetrc))
+	c.Assert(err, check.IsNil)
+
+	var cases = []struct {
+		host     string
+		login    string
+		password string
+	}{
+		{"a.com", "alice", "pass1"},
+		{"b.com", "bob", "pass2"},
+		{"d.com", "dave", "pass3"},
+		{"c.com", "anonymous", "guest"},
+		{"x.com", "anonymous", "guest"},
+	}
+	for _, cc := range cases {
+		m := n.Lookup(cc.host)
+		c.Assert(m, check.NotNil, check.Commentf("host:%s", cc.host))
+		c.Assert(m.Login, check.Equals, cc.login, check.Commentf("host:%s", cc.host))
+		c.Assert(m.Password, check.Equals, cc.password, check.Commentf("host:%s", cc.host))
+	}
+
+	n, err = parseNetrc(strings.NewReader("machine a.com login alice password pass1"))
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Lookup("b.com"), check.IsNil)
+}
+
+func (suite *DFGetUtilSuite) TestParseNetrc_file(c *check.C) {
+	f, err := ioutil.TempFile("/tmp", "dfget_netrc")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString(testNetrc)
+	f.Close()
+
+	n, err := ParseNetrc(f.Name())
+	c.Assert(err, check.IsNil)
+	c.Assert(n.Lookup("a.com").Login, check.Equals, "alice")
+
+	_, err = ParseNetrc(f.Name() + ".notexist")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
@@ -60,8 +60,11 @@ func (rl *RateLimiter) AcquireNonBlocking(token int32) int32 {
 	return rl.acquire(token, false)
 }
 
-// SetRate sets rate of RateLimiter.
+// SetRate sets rate of RateLimiter, and it takes effect on the tokens
+// acquired after it returns.
 func (rl *RateLimiter) SetRate(rate int32) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 	if rl.rate != rate {
 		rl.capacity = rate
 		rl.rate = rate
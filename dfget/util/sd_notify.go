@@ -0,0 +1,49 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"net"
+	"os"
+)
+
+// NotifySocketEnv is the environment variable holding the socket that
+// systemd listens on for the notifications of the service.
+const NotifySocketEnv = "NOTIFY_SOCKET"
+
+// SdNotify sends state, e.g. "READY=1" or "STATUS=...", to systemd through
+// the socket of NotifySocketEnv. It returns false and does nothing if the
+// socket isn't set, which means it isn't running under systemd.
+func SdNotify(state string) (bool, error) {
+	name := os.Getenv(NotifySocketEnv)
+	if IsEmptyStr(name) {
+		return false, nil
+	}
+	// the leading '@' stands for an abstract socket
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
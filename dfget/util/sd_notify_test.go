@@ -0,0 +1,73 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestSdNotify(c *check.C) {
+	defer os.Setenv(NotifySocketEnv, os.Getenv(NotifySocketEnv))
+
+	os.Unsetenv(NotifySocketEnv)
+	sent, err := SdNotify("READY=1")
+	c.Assert(err, check.IsNil)
+	c.Assert(sent, check.Equals, false)
+
+	dir, _ := ioutil.TempDir("/tmp", "sd-notify")
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	os.Setenv(NotifySocketEnv, name)
+	sent, err = SdNotify("STATUS=downloading")
+	c.Assert(err, check.IsNil)
+	c.Assert(sent, check.Equals, true)
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buf[:n]), check.Equals, "STATUS=downloading")
+
+	os.Setenv(NotifySocketEnv, filepath.Join(dir, "none.sock"))
+	sent, err = SdNotify("READY=1")
+	c.Assert(err, check.NotNil)
+	c.Assert(sent, check.Equals, false)
+}
+
+func (suite *DFGetUtilSuite) TestSdNotify_Abstract(c *check.C) {
+	defer os.Setenv(NotifySocketEnv, os.Getenv(NotifySocketEnv))
+
+	name := "dfget-sd-notify-test"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "\x00" + name, Net: "unixgram"})
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	os.Setenv(NotifySocketEnv, "@"+name)
+	sent, err := SdNotify("READY=1")
+	c.Assert(err, check.IsNil)
+	c.Assert(sent, check.Equals, true)
+	buf := make([]byte, 64)
+	n, _ := conn.Read(buf)
+	c.Assert(string(buf[:n]), check.Equals, "READY=1")
+}
@@ -18,13 +18,34 @@ package util
 
 import (
 	"fmt"
+	"io"
+	"os"
 )
 
 // StdPrinter output info to console directly.
 type StdPrinter struct {
+	// Out is os.Stdout if it's nil.
+	Out io.Writer
 }
 
 // Println output info to console directly.
 func (sp *StdPrinter) Println(msg string) {
-	fmt.Println(msg)
+	fmt.Fprintln(sp.out(), msg)
+}
+
+func (sp *StdPrinter) out() io.Writer {
+	if sp.Out == nil {
+		return os.Stdout
+	}
+	return sp.Out
+}
+
+// IsTerminal reports whether w is a terminal rather than a file or a pipe.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
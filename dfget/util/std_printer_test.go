@@ -0,0 +1,42 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestStdPrinter_Println(c *check.C) {
+	var buf bytes.Buffer
+	sp := &StdPrinter{Out: &buf}
+	sp.Println("dragonfly")
+	c.Assert(buf.String(), check.Equals, "dragonfly\n")
+}
+
+func (suite *DFGetUtilSuite) TestIsTerminal(c *check.C) {
+	c.Assert(IsTerminal(&bytes.Buffer{}), check.Equals, false)
+
+	f, err := ioutil.TempFile("", "dfget-terminal")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	c.Assert(IsTerminal(f), check.Equals, false)
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"net/url"
+	"strings"
+)
+
+// FilterURLParam removes the query params whose keys are in filters from the
+// url, so that the urls only differing in the volatile params such as
+// expiration and signature are regarded as the same one.
+// The rest of the url is kept as is, and the url is returned directly if
+// filters is empty.
+func FilterURLParam(rawURL string, filters []string) string {
+	if len(filters) == 0 {
+		return rawURL
+	}
+	start := strings.IndexByte(rawURL, '?')
+	if start < 0 {
+		return rawURL
+	}
+	end := len(rawURL)
+	if idx := strings.IndexByte(rawURL[start:], '#'); idx >= 0 {
+		end = start + idx
+	}
+
+	var kept []string
+	for _, param := range strings.Split(rawURL[start+1:end], "&") {
+		if param == "" {
+			continue
+		}
+		key := strings.SplitN(param, "=", 2)[0]
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if !containsStr(filters, key) {
+			kept = append(kept, param)
+		}
+	}
+
+	filtered := rawURL[:start]
+	if len(kept) > 0 {
+		filtered += "?" + strings.Join(kept, "&")
+	}
+	return filtered + rawURL[end:]
+}
+
+func containsStr(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
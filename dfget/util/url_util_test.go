@@ -0,0 +1,46 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestFilterURLParam(c *check.C) {
+	var cases = []struct {
+		url      string
+		filters  []string
+		expected string
+	}{
+		{"http://a.b/c?key=1&sign=2", nil, "http://a.b/c?key=1&sign=2"},
+		{"http://a.b/c", []string{"key"}, "http://a.b/c"},
+		{"http://a.b/c?x=1&key=1&sign=2", []string{"key", "sign"}, "http://a.b/c?x=1"},
+		{"http://a.b/c?key=1&x=1&sign=2", []string{"key", "sign"}, "http://a.b/c?x=1"},
+		{"http://a.b/c?key=1&sign=2", []string{"key", "sign"}, "http://a.b/c"},
+		{"http://a.b/c?key=1&key=2&x", []string{"key"}, "http://a.b/c?x"},
+		{"http://a.b/c?key&x=a%26b", []string{"key"}, "http://a.b/c?x=a%26b"},
+		{"http://a.b/c?k%65y=1&x=1", []string{"key"}, "http://a.b/c?x=1"},
+		{"http://a.b/c?keys=1&x=1", []string{"key"}, "http://a.b/c?keys=1&x=1"},
+		{"http://a.b/c?key=1&&x=1#key=2", []string{"key"}, "http://a.b/c?x=1#key=2"},
+		{"http://a.b/c?key=1#f", []string{"key"}, "http://a.b/c#f"},
+	}
+
+	for _, v := range cases {
+		c.Assert(FilterURLParam(v.url, v.filters), check.Equals, v.expected,
+			check.Commentf("%v", v))
+	}
+}
@@ -19,6 +19,7 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 )
@@ -65,7 +66,7 @@ func IsNil(value interface{}) (result bool) {
 // PanicIfNil panic if the obj is nil.
 func PanicIfNil(obj interface{}, msg string) {
 	if IsNil(obj) {
-		panic(fmt.Errorf(msg))
+		panic(errors.New(msg))
 	}
 }
 
@@ -0,0 +1,111 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ParseYAML parses a flat yaml document whose values are scalars or lists
+// of scalars, the lists are either in block style with '- ' prefixed items
+// or in flow style like '[a, b]'. The value of map is a string or []string.
+// Nested mappings, anchors and multi-line scalars are not supported.
+func ParseYAML(data []byte) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	var (
+		listKey string
+		lineNo  int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lineNo++
+		line := stripYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without key", lineNo)
+			}
+			item := unquoteYAML(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			result[listKey] = append(result[listKey].([]string), item)
+			continue
+		}
+		if line != strings.TrimLeft(line, " \t") {
+			return nil, fmt.Errorf("line %d: nested mapping is not supported", lineNo)
+		}
+
+		idx := strings.Index(trimmed, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: invalid line %q", lineNo, trimmed)
+		}
+		key := strings.TrimSpace(trimmed[:idx])
+		if _, ok := result[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicated key %s", lineNo, key)
+		}
+		value := strings.TrimSpace(trimmed[idx+1:])
+		listKey = ""
+		switch {
+		case value == "":
+			// the value is a block list or null
+			result[key] = []string{}
+			listKey = key
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			items := []string{}
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, unquoteYAML(item))
+				}
+			}
+			result[key] = items
+		default:
+			result[key] = unquoteYAML(value)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// stripYAMLComment removes the comment starting with '#' which is at the
+// beginning or after a space, and it's not in quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
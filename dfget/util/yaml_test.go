@@ -0,0 +1,64 @@
+/*
+ * Copyright 1999-2018 Alibaba Group.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"github.com/go-check/check"
+)
+
+func (suite *DFGetUtilSuite) TestParseYAML(c *check.C) {
+	data := `
+---
+# site-wide config
+pattern: p2p
+localLimit: 20971520 # 20M
+callSystem: "dfget #1"
+workHome: '/home/admin/.small-dragonfly'
+node:
+  - 127.0.0.1:8002
+  - "127.0.0.2=2"
+header: [a:1, 'b: 2']
+filter:
+- key
+empty:
+`
+	values, err := ParseYAML([]byte(data))
+	c.Assert(err, check.IsNil)
+	c.Assert(values, check.DeepEquals, map[string]interface{}{
+		"pattern":    "p2p",
+		"localLimit": "20971520",
+		"callSystem": "dfget #1",
+		"workHome":   "/home/admin/.small-dragonfly",
+		"node":       []string{"127.0.0.1:8002", "127.0.0.2=2"},
+		"header":     []string{"a:1", "b: 2"},
+		"filter":     []string{"key"},
+		"empty":      []string{},
+	})
+
+	var invalid = []string{
+		"- a",
+		"a",
+		": a",
+		"a: 1\na: 2",
+		"a:\n  b: 1",
+		"a: 1\n- b",
+	}
+	for _, v := range invalid {
+		_, err := ParseYAML([]byte(v))
+		c.Assert(err, check.NotNil, check.Commentf("yaml:%q", v))
+	}
+}